@@ -0,0 +1,201 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// derivedCacheDir 站点缓存目录下保存派生层内容的子目录
+const derivedCacheDir = "_derived"
+
+// cacheLayoutFile 缓存目录下记录缓存结构版本的文件，cacheLayoutVersion 为当前的版本。
+// 版本 1 直接把修改后的内容保存在站点目录下，版本 2 起站点目录下为原始层，
+// 版本 3 起派生层不再按请求主机分目录保存
+const (
+	cacheLayoutFile    = "cache-layout"
+	cacheLayoutVersion = "3"
+)
+
+// staleTempFileAge 超过该时间的缓存临时文件视为进程被强制终止时遗留，平滑重启时旧进程仍在写入的临时文件不会被删除
+const staleTempFileAge = 10 * time.Minute
+
+// rebuildDerivedCache 从原始层读取内容并重新应用 hack，写入派生层
+func rebuildDerivedCache(rc *runtimeConfig, upstream string, rawPath string, derivedPath string, relPath string, vars TemplateVars) error {
+	_, err, _ := singleGroup.Do("rebuild:"+derivedPath, func() (interface{}, error) {
+		raw, err := os.ReadFile(rawPath)
+		if err != nil {
+			return nil, err
+		}
+		body, err := applyHacks(rc, upstream, relPath, raw, vars)
+		if err != nil {
+			return nil, err
+		}
+		if err := writeCacheFile(derivedPath, body); err != nil {
+			return nil, err
+		}
+		log.Info().Str("raw_path", rawPath).Str("cache_path", derivedPath).Msg("Derived cache rebuilt")
+		return nil, nil
+	})
+	return err
+}
+
+// removeDerivedCache 删除各个摘要下指定文件的派生层内容，filePath 为空时删除站点全部派生层
+func removeDerivedCache(siteDir string, filePath string) error {
+	if filePath == "" {
+		return os.RemoveAll(filepath.Join(siteDir, derivedCacheDir))
+	}
+	matches, err := filepath.Glob(filepath.Join(siteDir, derivedCacheDir, "*", filePath))
+	if err != nil {
+		return err
+	}
+	for _, match := range matches {
+		if err := os.Remove(match); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneDerivedCache 删除不再被当前 hack-map 使用的派生层摘要目录。
+// hackSource 可以是通配规则，无法枚举路径，因此根据目录中已有的文件重新计算摘要来判断
+func pruneDerivedCache() {
+	dirs, err := filepath.Glob(filepath.Join(cacheDir, "*.site", derivedCacheDir, "*"))
+	if err != nil {
+		return
+	}
+	for _, dir := range dirs {
+		if derivedDirActive(dir) {
+			continue
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			log.Error().Err(err).Str("dir", dir).Msg("Error pruning derived cache")
+			continue
+		}
+		log.Info().Str("dir", dir).Msg("Stale derived cache pruned")
+	}
+}
+
+// derivedDirActive 判断摘要目录下是否存在摘要仍然有效的文件，目录结构为 <namespace>.site/_derived/<digest>/<path>，
+// 缓存目录名已经不属于任何上游时视为无效。目录中不记录协议与主机，依次计算两种协议与所有登记主机的摘要
+func derivedDirActive(dir string) bool {
+	digest := filepath.Base(dir)
+	siteDir := filepath.Base(filepath.Dir(filepath.Dir(dir)))
+	upstream, ok := upstreamByNamespace(strings.TrimSuffix(siteDir, ".site"))
+	if !ok {
+		return false
+	}
+	rc := activeRuntime()
+	hosts := []string{""}
+	for host := range rc.knownHosts {
+		hosts = append(hosts, host)
+	}
+	active := false
+	_ = filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return nil
+		}
+		relPath := "/" + filepath.ToSlash(rel)
+		for _, host := range hosts {
+			for _, scheme := range []string{"http", "https"} {
+				if current, _ := hackDigest(rc, upstream.Name, relPath, host, scheme); current == digest {
+					active = true
+					return filepath.SkipAll
+				}
+			}
+		}
+		return nil
+	})
+	return active
+}
+
+// migrateCacheLayout 将旧版本的缓存目录迁移为当前结构，需要在开始服务前调用。
+// 版本 1 把修改后的内容保存在原始层的位置，这些文件会被当作原始内容重复修改，
+// 因此删除当前 hack 作用到的文件，其他文件与上游原始内容一致，继续保留；
+// 派生层的目录结构在版本 2 与 3 之间发生变化，两种情况都删除全部派生层，之后按需重新生成
+func migrateCacheLayout() {
+	markerPath := filepath.Join(cacheDir, cacheLayoutFile)
+	var current string
+	if data, err := os.ReadFile(markerPath); err == nil {
+		current = strings.TrimSpace(string(data))
+	}
+	if current == cacheLayoutVersion {
+		return
+	}
+	hasRawLayer := current != ""
+
+	rc := activeRuntime()
+	sites, err := filepath.Glob(filepath.Join(cacheDir, "*.site"))
+	if err != nil {
+		log.Error().Err(err).Msg("Error listing cache sites")
+		return
+	}
+	for _, siteDir := range sites {
+		upstream, ok := upstreamByNamespace(strings.TrimSuffix(filepath.Base(siteDir), ".site"))
+		if !ok {
+			continue
+		}
+		_ = filepath.WalkDir(siteDir, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil || hasRawLayer {
+				return nil
+			}
+			if entry.IsDir() {
+				if entry.Name() == derivedCacheDir && filepath.Dir(path) == siteDir {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			rel, err := filepath.Rel(siteDir, path)
+			if err != nil || len(rc.findHacks(upstream.Name, "/"+filepath.ToSlash(rel))) == 0 {
+				return nil
+			}
+			if err := os.Remove(path); err != nil {
+				log.Error().Err(err).Str("path", path).Msg("Error removing legacy hacked cache")
+				return nil
+			}
+			log.Info().Str("path", path).Msg("Legacy hacked cache removed")
+			return nil
+		})
+		if err := removeDerivedCache(siteDir, ""); err != nil {
+			log.Error().Err(err).Str("dir", siteDir).Msg("Error removing derived cache")
+			return
+		}
+	}
+
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		log.Error().Err(err).Msg("Error creating cache dir")
+		return
+	}
+	if err := os.WriteFile(markerPath, []byte(cacheLayoutVersion+"\n"), 0644); err != nil {
+		log.Error().Err(err).Str("path", markerPath).Msg("Error writing cache layout version")
+		return
+	}
+	log.Info().Str("version", cacheLayoutVersion).Msg("Cache layout migrated")
+}
+
+// removeStaleTempFiles 删除写入缓存时被中断而遗留的临时文件
+func removeStaleTempFiles() {
+	_ = filepath.WalkDir(cacheDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() || !strings.HasPrefix(entry.Name(), "tmp-") {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < staleTempFileAge {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			log.Error().Err(err).Str("path", path).Msg("Error removing stale temp file")
+			return nil
+		}
+		log.Info().Str("path", path).Msg("Stale temp file removed")
+		return nil
+	})
+}
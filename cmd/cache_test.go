@@ -0,0 +1,185 @@
+package main
+
+import (
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHackDigestHost(t *testing.T) {
+	hacks := []HackConfig{
+		{HackAction: ReplaceText, HackSource: "/host.js", HackDetail: HackDetail{Replacements: []TextReplacement{{Old: "a", New: "{{.Host}}"}}}},
+		{HackAction: ReplaceText, HackSource: "/plain.js", HackDetail: HackDetail{Replacements: []TextReplacement{{Old: "a", New: "{{.MainHost}}"}}}},
+	}
+	c := Config{Routes: []ConfigRoute{{Hosts: []string{"cn.example.com", "*.example.com"}}}}
+	rc := &runtimeConfig{config: &c, hacks: hacks, digests: newDigestCache(),
+		knownHosts: knownHosts(c, map[string]*Upstream{testEntryHost: nil})}
+
+	tests := []struct {
+		relPath   string
+		host      string
+		cacheable bool
+	}{
+		{"/host.js", testEntryHost, true},
+		{"/host.js", "cn.example.com", true},
+		{"/host.js", "any.example.com", false},
+		{"/plain.js", testEntryHost, true},
+		{"/plain.js", "any.example.com", true},
+	}
+	digests := map[string]map[string]bool{}
+	for _, tt := range tests {
+		digest, cacheable := hackDigest(rc, "main", tt.relPath, tt.host, "http")
+		if digest == "" || cacheable != tt.cacheable {
+			t.Errorf("%s %s: digest %q, cacheable %v, want %v", tt.relPath, tt.host, digest, cacheable, tt.cacheable)
+		}
+		if digests[tt.relPath] == nil {
+			digests[tt.relPath] = map[string]bool{}
+		}
+		digests[tt.relPath][digest] = true
+	}
+	if len(digests["/host.js"]) != 3 {
+		t.Errorf("host dependent hack: got %d digests, want one per host", len(digests["/host.js"]))
+	}
+	if len(digests["/plain.js"]) != 1 {
+		t.Errorf("host independent hack: got %d digests, want 1", len(digests["/plain.js"]))
+	}
+}
+
+// derivedFiles 返回上游 main 派生层中的全部文件，路径相对于派生层目录
+func derivedFiles(t *testing.T) []string {
+	t.Helper()
+	root := filepath.Join(cacheDir, currentUpstreams()["main"].SiteDir(), derivedCacheDir)
+	var files []string
+	_ = filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err == nil && !entry.IsDir() {
+			rel, _ := filepath.Rel(root, path)
+			files = append(files, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	return files
+}
+
+func TestProxyDerivedCacheHosts(t *testing.T) {
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/javascript")
+		_, _ = w.Write([]byte("host=a"))
+	})
+	hacks := []HackConfig{
+		{HackAction: ReplaceText, HackSource: "/host.js", HackDetail: HackDetail{Replacements: []TextReplacement{{Old: "a", New: "{{.Host}}"}}}},
+		{HackAction: ReplaceText, HackSource: "/plain.js", HackDetail: HackDetail{Replacements: []TextReplacement{{Old: "a", New: "b"}}}},
+	}
+	newTestProxy(t, upstream, Config{
+		Upstreams: map[string]ConfigUpstream{"main": {EntryList: []string{testEntryHost}}},
+		Routes:    []ConfigRoute{{Hosts: []string{"*.example.net"}, Upstream: "main"}},
+	}, hacks)
+
+	// 每个主机请求两次，第二次命中缓存
+	for _, host := range []string{testEntryHost, "a.example.net", "b.example.net", testEntryHost, "a.example.net"} {
+		if w := proxyGet("http://"+host+"/host.js", nil); w.Body.String() != "host="+host {
+			t.Errorf("%s: got %q", host, w.Body.String())
+		}
+		if w := proxyGet("http://"+host+"/plain.js", nil); w.Body.String() != "host=b" {
+			t.Errorf("%s: got %q", host, w.Body.String())
+		}
+	}
+
+	// 通配路由的主机不写入派生层，与主机无关的结果所有主机共用一份
+	var hostFiles, plainFiles int
+	for _, file := range derivedFiles(t) {
+		parts := strings.Split(file, "/")
+		if len(parts) != 2 {
+			t.Errorf("unexpected derived layout %s", file)
+			continue
+		}
+		switch parts[1] {
+		case "host.js":
+			hostFiles++
+		case "plain.js":
+			plainFiles++
+		}
+	}
+	if hostFiles != 1 || plainFiles != 1 {
+		t.Errorf("derived files %q, want one host.js for the entry host and one shared plain.js", derivedFiles(t))
+	}
+}
+
+func TestMigrateCacheLayout(t *testing.T) {
+	hacks := []HackConfig{
+		{HackAction: ReplaceText, HackSource: "/a.js", HackDetail: HackDetail{Replacements: []TextReplacement{{Old: "a", New: "b"}}}},
+	}
+	tests := []struct {
+		name    string
+		version string // 为空表示没有版本文件
+		kept    []string
+		removed []string
+	}{
+		{"version 1", "", []string{"b.js"}, []string{"a.js", "_derived/x/" + testEntryHost + "/a.js"}},
+		{"version 2", "2", []string{"a.js", "b.js"}, []string{"_derived/x/" + testEntryHost + "/a.js"}},
+		{"current", cacheLayoutVersion, []string{"a.js", "b.js", "_derived/x/" + testEntryHost + "/a.js"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestProxy(t, http.NotFoundHandler(), Config{}, hacks)
+			site := filepath.Join(cacheDir, currentUpstreams()["main"].SiteDir())
+			for _, file := range append(append([]string{}, tt.kept...), tt.removed...) {
+				path := filepath.Join(site, file)
+				if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, []byte("x"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.version != "" {
+				if err := os.WriteFile(filepath.Join(cacheDir, cacheLayoutFile), []byte(tt.version+"\n"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			migrateCacheLayout()
+			for _, file := range tt.kept {
+				if !fileExists(filepath.Join(site, file)) {
+					t.Errorf("%s removed", file)
+				}
+			}
+			for _, file := range tt.removed {
+				if fileExists(filepath.Join(site, file)) {
+					t.Errorf("%s kept", file)
+				}
+			}
+			if data, _ := os.ReadFile(filepath.Join(cacheDir, cacheLayoutFile)); strings.TrimSpace(string(data)) != cacheLayoutVersion {
+				t.Errorf("layout version = %q", data)
+			}
+		})
+	}
+}
+
+func TestPruneDerivedCache(t *testing.T) {
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/javascript")
+		_, _ = w.Write([]byte("a"))
+	})
+	hacks := []HackConfig{
+		{HackAction: ReplaceText, HackSource: "/a.js", HackDetail: HackDetail{Replacements: []TextReplacement{{Old: "a", New: "{{.Host}}"}}}},
+	}
+	newTestProxy(t, upstream, Config{}, hacks)
+	proxyGet("https://"+testEntryHost+"/a.js", nil)
+
+	stale := filepath.Join(cacheDir, currentUpstreams()["main"].SiteDir(), derivedCacheDir, "stale", "a.js")
+	if err := os.MkdirAll(filepath.Dir(stale), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(stale, []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	pruneDerivedCache()
+	files := derivedFiles(t)
+	if len(files) != 1 || strings.HasPrefix(files[0], "stale/") {
+		t.Errorf("derived files after prune = %q, want only the active digest", files)
+	}
+}
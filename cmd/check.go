@@ -0,0 +1,334 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ConfigErrors 汇总配置中的所有错误
+type ConfigErrors []error
+
+func (e ConfigErrors) Error() string {
+	lines := make([]string, len(e))
+	for i, err := range e {
+		lines[i] = err.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// ConfigCheckResult 定义配置检查的结果，存在错误时拒绝启动，警告只记录日志
+type ConfigCheckResult struct {
+	Errors   ConfigErrors
+	Warnings []string
+}
+
+func (r *ConfigCheckResult) errorf(format string, args ...interface{}) {
+	r.Errors = append(r.Errors, fmt.Errorf(format, args...))
+}
+
+func (r *ConfigCheckResult) warnf(format string, args ...interface{}) {
+	r.Warnings = append(r.Warnings, fmt.Sprintf(format, args...))
+}
+
+// checkConfig 检查配置与 hack-map 中的全部问题并一次性返回，hacks 为 hack-map 的解析结果，解析失败时为空
+func checkConfig(c Config, hacks []HackConfig) ConfigCheckResult {
+	var result ConfigCheckResult
+
+	checkTargetURLs(c, &result)
+	urlErrors := len(result.Errors)
+	checkEntryHosts(c, &result)
+	checkAllowedOrigins(c, &result)
+	checkHTTPS(c, &result)
+	checkOverwriteFiles(c, &result)
+
+	// 各部分的解析互不依赖，分别检查以便一次报告全部错误；地址错误已经在上面报告过
+	upstreams, err := loadUpstreams(c)
+	if err != nil && urlErrors == 0 {
+		result.Errors = append(result.Errors, err)
+	}
+	if err := validateHeaderRules("header_rules", c.HeaderRules); err != nil {
+		result.Errors = append(result.Errors, err)
+	}
+	if err := validateURLRewrite(c.URLRewrite); err != nil {
+		result.Errors = append(result.Errors, err)
+	}
+	if _, err := compileErrorPages(c.ErrorPages); err != nil {
+		result.Errors = append(result.Errors, err)
+	}
+	if upstreams != nil {
+		routes, err := compileRoutes(c.Routes, upstreams)
+		if err != nil {
+			result.Errors = append(result.Errors, err)
+		}
+		checkHackUpstreams(hacks, upstreams, routes, &result)
+	}
+	if _, _, err := parseMaintenance(c.Maintenance); err != nil {
+		result.Errors = append(result.Errors, err)
+	}
+	if _, err := parseTrustedProxies(c.TrustedProxies); err != nil {
+		result.Errors = append(result.Errors, err)
+	}
+	if c.ReloadInterval != "" {
+		if interval, err := time.ParseDuration(c.ReloadInterval); err != nil || interval <= 0 {
+			result.errorf("reload_interval: invalid duration %q", c.ReloadInterval)
+		}
+	}
+	if c.Readiness != nil {
+		if c.Readiness.MinFreeDiskMB < 0 {
+			result.errorf("readiness.min_free_disk_mb: must not be negative")
+		}
+		if c.Readiness.MaxLogQueueRatio < 0 || c.Readiness.MaxLogQueueRatio > 1 {
+			result.errorf("readiness.max_log_queue_ratio: must be between 0 and 1")
+		}
+	}
+	if c.ShutdownTimeout != "" {
+		if timeout, err := time.ParseDuration(c.ShutdownTimeout); err != nil || timeout <= 0 {
+			result.errorf("shutdown_timeout: invalid duration %q", c.ShutdownTimeout)
+		}
+	}
+	return result
+}
+
+// checkURL 检查上游地址，必须为带主机名的 http 或 https 地址
+func checkURL(field string, rawURL string, result *ConfigCheckResult) {
+	parsed, err := url.Parse(rawURL)
+	switch {
+	case err != nil:
+		result.errorf("%s: invalid url %q: %v", field, rawURL, err)
+	case parsed.Scheme != "http" && parsed.Scheme != "https":
+		result.errorf("%s: url %q must use http or https", field, rawURL)
+	case parsed.Host == "":
+		result.errorf("%s: url %q has no host", field, rawURL)
+	}
+}
+
+// checkTargetURLs 检查全部上游与源站地址
+func checkTargetURLs(c Config, result *ConfigCheckResult) {
+	if c.MainTargetURL != "" {
+		checkURL("main_target_url", c.MainTargetURL, result)
+	}
+	if c.ResTargetURL != "" {
+		checkURL("res_target_url", c.ResTargetURL, result)
+	}
+	for _, name := range sortedUpstreamNames(c.Upstreams) {
+		upstream := c.Upstreams[name]
+		if len(upstream.Origins) == 0 {
+			checkURL("upstreams."+name+".target_url", upstream.TargetURL, result)
+		}
+		for i, origin := range upstream.Origins {
+			checkURL(fmt.Sprintf("upstreams.%s.origins[%d].url", name, i), origin.URL, result)
+		}
+	}
+	if _, ok := c.Upstreams["main"]; ok && c.MainTargetURL != "" {
+		result.warnf("main_target_url: overridden by upstreams.main")
+	}
+	if _, ok := c.Upstreams["res"]; ok && c.ResTargetURL != "" {
+		result.warnf("res_target_url: overridden by upstreams.res")
+	}
+}
+
+// checkEntryHosts 检查入口主机：格式必须为不含端口的主机名，同一主机不能属于多个上游
+func checkEntryHosts(c Config, result *ConfigCheckResult) {
+	lists := map[string][]string{}
+	if _, ok := c.Upstreams["main"]; !ok {
+		lists["main_entry_list"] = c.MainEntryList
+	}
+	if _, ok := c.Upstreams["res"]; !ok {
+		lists["res_entry_list"] = c.ResEntryList
+	}
+	for name, upstream := range c.Upstreams {
+		lists["upstreams."+name+".entry_list"] = upstream.EntryList
+	}
+
+	fields := make([]string, 0, len(lists))
+	for field := range lists {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	owners := map[string]string{}
+	for _, field := range fields {
+		for i, host := range lists[field] {
+			if host == "" || strings.ContainsAny(host, ":/ ") {
+				result.errorf("%s[%d]: %q must be a host name without scheme, port or path", field, i, host)
+				continue
+			}
+			owner, ok := owners[strings.ToLower(host)]
+			switch {
+			case !ok:
+				owners[strings.ToLower(host)] = field
+			case owner == field:
+				result.warnf("%s[%d]: duplicate host %q", field, i, host)
+			default:
+				result.errorf("%s[%d]: host %q already belongs to %s", field, i, host, owner)
+			}
+		}
+	}
+}
+
+// checkAllowedOrigins 检查跨域来源，格式必须为 scheme://host[:port]
+func checkAllowedOrigins(c Config, result *ConfigCheckResult) {
+	for i, origin := range c.AllowedOrigins {
+		parsed, err := url.Parse(origin)
+		if err != nil || parsed.Scheme == "" || parsed.Host == "" || (parsed.Path != "" && parsed.Path != "/") {
+			result.errorf("allowed_origins[%d]: %q must be scheme://host[:port]", i, origin)
+		} else if parsed.Path == "/" {
+			result.warnf("allowed_origins[%d]: %q has a trailing slash and never matches an Origin header", i, origin)
+		}
+	}
+}
+
+// checkHTTPS 检查 HTTPS 证书与私钥能否读取并且互相匹配
+func checkHTTPS(c Config, result *ConfigCheckResult) {
+	if c.HTTPS == nil {
+		return
+	}
+	if c.HTTPS.Cert == "" || c.HTTPS.Key == "" {
+		result.errorf("https: cert and key are required")
+		return
+	}
+	readable := true
+	for _, file := range []struct{ field, path string }{{"https.cert", c.HTTPS.Cert}, {"https.key", c.HTTPS.Key}} {
+		if _, err := os.ReadFile(file.path); err != nil {
+			result.errorf("%s: unreadable: %v", file.field, err)
+			readable = false
+		}
+	}
+	if !readable {
+		return
+	}
+	if _, err := tls.LoadX509KeyPair(c.HTTPS.Cert, c.HTTPS.Key); err != nil {
+		result.errorf("https: invalid certificate or key: %v", err)
+	}
+}
+
+// checkOverwriteFiles 检查覆盖文件路由引用的文件，缺失时对应路径返回 404
+func checkOverwriteFiles(c Config, result *ConfigCheckResult) {
+	for _, overwrite := range overwriteRoutes {
+		file := filepath.Join(c.OverwriteDir, overwrite.File)
+		info, err := os.Stat(file)
+		if err != nil || info.IsDir() {
+			result.warnf("%s: overwrite file %s not found, the path returns 404", overwrite.Path, file)
+		}
+	}
+}
+
+// checkHackUpstreams 检查 hack 是否会生效：引用的上游必须存在且可以通过入口主机或路由规则访问，
+// hackSource 不能是由覆盖文件直接返回的路径。addFile 已经废弃，只检查路径是否由覆盖文件返回
+func checkHackUpstreams(hacks []HackConfig, upstreams map[string]*Upstream, routes []route, result *ConfigCheckResult) {
+	reachable := map[string]bool{}
+	for name, upstream := range upstreams {
+		reachable[name] = len(upstream.EntryList) > 0
+	}
+	for _, r := range routes {
+		reachable[r.Upstream] = true
+	}
+
+	var addFiles []string
+	for i, hack := range hacks {
+		if hack.HackAction == AddFile {
+			addFiles = append(addFiles, hack.HackSource)
+			if !servedByOverwrite(hack.HackSource) {
+				result.warnf("hack-map [%d] %s: addFile has no effect, the path is not served from an overwrite file", i, hack.HackSource)
+			}
+			continue
+		}
+		for _, overwrite := range overwriteRoutes {
+			if hack.HackSource == overwrite.Path {
+				result.errorf("hack-map [%d] %s: unused, the path is served from overwrite file %s", i, hack.HackSource, overwrite.File)
+			}
+		}
+
+		names := hack.Upstreams
+		if len(names) == 0 {
+			names = make([]string, 0, len(upstreams))
+			for name := range upstreams {
+				names = append(names, name)
+			}
+		}
+		used := false
+		for _, name := range names {
+			if _, ok := upstreams[name]; !ok {
+				result.warnf("hack-map [%d] %s: unknown upstream %q", i, hack.HackSource, name)
+				continue
+			}
+			used = used || reachable[name]
+		}
+		if !used {
+			result.errorf("hack-map [%d] %s: unused, none of its upstreams exist or are reachable by an entry host or route", i, hack.HackSource)
+		}
+	}
+	if len(addFiles) > 0 {
+		result.warnf("hack-map: addFile is deprecated and ignored, overwrite files are served by built-in routes; remove the entries for %s", strings.Join(addFiles, ", "))
+	}
+}
+
+// servedByOverwrite 判断路径是否由覆盖文件直接返回
+func servedByOverwrite(path string) bool {
+	for _, overwrite := range overwriteRoutes {
+		if path == overwrite.Path {
+			return true
+		}
+	}
+	return false
+}
+
+// sortedUpstreamNames 返回排序后的上游名称，保证输出稳定
+func sortedUpstreamNames(upstreams map[string]ConfigUpstream) []string {
+	names := make([]string, 0, len(upstreams))
+	for name := range upstreams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// checkConfigAndHackMap 读取 hack-map 并检查配置与 hack-map 的全部问题，覆盖文件目录需要预先设置
+func checkConfigAndHackMap(c Config) ([]HackConfig, ConfigCheckResult) {
+	return checkConfigAndHackMapFile(c, hackMapPath)
+}
+
+// checkConfigAndHackMapFile 读取指定的 hack-map 文件并与配置一起检查
+func checkConfigAndHackMapFile(c Config, file string) ([]HackConfig, ConfigCheckResult) {
+	hacks, err := loadHackMap(file)
+	result := checkConfig(c, hacks)
+	if err != nil {
+		var hackErrs HackMapErrors
+		if errors.As(err, &hackErrs) {
+			for _, hackErr := range hackErrs {
+				result.Errors = append(result.Errors, hackErr)
+			}
+		} else {
+			result.errorf("%s: %v", file, err)
+		}
+	}
+	return hacks, result
+}
+
+// runCheckCommand 执行 check 子命令，检查配置文件与 hack-map 并一次输出全部错误与警告
+func runCheckCommand(c Config, configPath string, args []string) int {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	strict := fs.Bool("strict", false, "treat warnings as errors")
+	_ = fs.Parse(args)
+
+	_, result := checkConfigAndHackMap(c)
+	for _, warning := range result.Warnings {
+		fmt.Fprintf(os.Stderr, "warning: %s\n", warning)
+	}
+	for _, err := range result.Errors {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+	}
+	if len(result.Errors) > 0 || (*strict && len(result.Warnings) > 0) {
+		return 1
+	}
+	fmt.Fprintf(os.Stdout, "%s: ok\n", configPath)
+	return 0
+}
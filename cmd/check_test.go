@@ -0,0 +1,130 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckOverwriteFiles(t *testing.T) {
+	complete := t.TempDir()
+	for _, overwrite := range overwriteRoutes {
+		if err := os.WriteFile(filepath.Join(complete, overwrite.File), []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	missing := t.TempDir()
+
+	tests := []struct {
+		name     string
+		dir      string
+		warnings int
+	}{
+		{"all files present", complete, 0},
+		{"all files missing", missing, len(overwriteRoutes)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var result ConfigCheckResult
+			checkOverwriteFiles(Config{OverwriteDir: tt.dir}, &result)
+			if len(result.Warnings) != tt.warnings {
+				t.Errorf("got %d warnings, want %d: %v", len(result.Warnings), tt.warnings, result.Warnings)
+			}
+			if len(result.Errors) != 0 {
+				t.Errorf("got errors %v, want none", result.Errors)
+			}
+		})
+	}
+}
+
+func TestCheckHackUpstreams(t *testing.T) {
+	upstreams := map[string]*Upstream{
+		"main":   {Name: "main", EntryList: []string{"game.example.com"}},
+		"res":    {Name: "res", EntryList: []string{"res.example.com"}},
+		"routed": {Name: "routed"},
+		"hidden": {Name: "hidden"},
+	}
+	routes := []route{{ConfigRoute: ConfigRoute{Upstream: "routed"}}}
+
+	tests := []struct {
+		name     string
+		hack     HackConfig
+		errors   []string
+		warnings []string
+	}{
+		{
+			name: "all upstreams",
+			hack: HackConfig{HackSource: "/index.html"},
+		},
+		{
+			name: "entry host upstream",
+			hack: HackConfig{HackSource: "/index.html", Upstreams: []string{"main"}},
+		},
+		{
+			name: "routed upstream",
+			hack: HackConfig{HackSource: "/index.html", Upstreams: []string{"routed"}},
+		},
+		{
+			name:     "one unknown upstream",
+			hack:     HackConfig{HackSource: "/index.html", Upstreams: []string{"main", "gone"}},
+			warnings: []string{`unknown upstream "gone"`},
+		},
+		{
+			name:     "only unknown upstreams",
+			hack:     HackConfig{HackSource: "/index.html", Upstreams: []string{"gone"}},
+			errors:   []string{"unused, none of its upstreams"},
+			warnings: []string{`unknown upstream "gone"`},
+		},
+		{
+			name:   "unreachable upstream",
+			hack:   HackConfig{HackSource: "/index.html", Upstreams: []string{"hidden"}},
+			errors: []string{"unused, none of its upstreams"},
+		},
+		{
+			name:   "overwrite route path",
+			hack:   HackConfig{HackSource: "/config.ini", Upstreams: []string{"main"}},
+			errors: []string{"served from overwrite file config.ini"},
+		},
+		{
+			name: "pattern covering overwrite route",
+			hack: HackConfig{HackSource: "/*.ini", Upstreams: []string{"main"}},
+		},
+		{
+			name:     "deprecated addFile",
+			hack:     HackConfig{HackAction: AddFile, HackSource: "/config.ini", Upstreams: []string{"hidden"}},
+			warnings: []string{"addFile is deprecated and ignored, overwrite files are served by built-in routes; remove the entries for /config.ini"},
+		},
+		{
+			name: "addFile without overwrite route",
+			hack: HackConfig{HackAction: AddFile, HackSource: "/servers.ini"},
+			warnings: []string{
+				"addFile has no effect, the path is not served from an overwrite file",
+				"addFile is deprecated",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var result ConfigCheckResult
+			checkHackUpstreams([]HackConfig{tt.hack}, upstreams, routes, &result)
+
+			if len(result.Errors) != len(tt.errors) {
+				t.Fatalf("got errors %v, want %d", result.Errors, len(tt.errors))
+			}
+			for i, want := range tt.errors {
+				if !strings.Contains(result.Errors[i].Error(), want) {
+					t.Errorf("error %q does not contain %q", result.Errors[i], want)
+				}
+			}
+			if len(result.Warnings) != len(tt.warnings) {
+				t.Fatalf("got warnings %v, want %d", result.Warnings, len(tt.warnings))
+			}
+			for i, want := range tt.warnings {
+				if !strings.Contains(result.Warnings[i], want) {
+					t.Errorf("warning %q does not contain %q", result.Warnings[i], want)
+				}
+			}
+		})
+	}
+}
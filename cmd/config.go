@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// envPrefix 环境变量覆盖配置项时使用的前缀，例如 RA2PROXY_HTTP_PORT 对应 http.port
+const envPrefix = "RA2PROXY_"
+
+const (
+	defaultConfigPath   = "config/config.json"
+	defaultCacheDir     = "./_cacheRaw"
+	defaultOverwriteDir = "overwrite"
+	defaultViewsDir     = "views"
+)
+
+// viewsDir 内置页面模板所在目录，默认错误页面与维护页面均相对于该目录
+var viewsDir = defaultViewsDir
+
+// viewFile 返回内置页面模板的路径
+func viewFile(name string) string {
+	return filepath.Join(viewsDir, name)
+}
+
+// commandLine 定义全局命令行参数，优先级高于环境变量与配置文件
+type commandLine struct {
+	flags        *flag.FlagSet
+	configPath   string
+	configFiles  []string // 最近一次读取的配置文件及其 include 的片段，用于检测变化
+	hackMapPath  string
+	cacheDir     string
+	overwriteDir string
+	viewsDir     string
+}
+
+// parseCommandLine 解析子命令之前的全局参数，例如 ra2web-proxy -config /etc/ra2web/config.json preview -host ...
+func parseCommandLine(args []string) (*commandLine, []string) {
+	cl := &commandLine{flags: flag.NewFlagSet("ra2web-proxy", flag.ExitOnError)}
+	cl.flags.StringVar(&cl.configPath, "config", "", "config file path, .json, .yaml or .toml (env RA2PROXY_CONFIG, default "+defaultConfigPath+")")
+	cl.flags.StringVar(&cl.hackMapPath, "hack-map", "", "hack map file path (env RA2PROXY_HACK_MAP, default hack-map.json next to the config file)")
+	cl.flags.StringVar(&cl.cacheDir, "cache-dir", "", "cache directory, overrides cache_dir (default "+defaultCacheDir+")")
+	cl.flags.StringVar(&cl.overwriteDir, "overwrite-dir", "", "overwrite files directory, overrides overwrite_dir (default "+defaultOverwriteDir+")")
+	cl.flags.StringVar(&cl.viewsDir, "views-dir", "", "built-in page templates directory, overrides views_dir (default "+defaultViewsDir+")")
+	_ = cl.flags.Parse(args)
+	return cl, cl.flags.Args()
+}
+
+// isSet 判断参数是否在命令行中显式指定
+func (cl *commandLine) isSet(name string) bool {
+	set := false
+	cl.flags.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// resolvePaths 按命令行、环境变量、默认值的顺序确定配置文件与 hack-map 的路径。
+// 覆盖文件目录也在此预先确定，读取配置文件后由 setDirs 按配置更新
+func (cl *commandLine) resolvePaths() {
+	configPath := firstNonEmpty(cl.configPath, os.Getenv(envPrefix+"CONFIG"), defaultConfigPath)
+	hackMapPath = firstNonEmpty(cl.hackMapPath, os.Getenv(envPrefix+"HACK_MAP"),
+		filepath.Join(filepath.Dir(configPath), "hack-map.json"))
+	cl.configPath = configPath
+	overwriteDir = firstNonEmpty(cl.overwriteDir, os.Getenv(envPrefix+"OVERWRITE_DIR"), defaultOverwriteDir)
+}
+
+// loadConfig 读取配置文件并展开 include，依次应用环境变量与命令行参数
+func loadConfig(cl *commandLine) (Config, error) {
+	c, files, err := readConfigFile(cl.configPath)
+	if err != nil {
+		return c, err
+	}
+	cl.configFiles = files
+	if err := applyEnvOverrides(&c, os.Environ()); err != nil {
+		return c, err
+	}
+
+	if cl.isSet("cache-dir") {
+		c.CacheDir = cl.cacheDir
+	}
+	if cl.isSet("overwrite-dir") {
+		c.OverwriteDir = cl.overwriteDir
+	}
+	if cl.isSet("views-dir") {
+		c.ViewsDir = cl.viewsDir
+	}
+	c.CacheDir = firstNonEmpty(c.CacheDir, defaultCacheDir)
+	c.OverwriteDir = firstNonEmpty(c.OverwriteDir, defaultOverwriteDir)
+	c.ViewsDir = firstNonEmpty(c.ViewsDir, defaultViewsDir)
+	return c, nil
+}
+
+// setDirs 设置目录相关的全局变量，只在启动时调用，修改目录需要重启
+func setDirs(c *Config) {
+	cacheDir = c.CacheDir
+	overwriteDir = c.OverwriteDir
+	viewsDir = c.ViewsDir
+}
+
+// applyEnvOverrides 使用 RA2PROXY_ 开头的环境变量覆盖配置项。
+// 变量名由 JSON 字段名逐级转为大写并用下划线连接，例如 RA2PROXY_HTTP_PORT、RA2PROXY_MAIN_TARGET_URL；
+// 字符串列表使用逗号分隔，map 以及结构体列表等复杂字段使用 JSON，例如 RA2PROXY_UPSTREAMS='{"main": {...}}'
+func applyEnvOverrides(c *Config, environ []string) error {
+	env := map[string]string{}
+	for _, kv := range environ {
+		name, value, ok := strings.Cut(kv, "=")
+		if ok && strings.HasPrefix(name, envPrefix) {
+			env[name] = value
+		}
+	}
+	if len(env) == 0 {
+		return nil
+	}
+	_, err := overrideStruct(reflect.ValueOf(c).Elem(), strings.TrimSuffix(envPrefix, "_"), env)
+	return err
+}
+
+// overrideStruct 递归覆盖结构体字段，返回是否有字段被覆盖
+func overrideStruct(v reflect.Value, prefix string, env map[string]string) (bool, error) {
+	changed := false
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := strings.Split(field.Tag.Get("json"), ",")[0]
+		if tag == "" || tag == "-" || !field.IsExported() {
+			continue
+		}
+		name := prefix + "_" + strings.ToUpper(tag)
+		ok, err := overrideField(v.Field(i), name, env)
+		if err != nil {
+			return changed, err
+		}
+		changed = changed || ok
+	}
+	return changed, nil
+}
+
+// overrideField 使用环境变量覆盖单个字段，结构体字段会继续按子字段查找
+func overrideField(v reflect.Value, name string, env map[string]string) (bool, error) {
+	value, ok := env[name]
+
+	switch {
+	case v.Kind() == reflect.Struct:
+		if ok {
+			return true, unmarshalEnv(v, name, value)
+		}
+		return overrideStruct(v, name, env)
+	case v.Kind() == reflect.Ptr && v.Type().Elem().Kind() == reflect.Struct:
+		if ok {
+			return true, unmarshalEnv(v, name, value)
+		}
+		// 指针为空时只有子字段被覆盖才创建
+		elem := reflect.New(v.Type().Elem())
+		if !v.IsNil() {
+			elem.Elem().Set(v.Elem())
+		}
+		changed, err := overrideStruct(elem.Elem(), name, env)
+		if changed && err == nil {
+			v.Set(elem)
+		}
+		return changed, err
+	}
+
+	if !ok {
+		return false, nil
+	}
+	if v.Kind() == reflect.Ptr {
+		elem := reflect.New(v.Type().Elem())
+		if err := setScalar(elem.Elem(), name, value); err != nil {
+			return false, err
+		}
+		v.Set(elem)
+		return true, nil
+	}
+	return true, setScalar(v, name, value)
+}
+
+// setScalar 解析环境变量的值并写入字段
+func setScalar(v reflect.Value, name string, value string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%s: invalid bool %q", name, value)
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int64, reflect.Int32:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%s: invalid integer %q", name, value)
+		}
+		v.SetInt(n)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.String && !strings.HasPrefix(strings.TrimSpace(value), "[") {
+			items := []string{}
+			for _, item := range strings.Split(value, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					items = append(items, item)
+				}
+			}
+			v.Set(reflect.ValueOf(items))
+			return nil
+		}
+		return unmarshalEnv(v, name, value)
+	default:
+		return unmarshalEnv(v, name, value)
+	}
+	return nil
+}
+
+// unmarshalEnv 将 JSON 格式的环境变量整体写入字段
+func unmarshalEnv(v reflect.Value, name string, value string) error {
+	target := reflect.New(v.Type())
+	if err := json.Unmarshal([]byte(value), target.Interface()); err != nil {
+		return fmt.Errorf("%s: invalid JSON value: %w", name, err)
+	}
+	v.Set(target.Elem())
+	return nil
+}
+
+// runPrintConfigCommand 执行 print-config 子命令，输出合并环境变量与命令行参数之后的生效配置
+func runPrintConfigCommand(c Config) int {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(c); err != nil {
+		fmt.Fprintf(os.Stderr, "unable to print config: %v\n", err)
+		return 1
+	}
+	return 0
+}
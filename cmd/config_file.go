@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// includeKey 配置文件中引用其他片段文件的字段，值为路径或路径列表，支持 glob，相对于当前文件所在目录
+const includeKey = "include"
+
+// readConfigFile 读取配置文件并展开 include，返回合并之后的配置与读取过的全部文件。
+// 格式按扩展名判断：.json、.yaml/.yml、.toml。合并规则：
+// 先按顺序合并 include 的片段（glob 匹配的文件按文件名排序），再合并当前文件自身的内容；
+// 对象逐个字段递归合并，列表按顺序拼接，其他值后者覆盖前者
+func readConfigFile(path string) (Config, []string, error) {
+	var c Config
+	tree, files, err := readConfigTree(path, nil)
+	if err != nil {
+		return c, files, err
+	}
+
+	data, err := json.Marshal(tree)
+	if err != nil {
+		return c, files, fmt.Errorf("unable to parse config file %s: %w", path, err)
+	}
+	if err := json.Unmarshal(data, &c); err != nil {
+		return c, files, fmt.Errorf("unable to parse config file %s: %w", path, err)
+	}
+	return c, files, nil
+}
+
+// readConfigTree 读取单个配置文件并递归展开 include，stack 为当前的引用链，用于检测循环引用
+func readConfigTree(path string, stack []string) (map[string]interface{}, []string, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, parent := range stack {
+		if parent == absPath {
+			return nil, nil, fmt.Errorf("config include cycle: %s -> %s", strings.Join(stack, " -> "), absPath)
+		}
+	}
+	stack = append(stack, absPath)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to read config file: %w", err)
+	}
+	tree, err := decodeConfigData(path, data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to parse config file %s: %w", path, err)
+	}
+	files := []string{path}
+
+	includes, err := includePaths(path, tree[includeKey])
+	if err != nil {
+		return nil, nil, err
+	}
+	delete(tree, includeKey)
+
+	merged := map[string]interface{}{}
+	for _, include := range includes {
+		fragment, fragmentFiles, err := readConfigTree(include, stack)
+		if err != nil {
+			return nil, nil, err
+		}
+		files = append(files, fragmentFiles...)
+		merged = mergeConfigTree(merged, fragment).(map[string]interface{})
+	}
+	merged = mergeConfigTree(merged, tree).(map[string]interface{})
+	return merged, files, nil
+}
+
+// decodeConfigData 按扩展名解析配置文件内容，统一为 JSON 兼容的数据结构
+func decodeConfigData(path string, data []byte) (map[string]interface{}, error) {
+	var tree map[string]interface{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		if err := decoder.Decode(&tree); err != nil {
+			return nil, err
+		}
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(data, &tree); err != nil {
+			return nil, err
+		}
+	case ".toml":
+		if err := toml.Unmarshal(data, &tree); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported config format %q, expect .json, .yaml, .yml or .toml", filepath.Ext(path))
+	}
+	if tree == nil {
+		tree = map[string]interface{}{}
+	}
+	normalized, err := normalizeConfigValue(tree)
+	if err != nil {
+		return nil, err
+	}
+	return normalized.(map[string]interface{}), nil
+}
+
+// normalizeConfigValue 将 YAML 解析出的 map[interface{}]interface{} 等类型转为 JSON 兼容的类型
+func normalizeConfigValue(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			normalized, err := normalizeConfigValue(item)
+			if err != nil {
+				return nil, err
+			}
+			v[key] = normalized
+		}
+		return v, nil
+	case map[interface{}]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			normalized, err := normalizeConfigValue(item)
+			if err != nil {
+				return nil, err
+			}
+			result[fmt.Sprint(key)] = normalized
+		}
+		return result, nil
+	case []interface{}:
+		for i, item := range v {
+			normalized, err := normalizeConfigValue(item)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = normalized
+		}
+		return v, nil
+	case []map[string]interface{}:
+		// TOML 的表数组
+		result := make([]interface{}, len(v))
+		for i, item := range v {
+			normalized, err := normalizeConfigValue(item)
+			if err != nil {
+				return nil, err
+			}
+			result[i] = normalized
+		}
+		return result, nil
+	default:
+		return v, nil
+	}
+}
+
+// includePaths 解析 include 字段，返回按顺序展开之后的文件列表
+func includePaths(path string, value interface{}) ([]string, error) {
+	var patterns []string
+	switch v := value.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		patterns = []string{v}
+	case []interface{}:
+		for _, item := range v {
+			pattern, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s: include must be a path or a list of paths", path)
+			}
+			patterns = append(patterns, pattern)
+		}
+	default:
+		return nil, fmt.Errorf("%s: include must be a path or a list of paths", path)
+	}
+
+	var paths []string
+	for _, pattern := range patterns {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(path), pattern)
+		}
+		if !strings.ContainsAny(pattern, "*?[") {
+			paths = append(paths, pattern)
+			continue
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid include pattern %q: %w", path, pattern, err)
+		}
+		sort.Strings(matches)
+		paths = append(paths, matches...)
+	}
+	return paths, nil
+}
+
+// mergeConfigTree 将 override 合并到 base：对象递归合并，列表拼接，其他值使用 override
+func mergeConfigTree(base interface{}, override interface{}) interface{} {
+	switch o := override.(type) {
+	case map[string]interface{}:
+		b, ok := base.(map[string]interface{})
+		if !ok {
+			return o
+		}
+		result := make(map[string]interface{}, len(b)+len(o))
+		for key, value := range b {
+			result[key] = value
+		}
+		for key, value := range o {
+			if existing, ok := result[key]; ok {
+				result[key] = mergeConfigTree(existing, value)
+			} else {
+				result[key] = value
+			}
+		}
+		return result
+	case []interface{}:
+		b, ok := base.([]interface{})
+		if !ok {
+			return o
+		}
+		return append(append([]interface{}(nil), b...), o...)
+	default:
+		return o
+	}
+}
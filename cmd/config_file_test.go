@@ -0,0 +1,206 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMergeConfigTree(t *testing.T) {
+	type tree = map[string]interface{}
+	type list = []interface{}
+
+	tests := []struct {
+		name     string
+		base     interface{}
+		override interface{}
+		want     interface{}
+	}{
+		{"scalar override", "a", "b", "b"},
+		{"nil base", nil, tree{"a": 1}, tree{"a": 1}},
+		{"lists concatenate", list{"a", "b"}, list{"c"}, list{"a", "b", "c"}},
+		{"list replaces scalar", "a", list{"b"}, list{"b"}},
+		{"scalar replaces object", tree{"a": 1}, "x", "x"},
+		{"object replaces list", list{"a"}, tree{"a": 1}, tree{"a": 1}},
+		{
+			name:     "objects merge recursively",
+			base:     tree{"http": tree{"port": 80}, "main_entry_list": list{"a"}, "cache_dir": "x"},
+			override: tree{"http": tree{"host": "h"}, "main_entry_list": list{"b"}, "views_dir": "v"},
+			want:     tree{"http": tree{"port": 80, "host": "h"}, "main_entry_list": list{"a", "b"}, "cache_dir": "x", "views_dir": "v"},
+		},
+		{
+			name:     "nested override",
+			base:     tree{"upstreams": tree{"main": tree{"target_url": "a", "entry_list": list{"x"}}}},
+			override: tree{"upstreams": tree{"main": tree{"target_url": "b"}, "res": tree{"target_url": "c"}}},
+			want:     tree{"upstreams": tree{"main": tree{"target_url": "b", "entry_list": list{"x"}}, "res": tree{"target_url": "c"}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mergeConfigTree(tt.base, tt.override); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMergeConfigTreeDoesNotModifyInputs(t *testing.T) {
+	// 预留容量，确保合并列表时不会写入 base 的底层数组
+	baseList := append(make([]interface{}, 0, 4), "a")
+	base := map[string]interface{}{"list": baseList, "obj": map[string]interface{}{"a": 1}}
+	override := map[string]interface{}{"list": []interface{}{"b"}, "obj": map[string]interface{}{"b": 2}}
+	mergeConfigTree(base, override)
+	mergeConfigTree(base, map[string]interface{}{"list": []interface{}{"c"}})
+
+	if !reflect.DeepEqual(base, map[string]interface{}{"list": []interface{}{"a"}, "obj": map[string]interface{}{"a": 1}}) {
+		t.Errorf("base modified: %#v", base)
+	}
+	if got := baseList[:2][1]; got != nil {
+		t.Errorf("base list backing array modified: %v", got)
+	}
+}
+
+// writeConfigFiles 在临时目录中写入文件，返回目录路径
+func writeConfigFiles(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestIncludePaths(t *testing.T) {
+	dir := writeConfigFiles(t, map[string]string{
+		"conf.d/20-b.json": "{}",
+		"conf.d/10-a.json": "{}",
+		"conf.d/30-c.yaml": "",
+		"extra.json":       "{}",
+	})
+	config := filepath.Join(dir, "config.json")
+
+	tests := []struct {
+		name    string
+		value   interface{}
+		want    []string // 相对于 dir 的路径
+		wantErr bool
+	}{
+		{"none", nil, nil, false},
+		{"single path", "extra.json", []string{"extra.json"}, false},
+		{"missing literal path is kept", "missing.json", []string{"missing.json"}, false},
+		{"glob sorted by name", "conf.d/*.json", []string{"conf.d/10-a.json", "conf.d/20-b.json"}, false},
+		{"glob without matches", "none.d/*.json", nil, false},
+		{"list keeps order", []interface{}{"extra.json", "conf.d/*"}, []string{"extra.json", "conf.d/10-a.json", "conf.d/20-b.json", "conf.d/30-c.yaml"}, false},
+		{"absolute path", filepath.Join(dir, "extra.json"), []string{"extra.json"}, false},
+		{"invalid type", 1, nil, true},
+		{"invalid list item", []interface{}{"a.json", 1}, nil, true},
+		{"invalid pattern", "conf.d/[.json", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			paths, err := includePaths(config, tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			var got []string
+			for _, path := range paths {
+				rel, err := filepath.Rel(dir, path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, filepath.ToSlash(rel))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadConfigFileIncludes(t *testing.T) {
+	dir := writeConfigFiles(t, map[string]string{
+		"config.json": `{
+  "include": ["base.yaml", "conf.d/*.toml"],
+  "main_entry_list": ["main.example.com"],
+  "http": {"port": 8080}
+}`,
+		"base.yaml": `
+main_entry_list: [base.example.com]
+cache_dir: base-cache
+http:
+  port: 80
+`,
+		"conf.d/20-late.toml":  "cache_dir = \"late-cache\"\n",
+		"conf.d/10-early.toml": "cache_dir = \"early-cache\"\nres_entry_list = [\"res.example.com\"]\n",
+	})
+
+	c, files, err := readConfigFile(filepath.Join(dir, "config.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(c.MainEntryList, []string{"base.example.com", "main.example.com"}) {
+		t.Errorf("MainEntryList = %q", c.MainEntryList)
+	}
+	if !reflect.DeepEqual(c.ResEntryList, []string{"res.example.com"}) {
+		t.Errorf("ResEntryList = %q", c.ResEntryList)
+	}
+	if c.CacheDir != "late-cache" {
+		t.Errorf("CacheDir = %q, want the last fragment to win", c.CacheDir)
+	}
+	if c.HTTP.Port != 8080 {
+		t.Errorf("HTTP.Port = %d, want the including file to win", c.HTTP.Port)
+	}
+	if len(files) != 4 {
+		t.Errorf("files = %q, want 4 files", files)
+	}
+}
+
+func TestReadConfigFileErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		want  string
+	}{
+		{
+			name:  "include cycle",
+			files: map[string]string{"config.json": `{"include": "a.json"}`, "a.json": `{"include": "config.json"}`},
+			want:  "config include cycle",
+		},
+		{
+			name:  "self include",
+			files: map[string]string{"config.json": `{"include": "config.json"}`},
+			want:  "config include cycle",
+		},
+		{
+			name:  "missing include",
+			files: map[string]string{"config.json": `{"include": "missing.json"}`},
+			want:  "unable to read config file",
+		},
+		{
+			name:  "unsupported format",
+			files: map[string]string{"config.json": `{"include": "a.ini"}`, "a.ini": "x=1"},
+			want:  "unsupported config format",
+		},
+		{
+			name:  "invalid fragment",
+			files: map[string]string{"config.json": `{"include": "a.yaml"}`, "a.yaml": "a: [1"},
+			want:  "a.yaml",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := writeConfigFiles(t, tt.files)
+			_, _, err := readConfigFile(filepath.Join(dir, "config.json"))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got %v, want error containing %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestApplyEnvOverrides(t *testing.T) {
+	tests := []struct {
+		name    string
+		base    Config
+		environ []string
+		check   func(t *testing.T, c Config)
+	}{
+		{
+			name:    "string",
+			environ: []string{"RA2PROXY_MAIN_TARGET_URL=https://game.example.com/"},
+			check: func(t *testing.T, c Config) {
+				if c.MainTargetURL != "https://game.example.com/" {
+					t.Errorf("MainTargetURL = %q", c.MainTargetURL)
+				}
+			},
+		},
+		{
+			name:    "nested struct",
+			environ: []string{"RA2PROXY_HTTP_PORT=8080"},
+			check: func(t *testing.T, c Config) {
+				if c.HTTP.Port != 8080 {
+					t.Errorf("HTTP.Port = %d", c.HTTP.Port)
+				}
+				if c.HTTPS != nil {
+					t.Errorf("HTTPS = %+v, want nil", c.HTTPS)
+				}
+			},
+		},
+		{
+			name:    "nil pointer struct is created for its fields",
+			environ: []string{"RA2PROXY_HTTPS_PORT=8443", "RA2PROXY_HTTPS_CERT=cert.pem"},
+			check: func(t *testing.T, c Config) {
+				if c.HTTPS == nil || c.HTTPS.Port != 8443 || c.HTTPS.Cert != "cert.pem" || c.HTTPS.Key != "" {
+					t.Errorf("HTTPS = %+v", c.HTTPS)
+				}
+			},
+		},
+		{
+			name:    "existing pointer struct keeps other fields",
+			base:    Config{HTTPS: &ConfigHTTPS{Port: 443, Cert: "a.pem", Key: "a.key"}},
+			environ: []string{"RA2PROXY_HTTPS_CERT=b.pem"},
+			check: func(t *testing.T, c Config) {
+				if *c.HTTPS != (ConfigHTTPS{Port: 443, Cert: "b.pem", Key: "a.key"}) {
+					t.Errorf("HTTPS = %+v", c.HTTPS)
+				}
+			},
+		},
+		{
+			name:    "comma separated list",
+			base:    Config{MainEntryList: []string{"old.example.com"}},
+			environ: []string{"RA2PROXY_MAIN_ENTRY_LIST= a.example.com, ,b.example.com "},
+			check: func(t *testing.T, c Config) {
+				if !reflect.DeepEqual(c.MainEntryList, []string{"a.example.com", "b.example.com"}) {
+					t.Errorf("MainEntryList = %q", c.MainEntryList)
+				}
+			},
+		},
+		{
+			name:    "JSON list",
+			environ: []string{`RA2PROXY_API_ENDPOINT=["a.example.com", "b,c.example.com"]`},
+			check: func(t *testing.T, c Config) {
+				if !reflect.DeepEqual(c.ApiEndpoint, []string{"a.example.com", "b,c.example.com"}) {
+					t.Errorf("ApiEndpoint = %q", c.ApiEndpoint)
+				}
+			},
+		},
+		{
+			name:    "empty list",
+			base:    Config{TrustedProxies: []string{"10.0.0.0/8"}},
+			environ: []string{"RA2PROXY_TRUSTED_PROXIES="},
+			check: func(t *testing.T, c Config) {
+				if c.TrustedProxies == nil || len(c.TrustedProxies) != 0 {
+					t.Errorf("TrustedProxies = %#v, want empty list", c.TrustedProxies)
+				}
+			},
+		},
+		{
+			name:    "list in nested pointer struct",
+			environ: []string{"RA2PROXY_MAINTENANCE_ALLOW_IPS=10.0.0.0/8,127.0.0.1", "RA2PROXY_MAINTENANCE_ENABLED=true"},
+			check: func(t *testing.T, c Config) {
+				if c.Maintenance == nil || !c.Maintenance.Enabled ||
+					!reflect.DeepEqual(c.Maintenance.AllowIPs, []string{"10.0.0.0/8", "127.0.0.1"}) {
+					t.Errorf("Maintenance = %+v", c.Maintenance)
+				}
+			},
+		},
+		{
+			name:    "float as JSON",
+			environ: []string{"RA2PROXY_READINESS_MAX_LOG_QUEUE_RATIO=0.5"},
+			check: func(t *testing.T, c Config) {
+				if c.Readiness == nil || c.Readiness.MaxLogQueueRatio != 0.5 {
+					t.Errorf("Readiness = %+v", c.Readiness)
+				}
+			},
+		},
+		{
+			name:    "map as JSON",
+			environ: []string{`RA2PROXY_UPSTREAMS={"main": {"target_url": "https://game.example.com/", "entry_list": ["a.example.com"]}}`},
+			check: func(t *testing.T, c Config) {
+				main, ok := c.Upstreams["main"]
+				if !ok || main.TargetURL != "https://game.example.com/" || !reflect.DeepEqual(main.EntryList, []string{"a.example.com"}) {
+					t.Errorf("Upstreams = %+v", c.Upstreams)
+				}
+			},
+		},
+		{
+			name:    "whole struct as JSON",
+			environ: []string{`RA2PROXY_HTTPS={"port": 8443, "cert": "c.pem", "key": "c.key"}`},
+			check: func(t *testing.T, c Config) {
+				if c.HTTPS == nil || *c.HTTPS != (ConfigHTTPS{Port: 8443, Cert: "c.pem", Key: "c.key"}) {
+					t.Errorf("HTTPS = %+v", c.HTTPS)
+				}
+			},
+		},
+		{
+			name:    "unrelated variables are ignored",
+			base:    Config{CacheDir: "cache"},
+			environ: []string{"HOME=/root", "RA2PROXY_UNKNOWN=1", "CACHE_DIR=x", "RA2PROXY_CACHE_DIR"},
+			check: func(t *testing.T, c Config) {
+				if c.CacheDir != "cache" {
+					t.Errorf("CacheDir = %q", c.CacheDir)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := tt.base
+			if err := applyEnvOverrides(&c, tt.environ); err != nil {
+				t.Fatal(err)
+			}
+			tt.check(t, c)
+		})
+	}
+}
+
+func TestApplyEnvOverridesErrors(t *testing.T) {
+	tests := []struct {
+		env  string
+		want string
+	}{
+		{"RA2PROXY_HTTP_PORT=http", "RA2PROXY_HTTP_PORT: invalid integer"},
+		{"RA2PROXY_REUSE_PORT=maybe", "RA2PROXY_REUSE_PORT: invalid bool"},
+		{"RA2PROXY_UPSTREAMS={", "RA2PROXY_UPSTREAMS: invalid JSON"},
+		{"RA2PROXY_MAIN_ENTRY_LIST=[1, 2]", "RA2PROXY_MAIN_ENTRY_LIST: invalid JSON"},
+		{"RA2PROXY_READINESS_MIN_FREE_DISK_MB=1.5", "RA2PROXY_READINESS_MIN_FREE_DISK_MB: invalid integer"},
+	}
+	for _, tt := range tests {
+		var c Config
+		err := applyEnvOverrides(&c, []string{tt.env})
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got %v, want error containing %q", tt.env, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ErrorPageKind 定义请求期望的错误响应类型
+type ErrorPageKind string
+
+const (
+	HTMLErrorPage  ErrorPageKind = "html"  // 页面请求，返回 HTML 页面
+	JSONErrorPage  ErrorPageKind = "json"  // 接口请求，返回 JSON
+	AssetErrorPage ErrorPageKind = "asset" // 脚本、样式、图片等资源请求，默认返回空响应体
+)
+
+// ConfigErrorPage 定义错误页面表中的一项，按顺序匹配，第一项命中的配置生效
+type ConfigErrorPage struct {
+	Status      string        `json:"status"`       // 状态码或范围，例如 404、5xx、500-504，为空时匹配全部错误
+	Hosts       []string      `json:"hosts"`        // 请求主机，支持 *.example.com 形式的通配，为空时匹配全部主机
+	Accept      ErrorPageKind `json:"accept"`       // 请求类型: html/json/asset，为空时匹配全部类型
+	File        string        `json:"file"`         // 页面模板文件，为空时返回空响应体
+	ContentType string        `json:"content_type"` // 响应类型，为空时根据文件扩展名判断
+}
+
+// ErrorPageVars 定义错误页面模板可用的变量
+type ErrorPageVars struct {
+	TemplateVars
+	Status     int    // 状态码
+	StatusText string // 状态码说明，例如 Not Found
+}
+
+// defaultErrorPages 返回未配置 error_pages 时使用的错误页面表，页面位于 views 目录
+func defaultErrorPages() []ConfigErrorPage {
+	return []ConfigErrorPage{
+		{Status: "404", Accept: HTMLErrorPage, File: viewFile("404page.html")},
+		{Accept: HTMLErrorPage, File: viewFile("error.html")},
+		{Accept: JSONErrorPage, File: viewFile("error.json")},
+		{Accept: AssetErrorPage},
+	}
+}
+
+// errorPageFuncs 错误页面模板在 templateFuncs 之外可用的辅助函数
+var errorPageFuncs = template.FuncMap{
+	// json 将值编码为 JSON，用于 JSON 错误页面，例如 {{json .RequestID}}
+	"json": func(value interface{}) (string, error) {
+		data, err := json.Marshal(value)
+		return string(data), err
+	},
+}
+
+// errorPage 编译后的错误页面，模板在加载配置时解析，随运行时状态一起替换
+type errorPage struct {
+	ConfigErrorPage
+	minStatus, maxStatus int
+	contentType          string
+	tmpl                 pageTemplate // File 为空时为 nil
+}
+
+// pageTemplate html/template 与 text/template 共同的渲染方法
+type pageTemplate interface {
+	Execute(w io.Writer, data interface{}) error
+}
+
+// compileErrorPages 校验错误页面表并解析页面模板，pages 为空时使用默认表。
+// 默认表的页面文件缺失时只记录日志并返回空响应体，不影响启动
+func compileErrorPages(pages []ConfigErrorPage) ([]errorPage, error) {
+	builtin := pages == nil
+	if builtin {
+		pages = defaultErrorPages()
+	}
+
+	compiled := make([]errorPage, 0, len(pages))
+	for i, page := range pages {
+		minStatus, maxStatus, err := parseStatusRange(page.Status)
+		if err != nil {
+			return nil, fmt.Errorf("error_pages[%d]: %w", i, err)
+		}
+		switch page.Accept {
+		case "", HTMLErrorPage, JSONErrorPage, AssetErrorPage:
+		default:
+			return nil, fmt.Errorf("error_pages[%d]: unknown accept %q", i, page.Accept)
+		}
+
+		compiledPage := errorPage{ConfigErrorPage: page, minStatus: minStatus, maxStatus: maxStatus}
+		if page.File != "" {
+			compiledPage.contentType = page.ContentType
+			if compiledPage.contentType == "" {
+				compiledPage.contentType = mime.TypeByExtension(filepath.Ext(page.File))
+			}
+			compiledPage.tmpl, err = parsePageFile(page.File, compiledPage.contentType)
+			if err != nil && builtin {
+				log.Warn().Err(err).Str("file", page.File).Msg("Built-in error page unavailable")
+				compiledPage.File = ""
+			} else if err != nil {
+				return nil, fmt.Errorf("error_pages[%d]: %w", i, err)
+			}
+		}
+		compiled = append(compiled, compiledPage)
+	}
+	return compiled, nil
+}
+
+// parseStatusRange 解析状态码范围，支持 404、5xx 与 500-504 三种写法，为空时匹配全部错误
+func parseStatusRange(status string) (int, int, error) {
+	switch {
+	case status == "":
+		return 400, 599, nil
+	case len(status) == 3 && strings.HasSuffix(strings.ToLower(status), "xx"):
+		class, err := strconv.Atoi(status[:1])
+		if err != nil || class < 1 || class > 5 {
+			return 0, 0, fmt.Errorf("invalid status %q", status)
+		}
+		return class * 100, class*100 + 99, nil
+	case strings.Contains(status, "-"):
+		from, to, _ := strings.Cut(status, "-")
+		min, err1 := strconv.Atoi(strings.TrimSpace(from))
+		max, err2 := strconv.Atoi(strings.TrimSpace(to))
+		if err1 != nil || err2 != nil || min > max {
+			return 0, 0, fmt.Errorf("invalid status %q", status)
+		}
+		return min, max, nil
+	default:
+		code, err := strconv.Atoi(status)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid status %q", status)
+		}
+		return code, code, nil
+	}
+}
+
+// errorPageKind 根据 Accept 头与请求路径判断请求期望的错误响应类型
+func errorPageKind(r *http.Request) ErrorPageKind {
+	accept := r.Header.Get("Accept")
+	ext := strings.ToLower(filepath.Ext(r.URL.Path))
+	switch {
+	case strings.Contains(accept, "application/json") || ext == ".json":
+		return JSONErrorPage
+	case strings.Contains(accept, "text/html") || ext == ".html" || ext == ".htm":
+		return HTMLErrorPage
+	case ext == "":
+		// 没有扩展名且未声明接受 HTML 的请求通常来自脚本调用接口
+		return JSONErrorPage
+	default:
+		return AssetErrorPage
+	}
+}
+
+// findErrorPage 按顺序查找匹配状态码、主机与请求类型的错误页面
+func findErrorPage(pages []errorPage, status int, host string, kind ErrorPageKind) (errorPage, bool) {
+	for _, page := range pages {
+		if status < page.minStatus || status > page.maxStatus {
+			continue
+		}
+		if page.Accept != "" && page.Accept != kind {
+			continue
+		}
+		if len(page.Hosts) > 0 {
+			matched := false
+			for _, pattern := range page.Hosts {
+				if matchHostPattern(pattern, host) {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				continue
+			}
+		}
+		return page, true
+	}
+	return errorPage{}, false
+}
+
+// renderErrorPage 渲染请求对应的错误页面，返回响应体与 Content-Type
+func renderErrorPage(r *http.Request, status int, vars TemplateVars) ([]byte, string) {
+	kind := errorPageKind(r)
+	page, ok := findErrorPage(activeRuntime().errorPages, status, vars.Host, kind)
+	if !ok || page.tmpl == nil {
+		return nil, ""
+	}
+
+	pageVars := ErrorPageVars{TemplateVars: vars, Status: status, StatusText: http.StatusText(status)}
+	var buf bytes.Buffer
+	if err := page.tmpl.Execute(&buf, pageVars); err != nil {
+		log.Error().Err(err).Str("file", page.File).Msg("Error rendering error page")
+		return []byte(http.StatusText(status)), "text/plain; charset=utf-8"
+	}
+	return buf.Bytes(), page.contentType
+}
+
+// parsePageFile 读取并解析页面模板。
+// HTML 页面使用 html/template 渲染，避免请求 ID 等来自请求的值被注入页面
+func parsePageFile(file string, contentType string) (pageTemplate, error) {
+	text, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.Contains(contentType, "html") {
+		funcs := htmltemplate.FuncMap{}
+		for name, fn := range templateFuncs {
+			funcs[name] = fn
+		}
+		tmpl, err := htmltemplate.New("page").Funcs(funcs).Parse(string(text))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		return tmpl, nil
+	}
+	tmpl, err := template.New("page").Funcs(templateFuncs).Funcs(errorPageFuncs).Parse(string(text))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return tmpl, nil
+}
+
+// renderPageFile 读取、解析并渲染页面模板，用于不缓存模板的维护页面
+func renderPageFile(file string, contentType string, data interface{}) ([]byte, error) {
+	tmpl, err := parsePageFile(file, contentType)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, data)
+	return buf.Bytes(), err
+}
+
+// replaceErrorBody 将上游的错误响应替换为错误页面，只修改响应体以及与响应体相关的头部。
+// 接口请求的上游错误本身就是 JSON 时保留上游内容
+func replaceErrorBody(response *http.Response, vars TemplateVars) {
+	if errorPageKind(response.Request) == JSONErrorPage && strings.Contains(response.Header.Get("Content-Type"), "json") {
+		return
+	}
+
+	content, contentType := renderErrorPage(response.Request, response.StatusCode, vars)
+	response.Body.Close()
+	response.Body = io.NopCloser(bytes.NewReader(content))
+	response.ContentLength = int64(len(content))
+	response.Header.Set("Content-Length", strconv.Itoa(len(content)))
+	if contentType != "" {
+		response.Header.Set("Content-Type", contentType)
+	} else {
+		response.Header.Del("Content-Type")
+	}
+	// 原响应体的编码与校验信息不再适用
+	response.Header.Del("Content-Encoding")
+	response.Header.Del("Content-Range")
+	response.Header.Del("ETag")
+}
+
+// writeErrorPage 直接向客户端写入错误页面，用于代理自身产生的错误
+func writeErrorPage(w http.ResponseWriter, r *http.Request, status int, vars TemplateVars) {
+	content, contentType := renderErrorPage(r, status, vars)
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+	w.WriteHeader(status)
+	_, _ = w.Write(content)
+}
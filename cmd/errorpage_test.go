@@ -0,0 +1,156 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseStatusRange(t *testing.T) {
+	tests := []struct {
+		status   string
+		min, max int
+		wantErr  bool
+	}{
+		{"", 400, 599, false},
+		{"404", 404, 404, false},
+		{"5xx", 500, 599, false},
+		{"4XX", 400, 499, false},
+		{"1xx", 100, 199, false},
+		{"500-504", 500, 504, false},
+		{" 500 - 504 ", 500, 504, false},
+		{"504-500", 0, 0, true},
+		{"6xx", 0, 0, true},
+		{"0xx", 0, 0, true},
+		{"axx", 0, 0, true},
+		{"50x", 0, 0, true},
+		{"500-", 0, 0, true},
+		{"abc", 0, 0, true},
+	}
+	for _, tt := range tests {
+		min, max, err := parseStatusRange(tt.status)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseStatusRange(%q) error = %v, want error %v", tt.status, err, tt.wantErr)
+			continue
+		}
+		if min != tt.min || max != tt.max {
+			t.Errorf("parseStatusRange(%q) = %d-%d, want %d-%d", tt.status, min, max, tt.min, tt.max)
+		}
+	}
+}
+
+func TestErrorPageKind(t *testing.T) {
+	tests := []struct {
+		path   string
+		accept string
+		want   ErrorPageKind
+	}{
+		{"/", "text/html,application/xhtml+xml", HTMLErrorPage},
+		{"/api/x", "application/json", JSONErrorPage},
+		{"/data.json", "*/*", JSONErrorPage},
+		{"/page.html", "", HTMLErrorPage},
+		{"/api/x", "*/*", JSONErrorPage},
+		{"/dist/a.js", "*/*", AssetErrorPage},
+		{"/res/a.PNG", "", AssetErrorPage},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "http://a.com"+tt.path, nil)
+		r.Header.Set("Accept", tt.accept)
+		if got := errorPageKind(r); got != tt.want {
+			t.Errorf("errorPageKind(%q, %q) = %q, want %q", tt.path, tt.accept, got, tt.want)
+		}
+	}
+}
+
+func TestFindErrorPage(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"404.html", "cn.html", "error.html", "error.json"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name+" {{.Status}}"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pages, err := compileErrorPages([]ConfigErrorPage{
+		{Status: "404", Accept: HTMLErrorPage, File: filepath.Join(dir, "404.html")},
+		{Status: "5xx", Hosts: []string{"*.ra2web.cn"}, Accept: HTMLErrorPage, File: filepath.Join(dir, "cn.html")},
+		{Accept: HTMLErrorPage, File: filepath.Join(dir, "error.html")},
+		{Status: "400-499", Accept: JSONErrorPage, File: filepath.Join(dir, "error.json")},
+		{Accept: AssetErrorPage},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		status int
+		host   string
+		kind   ErrorPageKind
+		want   string // 命中页面的文件名，空字符串表示命中没有文件的页面
+		found  bool
+	}{
+		{"exact status", 404, "a.com", HTMLErrorPage, "404.html", true},
+		{"host pattern", 502, "game.ra2web.cn", HTMLErrorPage, "cn.html", true},
+		{"host pattern mismatch", 502, "a.com", HTMLErrorPage, "error.html", true},
+		{"first match wins", 404, "game.ra2web.cn", HTMLErrorPage, "404.html", true},
+		{"json range", 429, "a.com", JSONErrorPage, "error.json", true},
+		{"json out of range", 500, "a.com", JSONErrorPage, "", false},
+		{"asset", 500, "a.com", AssetErrorPage, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page, ok := findErrorPage(pages, tt.status, tt.host, tt.kind)
+			if ok != tt.found {
+				t.Fatalf("found = %v, want %v", ok, tt.found)
+			}
+			if got := filepath.Base(page.File); ok && tt.want != "" && got != tt.want {
+				t.Errorf("file = %q, want %q", got, tt.want)
+			}
+			if ok && tt.want == "" && page.tmpl != nil {
+				t.Errorf("expected page without template, got %q", page.File)
+			}
+		})
+	}
+}
+
+func TestCompileErrorPagesErrors(t *testing.T) {
+	dir := t.TempDir()
+	broken := filepath.Join(dir, "broken.html")
+	if err := os.WriteFile(broken, []byte("{{.Status"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		page ConfigErrorPage
+		want string
+	}{
+		{"invalid status", ConfigErrorPage{Status: "4x"}, "invalid status"},
+		{"unknown accept", ConfigErrorPage{Accept: "xml"}, "unknown accept"},
+		{"missing file", ConfigErrorPage{File: filepath.Join(dir, "missing.html")}, "missing.html"},
+		{"invalid template", ConfigErrorPage{File: broken}, "broken.html"},
+	}
+	for _, tt := range tests {
+		_, err := compileErrorPages([]ConfigErrorPage{tt.page})
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got %v, want error containing %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestCompileDefaultErrorPagesWithoutViews(t *testing.T) {
+	saved := viewsDir
+	viewsDir = t.TempDir()
+	defer func() { viewsDir = saved }()
+
+	pages, err := compileErrorPages(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, page := range pages {
+		if page.tmpl != nil || page.File != "" {
+			t.Errorf("built-in page %+v should fall back to an empty body", page.ConfigErrorPage)
+		}
+	}
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/rs/zerolog/log"
+)
+
+// regexpSourcePrefix hackSource 使用正则表达式时的前缀
+const regexpSourcePrefix = "re:"
+
+// hackMapPath hack-map 文件路径，默认为配置文件所在目录下的 hack-map.json
+var hackMapPath = "config/hack-map.json"
+
+// loadHackMap 读取并严格校验 hack-map 文件，存在任何错误时返回全部错误
+func loadHackMap(path string) ([]HackConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseHackMap(path, data)
+}
+
+// reloadHackMap 重新加载 hack-map，新配置不合法时保留之前生效的配置。
+// 与重新加载配置互斥，新的 hack 与当前配置一起整体替换
+func reloadHackMap() error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	hacks, err := loadHackMap(hackMapPath)
+	if err != nil {
+		log.Error().Err(err).Str("file", hackMapPath).Msg("Hack map invalid, keep previous one")
+		return err
+	}
+	next := *activeRuntime()
+	next.hacks = hacks
+	next.digests = newDigestCache()
+	activeConfig.Store(&next)
+	log.Info().Str("file", hackMapPath).Int("hacks", len(hacks)).Msg("Hack map reloaded")
+	go pruneDerivedCache()
+	return nil
+}
+
+// findHacks 按 hack-map 中的顺序返回会修改指定上游与路径响应内容的全部 hack 配置
+func (rc *runtimeConfig) findHacks(upstream string, relPath string) []HackConfig {
+	var hacks []HackConfig
+	for _, hack := range rc.hacks {
+		if hack.HackAction != AddFile && hack.appliesTo(upstream) && matchHackSource(hack.HackSource, relPath) {
+			hacks = append(hacks, hack)
+		}
+	}
+	return hacks
+}
+
+// appliesTo 判断 hack 是否作用于指定上游，upstreams 为空时作用于全部上游
+func (hack HackConfig) appliesTo(upstream string) bool {
+	return len(hack.Upstreams) == 0 || containsString(hack.Upstreams, upstream)
+}
+
+// regexpCache 缓存 hackSource 中已编译的正则表达式
+var regexpCache sync.Map
+
+// matchHackSource 判断请求路径是否匹配 hackSource，支持精确路径、glob 与 re: 前缀的正则表达式
+func matchHackSource(pattern string, relPath string) bool {
+	if expr, ok := strings.CutPrefix(pattern, regexpSourcePrefix); ok {
+		var re *regexp.Regexp
+		if cached, ok := regexpCache.Load(expr); ok {
+			re = cached.(*regexp.Regexp)
+		} else {
+			compiled, err := regexp.Compile(expr)
+			if err != nil {
+				return false
+			}
+			regexpCache.Store(expr, compiled)
+			re = compiled
+		}
+		return re.MatchString(relPath)
+	}
+	if strings.ContainsAny(pattern, "*?[") {
+		matched, err := path.Match(pattern, relPath)
+		return err == nil && matched
+	}
+	return pattern == relPath
+}
+
+// HackRuleStat 记录单个修改点的匹配情况
+type HackRuleStat struct {
+	Hack     int    `json:"hack"`     // 所属 hack 在本次应用列表中的序号
+	Index    int    `json:"index"`    // 修改点在 modifyPointsList 或 assets 中的序号
+	Action   string `json:"action"`   // 操作类型，injectAsset 为资源类型
+	Selector string `json:"selector"` // CSS 选择器，injectAsset 为插入位置
+	Matched  int    `json:"matched"`  // 命中的元素数量，replaceJS 为实际替换的脚本数量
+}
+
+// applyHackConfig 对响应体应用单个 hack 配置，返回修改后的内容与每个修改点的匹配统计
+func applyHackConfig(hack HackConfig, body []byte, vars TemplateVars) ([]byte, []HackRuleStat, error) {
+	switch hack.HackAction {
+	case ModifyHTMLFile:
+		return applyHTMLHack(body, hack.HackDetail.ModifyPointsList, vars)
+	case InjectAsset:
+		return applyInjectAsset(body, hack.HackDetail.Assets, vars)
+	case StripTrackers:
+		return applyStripTrackers(hack.HackSource, hack.HackDetail, body, vars)
+	case ReplaceText:
+		return applyReplaceText(body, hack.HackDetail.Replacements, vars)
+	default:
+		return body, nil, nil
+	}
+}
+
+// applyHTMLHack 按顺序对 HTML 文档应用修改点，内容字段支持模板变量
+func applyHTMLHack(body []byte, points []ModifyPoint, vars TemplateVars) ([]byte, []HackRuleStat, error) {
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stats := make([]HackRuleStat, 0, len(points))
+	for i, point := range points {
+		content, err := renderTemplate(point.Content, vars)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to render content of %q: %w", point.Selector, err)
+		}
+
+		selection := doc.Find(point.Selector)
+		stat := HackRuleStat{
+			Index:    i,
+			Action:   string(point.Action),
+			Selector: point.Selector,
+			Matched:  selection.Length(),
+		}
+		if selection.Length() == 0 {
+			log.Debug().Str("selector", point.Selector).Msg("Hack selector matched nothing")
+			stats = append(stats, stat)
+			continue
+		}
+
+		switch point.Action {
+		case Insert:
+			// 模板渲染结果为空时不插入任何内容
+			if content != "" && point.Position == "before" {
+				selection.BeforeHtml(content)
+			} else if content != "" {
+				selection.AfterHtml(content)
+			}
+		case Delete:
+			selection.Remove()
+		case Replace:
+			selection.ReplaceWithHtml(content)
+		case ReplaceJS:
+			newContent, err := renderTemplate(point.NewContent, vars)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to render newContent of %q: %w", point.Selector, err)
+			}
+			stat.Matched = 0
+			selection.Each(func(_ int, s *goquery.Selection) {
+				script := s.Text()
+				if strings.Contains(script, point.OldContent) {
+					s.SetText(strings.Replace(script, point.OldContent, newContent, -1))
+					stat.Matched++
+				}
+			})
+		}
+		stats = append(stats, stat)
+	}
+
+	html, err := doc.Html()
+	if err != nil {
+		return nil, nil, err
+	}
+	return []byte(html), stats, nil
+}
+
+// normalizeHTML 将 HTML 文档解析后重新序列化，用于与 hack 输出进行格式一致的比较
+func normalizeHTML(body []byte) ([]byte, error) {
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	html, err := doc.Html()
+	if err != nil {
+		return nil, err
+	}
+	return []byte(html), nil
+}
+
+// maxDigestCacheEntries 摘要缓存的最大条目数，glob 形式的 hackSource 可以匹配任意路径，超出时清空缓存
+const maxDigestCacheEntries = 10000
+
+// digestCache 缓存同一运行时状态下每个上游、请求主机与路径的摘要，随运行时状态整体替换
+type digestCache struct {
+	mu      sync.Mutex
+	entries map[string]digestEntry
+}
+
+// digestEntry 摘要中不随文件变化的部分，注入的资源文件可能在运行中修改，每次仍然读取其哈希
+type digestEntry struct {
+	base       []byte   // hack、URL 改写规则、配置与版本号的哈希，没有 hack 时为空
+	assetFiles []string // 参与摘要计算的资源文件
+	usesScheme bool     // 结果依赖请求协议，协议参与摘要计算
+	usesHost   bool     // 结果依赖请求主机，主机名参与摘要计算
+}
+
+func newDigestCache() *digestCache {
+	return &digestCache{entries: map[string]digestEntry{}}
+}
+
+func (c *digestCache) load(key string) (digestEntry, bool) {
+	if c == nil {
+		return digestEntry{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	return entry, ok
+}
+
+func (c *digestCache) store(key string, entry digestEntry) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= maxDigestCacheEntries {
+		c.entries = map[string]digestEntry{}
+	}
+	c.entries[key] = entry
+}
+
+// configDigest 计算配置的哈希，构建运行时状态时计算一次
+func configDigest(c *Config) []byte {
+	data, _ := json.Marshal(c)
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+// hackDigest 计算作用于指定上游、路径与请求主机的全部 hack 的摘要，没有 hack 时返回空字符串。
+// 模板可以引用配置与版本号，注入的资源文件内容决定 integrity，因此它们也参与摘要计算；
+// 结果依赖请求协议或主机时，协议或主机也参与计算，其他情况下不同请求共用同一份派生层内容。
+// cacheable 表示结果可以写入派生层：依赖请求主机且主机未在配置中登记时，每个 Host 都会产生不同的摘要，不能写入磁盘
+func hackDigest(rc *runtimeConfig, upstream string, relPath string, host string, scheme string) (digest string, cacheable bool) {
+	// 未登记的主机只会命中不限主机的 URL 改写规则，共用同一个摘要缓存条目
+	known := rc.knownHosts[host]
+	keyHost := host
+	if !known {
+		keyHost = ""
+	}
+	key := upstream + "\x00" + keyHost + "\x00" + relPath
+	entry, ok := rc.digests.load(key)
+	if !ok {
+		entry = rc.digestEntry(upstream, relPath, keyHost)
+		rc.digests.store(key, entry)
+	}
+	if entry.base == nil {
+		return "", true
+	}
+
+	hash := sha256.New()
+	hash.Write(entry.base)
+	if entry.usesScheme {
+		hash.Write([]byte("\x00scheme=" + scheme))
+	}
+	if entry.usesHost {
+		hash.Write([]byte("\x00host=" + host))
+	}
+	for _, file := range entry.assetFiles {
+		fileHash, _ := assetFileHash(file)
+		hash.Write(fileHash)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), known || !entry.usesHost
+}
+
+// digestEntry 计算摘要中不随文件变化的部分
+func (rc *runtimeConfig) digestEntry(upstream string, relPath string, host string) digestEntry {
+	var entry digestEntry
+	hash := sha256.New()
+	hacked := false
+
+	fields := map[string]bool{}
+	for _, hack := range rc.findHacks(upstream, relPath) {
+		data, _ := json.Marshal(hack)
+		hash.Write(data)
+		for _, asset := range hack.HackDetail.Assets {
+			if asset.File != "" {
+				entry.assetFiles = append(entry.assetFiles, asset.File)
+			}
+		}
+		for _, text := range hack.templates() {
+			mergeTemplateFields(fields, text)
+		}
+		hacked = true
+	}
+	if rules := rc.urlRewriteRules(relPath, host); len(rules) > 0 {
+		data, _ := json.Marshal(rules)
+		hash.Write(data)
+		// 带协议的地址改写为当前请求的协议
+		fields["Scheme"] = true
+		for _, rule := range rules {
+			mergeTemplateFields(fields, rule.To)
+		}
+		hacked = true
+	}
+	if !hacked {
+		return digestEntry{}
+	}
+	entry.usesScheme = fields["Scheme"]
+	entry.usesHost = fields["Host"]
+
+	configHash := rc.configDigest
+	if configHash == nil {
+		configHash = configDigest(rc.config)
+	}
+	hash.Write(configHash)
+	hash.Write([]byte(version))
+	entry.base = hash.Sum(nil)
+	return entry
+}
+
+// templates 返回 hack 中会按请求渲染的全部模板文本
+func (hack HackConfig) templates() []string {
+	var texts []string
+	for _, point := range hack.HackDetail.ModifyPointsList {
+		texts = append(texts, point.Content, point.NewContent)
+	}
+	for _, replacement := range hack.HackDetail.Replacements {
+		texts = append(texts, replacement.New)
+	}
+	for _, asset := range hack.HackDetail.Assets {
+		texts = append(texts, asset.Src, asset.Content)
+		for _, value := range asset.Attrs {
+			texts = append(texts, value)
+		}
+	}
+	return texts
+}
+
+// mergeTemplateFields 将模板引用的模板变量合并到 fields，模板已经在加载时校验过
+func mergeTemplateFields(fields map[string]bool, text string) {
+	referenced, _ := templateFields(text)
+	for field := range referenced {
+		fields[field] = true
+	}
+}
+
+// applyHacks 对指定上游与路径的原始内容应用全部 hack，得到派生层内容，并记录匹配统计。
+// rc 应与计算摘要时使用的状态相同，保证派生层内容与摘要对应
+func applyHacks(rc *runtimeConfig, upstream string, relPath string, body []byte, vars TemplateVars) ([]byte, error) {
+	record := HackPathStats{Upstream: upstream, Path: relPath, BuiltAt: time.Now()}
+	for i, hack := range rc.findHacks(upstream, relPath) {
+		var stats []HackRuleStat
+		var err error
+		body, stats, err = applyHackConfig(hack, body, vars)
+		if err != nil {
+			return nil, err
+		}
+		record.Hacks = append(record.Hacks, string(hack.HackAction)+" "+hack.HackSource)
+		for _, stat := range stats {
+			stat.Hack = i
+			record.Rules = append(record.Rules, stat)
+		}
+	}
+
+	// 改写上游绝对地址，放在最后以便覆盖 hack 注入的内容
+	if rules := rc.urlRewriteRules(relPath, vars.Host); len(rules) > 0 {
+		var stats []HackRuleStat
+		var err error
+		body, stats, err = rewriteURLs(body, rules, vars)
+		if err != nil {
+			return nil, err
+		}
+		record.Hacks = append(record.Hacks, "rewriteURL "+vars.Host)
+		for _, stat := range stats {
+			stat.Hack = len(record.Hacks) - 1
+			record.Rules = append(record.Rules, stat)
+		}
+	}
+	hackStats.Store(upstream+":"+relPath, record)
+	return body, nil
+}
+
+// applyReplaceText 按顺序对文本内容执行替换，适用于 JS、CSS 等非 HTML 文件
+func applyReplaceText(body []byte, replacements []TextReplacement, vars TemplateVars) ([]byte, []HackRuleStat, error) {
+	text := string(body)
+	stats := make([]HackRuleStat, 0, len(replacements))
+	for i, replacement := range replacements {
+		newText, err := renderTemplate(replacement.New, vars)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to render replacement %d: %w", i, err)
+		}
+
+		count := strings.Count(text, replacement.Old)
+		if replacement.Limit > 0 && count > replacement.Limit {
+			count = replacement.Limit
+		}
+		limit := replacement.Limit
+		if limit == 0 {
+			limit = -1
+		}
+		text = strings.Replace(text, replacement.Old, newText, limit)
+
+		stats = append(stats, HackRuleStat{Index: i, Action: string(ReplaceText), Selector: replacement.Old, Matched: count})
+	}
+	return []byte(text), stats, nil
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// overwriteDir 覆盖文件所在目录，injectAsset 的 file 与 addFile 的 addFileSource 均相对于该目录
+var overwriteDir = defaultOverwriteDir
+
+// assetPositions 注入位置及其对应的插入方式
+var assetPositions = []string{"head-start", "head-end", "body-end"}
+
+// assetHashCache 缓存覆盖文件的哈希，文件修改时间或大小变化时重新计算
+var assetHashCache sync.Map
+
+type assetHash struct {
+	modTime time.Time
+	size    int64
+	sha256  []byte
+	sha384  []byte
+}
+
+// loadAssetHash 读取覆盖文件并返回其哈希
+func loadAssetHash(file string) (*assetHash, error) {
+	path := filepath.Join(overwriteDir, filepath.FromSlash(file))
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if cached, ok := assetHashCache.Load(path); ok {
+		hash := cached.(*assetHash)
+		if hash.modTime.Equal(info.ModTime()) && hash.size == info.Size() {
+			return hash, nil
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	sum256 := sha256.Sum256(data)
+	sum384 := sha512.Sum384(data)
+	hash := &assetHash{modTime: info.ModTime(), size: info.Size(), sha256: sum256[:], sha384: sum384[:]}
+	assetHashCache.Store(path, hash)
+	return hash, nil
+}
+
+// assetFileHash 返回覆盖文件内容的 sha256
+func assetFileHash(file string) ([]byte, error) {
+	hash, err := loadAssetHash(file)
+	if err != nil {
+		return nil, err
+	}
+	return hash.sha256, nil
+}
+
+// applyInjectAsset 将资源按位置注入 HTML 文档，同一位置的资源保持声明顺序
+func applyInjectAsset(body []byte, assets []AssetPoint, vars TemplateVars) ([]byte, []HackRuleStat, error) {
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	targets := map[string]*goquery.Selection{
+		"head-start": doc.Find("head").First(),
+		"head-end":   doc.Find("head").First(),
+		"body-end":   doc.Find("body").First(),
+	}
+
+	blocks := make(map[string]*strings.Builder)
+	stats := make([]HackRuleStat, 0, len(assets))
+	for i, asset := range assets {
+		tag, err := renderAssetTag(asset, vars)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to render asset %d: %w", i, err)
+		}
+		if blocks[asset.Position] == nil {
+			blocks[asset.Position] = &strings.Builder{}
+		}
+		blocks[asset.Position].WriteString(tag)
+
+		matched := 0
+		if target, ok := targets[asset.Position]; ok {
+			matched = target.Length()
+		}
+		stats = append(stats, HackRuleStat{Index: i, Action: string(asset.Type), Selector: asset.Position, Matched: matched})
+	}
+
+	for _, position := range assetPositions {
+		block, ok := blocks[position]
+		if !ok {
+			continue
+		}
+		if position == "head-start" {
+			targets[position].PrependHtml(block.String())
+		} else {
+			targets[position].AppendHtml(block.String())
+		}
+	}
+
+	result, err := doc.Html()
+	if err != nil {
+		return nil, nil, err
+	}
+	return []byte(result), stats, nil
+}
+
+// renderAssetTag 生成资源对应的 HTML 标签
+func renderAssetTag(asset AssetPoint, vars TemplateVars) (string, error) {
+	attrs := make(map[string]string, len(asset.Attrs)+2)
+	for name, value := range asset.Attrs {
+		rendered, err := renderTemplate(value, vars)
+		if err != nil {
+			return "", err
+		}
+		attrs[name] = rendered
+	}
+
+	if asset.Src != "" {
+		src, err := renderTemplate(asset.Src, vars)
+		if err != nil {
+			return "", err
+		}
+
+		if asset.File != "" && (asset.Integrity || asset.CacheBust) {
+			hash, err := loadAssetHash(asset.File)
+			if err != nil {
+				return "", err
+			}
+			if asset.Integrity {
+				attrs["integrity"] = "sha384-" + base64.StdEncoding.EncodeToString(hash.sha384)
+			}
+			if asset.CacheBust {
+				separator := "?"
+				if strings.Contains(src, "?") {
+					separator = "&"
+				}
+				src += separator + "v=" + hex.EncodeToString(hash.sha256)[:12]
+			}
+		}
+
+		if asset.Type == StyleAsset {
+			attrs["href"] = src
+		} else {
+			attrs["src"] = src
+		}
+	}
+
+	// 内联内容直接写入标签体
+	content, err := renderTemplate(asset.Content, vars)
+	if err != nil {
+		return "", err
+	}
+
+	switch asset.Type {
+	case ScriptAsset:
+		return "<script" + renderAttrs(attrs) + ">" + content + "</script>", nil
+	case StyleAsset:
+		if asset.Src == "" {
+			return "<style" + renderAttrs(attrs) + ">" + content + "</style>", nil
+		}
+		if _, ok := attrs["rel"]; !ok {
+			attrs["rel"] = "stylesheet"
+		}
+		return "<link" + renderAttrs(attrs) + "/>", nil
+	case MetaAsset:
+		return "<meta" + renderAttrs(attrs) + "/>", nil
+	default:
+		return "", fmt.Errorf("unknown asset type %q", asset.Type)
+	}
+}
+
+// renderAttrs 按属性名排序输出属性，保证相同配置生成相同内容
+func renderAttrs(attrs map[string]string) string {
+	names := make([]string, 0, len(attrs))
+	for name := range attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	for _, name := range names {
+		sb.WriteByte(' ')
+		sb.WriteString(name)
+		if value := attrs[name]; value != "" {
+			sb.WriteString(`="`)
+			sb.WriteString(html.EscapeString(value))
+			sb.WriteByte('"')
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProxyInjectAsset(t *testing.T) {
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write([]byte(`<html><head><title>t</title></head><body><p>game</p></body></html>`))
+	})
+	savedOverwriteDir := overwriteDir
+	overwriteDir = t.TempDir()
+	t.Cleanup(func() { overwriteDir = savedOverwriteDir })
+	file := filepath.Join(overwriteDir, "pad.js")
+	if err := os.WriteFile(file, []byte("v1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	hacks := []HackConfig{{
+		HackAction: InjectAsset,
+		HackSource: "/index.html",
+		HackDetail: HackDetail{Assets: []AssetPoint{
+			{Type: ScriptAsset, Position: "body-end", Src: "/lib/pad.js", File: "pad.js", Integrity: true, CacheBust: true, Attrs: map[string]string{"defer": ""}},
+			{Type: MetaAsset, Position: "head-start", Attrs: map[string]string{"name": "proxy", "content": "{{.Host}}"}},
+			{Type: StyleAsset, Position: "head-end", Content: "p{}"},
+			{Type: ScriptAsset, Position: "body-end", Content: "start()"},
+		}},
+	}}
+	newTestProxy(t, upstream, Config{}, hacks)
+
+	scriptTag := func(content string) string {
+		sum256 := sha256.Sum256([]byte(content))
+		sum384 := sha512.Sum384([]byte(content))
+		return `<script defer="" integrity="sha384-` + base64.StdEncoding.EncodeToString(sum384[:]) +
+			`" src="/lib/pad.js?v=` + hex.EncodeToString(sum256[:])[:12] + `"></script>`
+	}
+
+	tests := []struct {
+		name    string
+		content string // 请求前写入覆盖文件的内容，为空时不修改
+		want    []string
+	}{
+		{
+			name: "positions keep declaration order",
+			want: []string{
+				`<head><meta content="` + testEntryHost + `" name="proxy"/><title>t</title><style>p{}</style></head>`,
+				`<p>game</p>` + scriptTag("v1") + `<script>start()</script></body>`,
+			},
+		},
+		{
+			name: "cached copy",
+			want: []string{scriptTag("v1")},
+		},
+		{
+			name:    "override file change rebuilds integrity and version",
+			content: "v2",
+			want:    []string{scriptTag("v2")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.content != "" {
+				if err := os.WriteFile(file, []byte(tt.content), 0644); err != nil {
+					t.Fatal(err)
+				}
+				// 修改时间精度不足时哈希缓存无法发现变化
+				future := time.Now().Add(time.Minute)
+				if err := os.Chtimes(file, future, future); err != nil {
+					t.Fatal(err)
+				}
+			}
+			w := proxyGet("http://"+testEntryHost+"/index.html", map[string]string{"Accept": "text/html"})
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d", w.Code)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(w.Body.String(), want) {
+					t.Errorf("body does not contain %s:\n%s", want, w.Body.String())
+				}
+			}
+		})
+	}
+}
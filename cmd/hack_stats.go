@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// hackStats 记录每个被 hack 修改过的路径最近一次构建的统计，key 为 "上游名称:请求路径"
+var hackStats sync.Map
+
+// HackPathStats 定义单个路径最近一次应用 hack 的统计
+type HackPathStats struct {
+	Upstream string         `json:"upstream"` // 文件所属的上游名称
+	Path     string         `json:"path"`     // 被修改的文件路径
+	Hacks    []string       `json:"hacks"`    // 命中的 hack，格式为 "hackAction hackSource"，按应用顺序
+	Rules    []HackRuleStat `json:"rules"`    // 每个规则的匹配统计
+	BuiltAt  time.Time      `json:"builtAt"`  // 最近一次构建时间
+}
+
+// hackStatsHandler 返回所有被 hack 修改过的文件及其匹配统计
+func hackStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if !isDomainAllowedCallApi(r.Host, *currentConfig()) {
+		mainProxyHandler(w, r)
+		return
+	}
+
+	records := make([]HackPathStats, 0)
+	hackStats.Range(func(_, value interface{}) bool {
+		records = append(records, value.(HackPathStats))
+		return true
+	})
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Upstream != records[j].Upstream {
+			return records[i].Upstream < records[j].Upstream
+		}
+		return records[i].Path < records[j].Path
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(records); err != nil {
+		log.Error().Err(err).Msg("Error writing hack stats response")
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestProxyHackSourcePatterns(t *testing.T) {
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/javascript")
+		_, _ = w.Write([]byte("CORSWorkaround;CORSWorkaround;legacy"))
+	})
+	hacks := []HackConfig{
+		{
+			HackAction: ReplaceText,
+			HackSource: "/dist/*.js",
+			HackDetail: HackDetail{Replacements: []TextReplacement{{Old: "CORSWorkaround", New: "true", Limit: 1}}},
+		},
+		{
+			HackAction: ReplaceText,
+			HackSource: `re:^/dist/workers/.*\.worker\.js$`,
+			HackDetail: HackDetail{Replacements: []TextReplacement{{Old: "legacy", New: "patched"}}},
+		},
+	}
+	newTestProxy(t, upstream, Config{ApiEndpoint: []string{"admin.example.com"}}, hacks)
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/dist/workerHost.3f2a1b.min.js", "true;CORSWorkaround;legacy"},
+		{"/dist/main.9c8d7e.js", "true;CORSWorkaround;legacy"},
+		{"/dist/workers/gamelogic.worker.js", "CORSWorkaround;CORSWorkaround;patched"},
+		{"/dist/sub/other.js", "CORSWorkaround;CORSWorkaround;legacy"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			// Web Worker 脚本的请求与普通脚本一样应用 hack
+			w := proxyGet("http://"+testEntryHost+tt.path, map[string]string{"Sec-Fetch-Dest": "worker"})
+			if w.Code != http.StatusOK || w.Body.String() != tt.want {
+				t.Errorf("got %d %q, want %q", w.Code, w.Body.String(), tt.want)
+			}
+		})
+	}
+
+	w := httptest.NewRecorder()
+	hackStatsHandler(w, httptest.NewRequest("GET", "http://admin.example.com/proxy-svc/api/v1/hack-stats", nil))
+	var records []HackPathStats
+	if err := json.Unmarshal(w.Body.Bytes(), &records); err != nil {
+		t.Fatal(err)
+	}
+	matched := map[string]int{}
+	for _, record := range records {
+		for _, rule := range record.Rules {
+			matched[record.Path] += rule.Matched
+		}
+	}
+	want := map[string]int{
+		"/dist/workerHost.3f2a1b.min.js":    1,
+		"/dist/main.9c8d7e.js":              1,
+		"/dist/workers/gamelogic.worker.js": 1,
+	}
+	for path, count := range want {
+		if matched[path] != count {
+			t.Errorf("hack stats for %s matched %d, want %d (all: %v)", path, matched[path], count, matched)
+		}
+	}
+	if _, ok := matched["/dist/sub/other.js"]; ok {
+		t.Errorf("hack stats recorded unmatched path /dist/sub/other.js")
+	}
+}
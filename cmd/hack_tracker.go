@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/rs/zerolog/log"
+)
+
+// trackerURLAttrs 可能引用第三方统计资源的元素及其地址属性
+var trackerURLAttrs = [][2]string{
+	{"script", "src"},
+	{"link", "href"},
+	{"img", "src"},
+	{"iframe", "src"},
+}
+
+// applyStripTrackers 移除引用屏蔽域名的外部资源以及命中特征的内联脚本，
+// 之后按需注入替代的统计代码，并记录本次构建移除的元素
+func applyStripTrackers(source string, detail HackDetail, body []byte, vars TemplateVars) ([]byte, []HackRuleStat, error) {
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stats := make([]HackRuleStat, 0, len(detail.BlockedDomains)+len(detail.InlinePatterns))
+	for i, domain := range detail.BlockedDomains {
+		stats = append(stats, HackRuleStat{Index: i, Action: "blockedDomain", Selector: domain})
+	}
+	for i, pattern := range detail.InlinePatterns {
+		stats = append(stats, HackRuleStat{Index: i, Action: "inlinePattern", Selector: pattern})
+	}
+
+	var removed []string
+
+	// 外部资源按地址的主机名匹配，屏蔽域名同时覆盖其子域名
+	for _, tagAttr := range trackerURLAttrs {
+		tag, attr := tagAttr[0], tagAttr[1]
+		doc.Find(tag + "[" + attr + "]").Each(func(_ int, s *goquery.Selection) {
+			value, _ := s.Attr(attr)
+			parsedUrl, err := url.Parse(strings.TrimSpace(value))
+			if err != nil || parsedUrl.Host == "" {
+				return
+			}
+			if i := matchBlockedDomain(parsedUrl.Hostname(), detail.BlockedDomains); i >= 0 {
+				stats[i].Matched++
+				removed = append(removed, fmt.Sprintf("<%s %s=%q>", tag, attr, value))
+				s.Remove()
+			}
+		})
+	}
+
+	// 内联脚本与 noscript 按内容匹配屏蔽域名或特征片段
+	doc.Find("script:not([src]), noscript").Each(func(_ int, s *goquery.Selection) {
+		text := s.Text()
+		for i, domain := range detail.BlockedDomains {
+			if strings.Contains(text, domain) {
+				stats[i].Matched++
+				removed = append(removed, fmt.Sprintf("inline <%s> matching %q", goquery.NodeName(s), domain))
+				s.Remove()
+				return
+			}
+		}
+		for i, pattern := range detail.InlinePatterns {
+			if strings.Contains(text, pattern) {
+				stats[len(detail.BlockedDomains)+i].Matched++
+				removed = append(removed, fmt.Sprintf("inline <%s> matching %q", goquery.NodeName(s), pattern))
+				s.Remove()
+				return
+			}
+		}
+	})
+
+	if len(removed) > 0 {
+		log.Info().Str("hack_source", source).Strs("removed", removed).Msg("Trackers stripped")
+	}
+
+	html, err := doc.Html()
+	if err != nil {
+		return nil, nil, err
+	}
+	result := []byte(html)
+
+	// 注入替代的统计代码
+	if len(detail.Assets) > 0 {
+		var assetStats []HackRuleStat
+		result, assetStats, err = applyInjectAsset(result, detail.Assets, vars)
+		if err != nil {
+			return nil, nil, err
+		}
+		stats = append(stats, assetStats...)
+	}
+
+	return result, stats, nil
+}
+
+// matchBlockedDomain 返回主机名命中的屏蔽域名序号，未命中时返回 -1
+func matchBlockedDomain(host string, domains []string) int {
+	host = strings.ToLower(host)
+	for i, domain := range domains {
+		domain = strings.ToLower(domain)
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return i
+		}
+	}
+	return -1
+}
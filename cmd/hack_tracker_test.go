@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestProxyStripTrackers(t *testing.T) {
+	page := `<html><head>
+<script async src="https://www.googletagmanager.com/gtag/js?id=G-NEWID"></script>
+<script>window.dataLayer = []; gtag('config', 'G-NEWID');</script>
+<script src="https://stats.Example-Analytics.com/t.js"></script>
+<link rel="preconnect" href="//cdn.example-analytics.com">
+<script src="/dist/main.js"></script>
+<script>start()</script>
+</head><body><img src="https://pixel.example-analytics.com/p.gif"><noscript><img src="https://www.googletagmanager.com/ns.html"></noscript></body></html>`
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write([]byte(page))
+	})
+	hacks := []HackConfig{{
+		HackAction: StripTrackers,
+		HackSource: "/index.html",
+		HackDetail: HackDetail{
+			BlockedDomains: []string{"googletagmanager.com", "example-analytics.com"},
+			InlinePatterns: []string{"gtag("},
+			Assets:         []AssetPoint{{Type: ScriptAsset, Position: "body-end", Src: "https://stats.{{.Host}}/own.js"}},
+		},
+	}}
+	newTestProxy(t, upstream, Config{}, hacks)
+
+	w := proxyGet("http://"+testEntryHost+"/index.html", map[string]string{"Accept": "text/html"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d", w.Code)
+	}
+	body := w.Body.String()
+	for _, removed := range []string{"googletagmanager", "example-analytics", "dataLayer", "<noscript>"} {
+		if strings.Contains(body, removed) {
+			t.Errorf("body still contains %q:\n%s", removed, body)
+		}
+	}
+	for _, kept := range []string{`<script src="/dist/main.js"></script>`, `<script>start()</script>`, `<script src="https://stats.` + testEntryHost + `/own.js"></script></body>`} {
+		if !strings.Contains(body, kept) {
+			t.Errorf("body does not contain %q:\n%s", kept, body)
+		}
+	}
+
+	record, ok := hackStats.Load("main:/index.html")
+	if !ok {
+		t.Fatal("no hack stats recorded for /index.html")
+	}
+	matched := map[string]int{}
+	for _, rule := range record.(HackPathStats).Rules {
+		matched[rule.Action+" "+rule.Selector] = rule.Matched
+	}
+	want := map[string]int{
+		"blockedDomain googletagmanager.com":  2,
+		"blockedDomain example-analytics.com": 3,
+		"inlinePattern gtag(":                 1,
+		"script body-end":                     1,
+	}
+	for rule, count := range want {
+		if matched[rule] != count {
+			t.Errorf("%s matched %d, want %d (all: %v)", rule, matched[rule], count, matched)
+		}
+	}
+}
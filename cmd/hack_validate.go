@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/andybalholm/cascadia"
+)
+
+// HackMapError 描述 hack-map 文件中的一处错误
+type HackMapError struct {
+	File   string
+	Line   int
+	Column int
+	Path   string // 出错字段的 JSON 路径，例如 [5].hackDetail.modifyPointsList[2].position
+	Msg    string
+}
+
+func (e HackMapError) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("%s:%d:%d: %s", e.File, e.Line, e.Column, e.Msg)
+	}
+	return fmt.Sprintf("%s:%d:%d: %s: %s", e.File, e.Line, e.Column, e.Path, e.Msg)
+}
+
+// HackMapErrors 汇总 hack-map 文件中的所有错误
+type HackMapErrors []HackMapError
+
+func (e HackMapErrors) Error() string {
+	lines := make([]string, len(e))
+	for i, err := range e {
+		lines[i] = err.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// parseHackMap 严格解析 hack-map 内容，未知字段与不合法的取值都会作为错误返回
+func parseHackMap(file string, data []byte) ([]HackConfig, error) {
+	var errs HackMapErrors
+	report := func(offset int64, path string, format string, args ...interface{}) {
+		line, column := offsetToLineColumn(data, offset)
+		errs = append(errs, HackMapError{File: file, Line: line, Column: column, Path: path, Msg: fmt.Sprintf(format, args...)})
+	}
+
+	// 先整体检查语法，语法错误时无法继续定位各个元素
+	var raw []json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		// 两种错误的偏移量都指向出错字符之后
+		switch {
+		case errors.As(err, &syntaxErr):
+			report(max(syntaxErr.Offset-1, 0), "", "%s", syntaxErr.Error())
+		case errors.As(err, &typeErr):
+			report(max(typeErr.Offset-1, 0), "", "hack map must be a JSON array")
+		default:
+			report(0, "", "%s", err.Error())
+		}
+		return nil, errs
+	}
+
+	offsets := arrayElementOffsets(data)
+	hacks := make([]HackConfig, 0, len(raw))
+	for i, element := range raw {
+		base := offsets[i]
+		path := fmt.Sprintf("[%d]", i)
+
+		var hack HackConfig
+		decoder := json.NewDecoder(bytes.NewReader(element))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&hack); err != nil {
+			report(base, path, "%s", strings.TrimPrefix(err.Error(), "json: "))
+			continue
+		}
+
+		if err := validateHackSource(hack.HackSource); err != nil {
+			report(base, path+".hackSource", "%s", err.Error())
+		}
+
+		switch hack.HackAction {
+		case AddFile:
+			if hack.HackDetail.AddFileSource == "" {
+				report(base, path+".hackDetail.addFileSource", "is required for addFile")
+			}
+		case ModifyHTMLFile:
+			if len(hack.HackDetail.ModifyPointsList) == 0 {
+				report(base, path+".hackDetail.modifyPointsList", "is required for modifyHTMLFile")
+			}
+			pointOffsets := detailListOffsets(element, "modifyPointsList")
+			for j, point := range hack.HackDetail.ModifyPointsList {
+				pointOffset := base
+				if j < len(pointOffsets) {
+					pointOffset = base + pointOffsets[j]
+				}
+				pointPath := fmt.Sprintf("%s.hackDetail.modifyPointsList[%d]", path, j)
+				for _, msg := range validateModifyPoint(point) {
+					report(pointOffset, pointPath+msg.field, "%s", msg.msg)
+				}
+			}
+		case InjectAsset:
+			if len(hack.HackDetail.Assets) == 0 {
+				report(base, path+".hackDetail.assets", "is required for injectAsset")
+			}
+			assetOffsets := detailListOffsets(element, "assets")
+			for j, asset := range hack.HackDetail.Assets {
+				assetOffset := base
+				if j < len(assetOffsets) {
+					assetOffset = base + assetOffsets[j]
+				}
+				assetPath := fmt.Sprintf("%s.hackDetail.assets[%d]", path, j)
+				for _, msg := range validateAssetPoint(asset) {
+					report(assetOffset, assetPath+msg.field, "%s", msg.msg)
+				}
+			}
+		case StripTrackers:
+			detail := hack.HackDetail
+			if len(detail.BlockedDomains) == 0 && len(detail.InlinePatterns) == 0 {
+				report(base, path+".hackDetail", "blockedDomains or inlinePatterns is required for stripTrackers")
+			}
+			for j, domain := range detail.BlockedDomains {
+				if domain == "" || strings.ContainsAny(domain, "/: ") {
+					report(base, fmt.Sprintf("%s.hackDetail.blockedDomains[%d]", path, j), "must be a bare domain, got %q", domain)
+				}
+			}
+			assetOffsets := detailListOffsets(element, "assets")
+			for j, asset := range detail.Assets {
+				assetOffset := base
+				if j < len(assetOffsets) {
+					assetOffset = base + assetOffsets[j]
+				}
+				assetPath := fmt.Sprintf("%s.hackDetail.assets[%d]", path, j)
+				for _, msg := range validateAssetPoint(asset) {
+					report(assetOffset, assetPath+msg.field, "%s", msg.msg)
+				}
+			}
+		case ReplaceText:
+			if len(hack.HackDetail.Replacements) == 0 {
+				report(base, path+".hackDetail.replacements", "is required for replaceText")
+			}
+			replacementOffsets := detailListOffsets(element, "replacements")
+			for j, replacement := range hack.HackDetail.Replacements {
+				replacementOffset := base
+				if j < len(replacementOffsets) {
+					replacementOffset = base + replacementOffsets[j]
+				}
+				replacementPath := fmt.Sprintf("%s.hackDetail.replacements[%d]", path, j)
+				if replacement.Old == "" {
+					report(replacementOffset, replacementPath+".old", "is required")
+				}
+				if replacement.Limit < 0 {
+					report(replacementOffset, replacementPath+".limit", "must not be negative")
+				}
+				if err := parseCachedTemplate(replacement.New); err != nil {
+					report(replacementOffset, replacementPath+".new", "invalid template: %v", err)
+				}
+			}
+		default:
+			report(base, path+".hackAction", "unknown action %q", hack.HackAction)
+		}
+
+		hacks = append(hacks, hack)
+	}
+
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return hacks, nil
+}
+
+// validateHackSource 检查 hackSource 是否为绝对路径、合法的 glob 或正则表达式
+func validateHackSource(source string) error {
+	if expr, ok := strings.CutPrefix(source, regexpSourcePrefix); ok {
+		if _, err := regexp.Compile(expr); err != nil {
+			return fmt.Errorf("invalid regular expression: %v", err)
+		}
+		return nil
+	}
+	if !strings.HasPrefix(source, "/") {
+		return errors.New("must be an absolute path starting with / or a regular expression starting with re:")
+	}
+	if _, err := path.Match(source, ""); err != nil {
+		return fmt.Errorf("invalid glob pattern: %v", err)
+	}
+	return nil
+}
+
+type fieldError struct {
+	field string
+	msg   string
+}
+
+// validateModifyPoint 检查单个修改点的必填字段与取值范围
+func validateModifyPoint(point ModifyPoint) []fieldError {
+	var errs []fieldError
+
+	if point.Selector == "" {
+		errs = append(errs, fieldError{".selector", "is required"})
+	} else if _, err := cascadia.Compile(point.Selector); err != nil {
+		errs = append(errs, fieldError{".selector", fmt.Sprintf("invalid CSS selector: %v", err)})
+	}
+
+	switch point.Action {
+	case Insert:
+		if point.Position != "before" && point.Position != "after" {
+			errs = append(errs, fieldError{".position", fmt.Sprintf("must be before or after, got %q", point.Position)})
+		}
+	case Delete:
+	case Replace:
+	case ReplaceJS:
+		if point.OldContent == "" {
+			errs = append(errs, fieldError{".oldContent", "is required for replaceJS"})
+		}
+	default:
+		errs = append(errs, fieldError{".action", fmt.Sprintf("unknown action %q", point.Action)})
+	}
+
+	if point.Action != Insert && point.Position != "" {
+		errs = append(errs, fieldError{".position", "is only allowed for insert"})
+	}
+
+	// 模板语法需要在加载时就能被解析
+	for field, text := range map[string]string{".content": point.Content, ".newContent": point.NewContent} {
+		if err := parseCachedTemplate(text); err != nil {
+			errs = append(errs, fieldError{field, fmt.Sprintf("invalid template: %v", err)})
+		}
+	}
+
+	return errs
+}
+
+// validateAssetPoint 检查单个注入资源的类型、位置以及 integrity 依赖的文件
+func validateAssetPoint(asset AssetPoint) []fieldError {
+	var errs []fieldError
+
+	switch asset.Type {
+	case ScriptAsset, StyleAsset:
+		if asset.Src == "" && asset.Content == "" {
+			errs = append(errs, fieldError{".src", fmt.Sprintf("src or content is required for %s", asset.Type)})
+		}
+		if asset.Src != "" && asset.Content != "" {
+			errs = append(errs, fieldError{".content", "is not allowed together with src"})
+		}
+	case MetaAsset:
+		if asset.Src != "" || asset.Content != "" {
+			errs = append(errs, fieldError{".src", "src and content are not allowed for meta"})
+		}
+	default:
+		errs = append(errs, fieldError{".type", fmt.Sprintf("unknown asset type %q", asset.Type)})
+	}
+
+	validPosition := false
+	for _, position := range assetPositions {
+		if asset.Position == position {
+			validPosition = true
+		}
+	}
+	if !validPosition {
+		errs = append(errs, fieldError{".position", fmt.Sprintf("must be one of %s, got %q", strings.Join(assetPositions, "/"), asset.Position)})
+	}
+
+	if asset.Integrity || asset.CacheBust {
+		if asset.File == "" {
+			errs = append(errs, fieldError{".file", "is required for integrity or cacheBust"})
+		} else if !filepath.IsLocal(filepath.FromSlash(strings.TrimPrefix(asset.File, "/"))) {
+			errs = append(errs, fieldError{".file", "must be a path inside the overwrite directory"})
+		} else if _, err := loadAssetHash(asset.File); err != nil {
+			errs = append(errs, fieldError{".file", fmt.Sprintf("unreadable: %v", err)})
+		}
+	}
+
+	if err := parseCachedTemplate(asset.Src); err != nil {
+		errs = append(errs, fieldError{".src", fmt.Sprintf("invalid template: %v", err)})
+	}
+	if err := parseCachedTemplate(asset.Content); err != nil {
+		errs = append(errs, fieldError{".content", fmt.Sprintf("invalid template: %v", err)})
+	}
+	for name, value := range asset.Attrs {
+		if err := parseCachedTemplate(value); err != nil {
+			errs = append(errs, fieldError{".attrs." + name, fmt.Sprintf("invalid template: %v", err)})
+		}
+	}
+
+	return errs
+}
+
+// arrayElementOffsets 返回 JSON 数组中每个元素的起始偏移量
+func arrayElementOffsets(data []byte) []int64 {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if token, err := decoder.Token(); err != nil || token != json.Delim('[') {
+		return nil
+	}
+
+	var offsets []int64
+	for decoder.More() {
+		offsets = append(offsets, skipSeparators(data, decoder.InputOffset()))
+		var skip json.RawMessage
+		if err := decoder.Decode(&skip); err != nil {
+			break
+		}
+	}
+	return offsets
+}
+
+// detailListOffsets 返回单个 hack 元素内 hackDetail 下指定列表各项的相对偏移量
+func detailListOffsets(element []byte, field string) []int64 {
+	detailOffset, ok := objectFieldOffset(element, 0, "hackDetail")
+	if !ok {
+		return nil
+	}
+	listOffset, ok := objectFieldOffset(element, detailOffset, field)
+	if !ok {
+		return nil
+	}
+	offsets := arrayElementOffsets(element[listOffset:])
+	for i := range offsets {
+		offsets[i] += listOffset
+	}
+	return offsets
+}
+
+// objectFieldOffset 返回从 start 开始的 JSON 对象中指定字段值的起始偏移量
+func objectFieldOffset(data []byte, start int64, field string) (int64, bool) {
+	decoder := json.NewDecoder(bytes.NewReader(data[start:]))
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return 0, false
+	}
+
+	for decoder.More() {
+		key, err := decoder.Token()
+		if err != nil {
+			return 0, false
+		}
+		if key == field {
+			return start + skipSeparators(data[start:], decoder.InputOffset()), true
+		}
+		var skip json.RawMessage
+		if err := decoder.Decode(&skip); err != nil {
+			return 0, false
+		}
+	}
+	return 0, false
+}
+
+// skipSeparators 跳过偏移量之后的空白、逗号与冒号，返回下一个值的起始位置
+func skipSeparators(data []byte, offset int64) int64 {
+	for offset < int64(len(data)) {
+		switch data[offset] {
+		case ' ', '\t', '\r', '\n', ',', ':':
+			offset++
+		default:
+			return offset
+		}
+	}
+	return offset
+}
+
+// offsetToLineColumn 将字节偏移量转换为从 1 开始的行号与列号
+func offsetToLineColumn(data []byte, offset int64) (int, int) {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	prefix := data[:offset]
+	line := bytes.Count(prefix, []byte("\n")) + 1
+	column := len(prefix) - bytes.LastIndexByte(prefix, '\n')
+	return line, column
+}
+
+// runValidateCommand 执行 validate 子命令，检查 hack-map 文件并输出所有错误。
+// 与启动时一样结合已加载的配置（包括环境变量覆盖）检查，覆盖文件目录、上游等与配置相关的问题同样会被发现
+func runValidateCommand(c Config, args []string) int {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	_ = fs.Parse(args)
+
+	files := fs.Args()
+	if len(files) == 0 {
+		files = []string{hackMapPath}
+	}
+
+	code := 0
+	for _, file := range files {
+		_, result := checkConfigAndHackMapFile(c, file)
+		for _, warning := range result.Warnings {
+			fmt.Fprintf(os.Stderr, "warning: %s\n", warning)
+		}
+		for _, err := range result.Errors {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		if len(result.Errors) > 0 {
+			code = 1
+			continue
+		}
+		fmt.Fprintf(os.Stdout, "%s: ok\n", file)
+	}
+	return code
+}
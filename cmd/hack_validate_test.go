@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestParseHackMapErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want []string // line:column path
+	}{
+		{
+			name: "valid",
+			data: `[
+  {
+    "hackAction": "replaceText",
+    "hackSource": "/index.html",
+    "hackDetail": {"replacements": [{"old": "a", "new": "b"}]}
+  }
+]`,
+		},
+		{
+			name: "syntax error",
+			data: `[
+  {"hackAction": "replaceText",}
+]`,
+			want: []string{"2:32 "},
+		},
+		{
+			name: "not an array",
+			data: `{"hackAction": "replaceText"}`,
+			want: []string{"1:1 "},
+		},
+		{
+			name: "unknown field",
+			data: `[
+  {"hackAction": "replaceText", "hackSource": "/a.js", "hackDetail": {}},
+  {"hackAction": "replaceText", "bogus": 1}
+]`,
+			want: []string{"2:3 [0].hackDetail.replacements", "3:3 [1]"},
+		},
+		{
+			name: "unknown action and invalid source",
+			data: `[
+    {"hackAction": "bogusAction", "hackSource": "index.html", "hackDetail": {}}
+]`,
+			want: []string{"2:5 [0].hackSource", "2:5 [0].hackAction"},
+		},
+		{
+			name: "addFile source",
+			data: `[
+  {"hackAction": "addFile", "hackSource": "/config.ini", "hackDetail": {"addFileSource": "/config.ini", "overwrite": true}},
+  {"hackAction": "addFile", "hackSource": "/servers.ini", "hackDetail": {}}
+]`,
+			want: []string{"3:3 [1].hackDetail.addFileSource"},
+		},
+		{
+			name: "modify point position",
+			data: `[
+  {
+    "hackAction": "modifyHTMLFile",
+    "hackSource": "/index.html",
+    "hackDetail": {
+      "modifyPointsList": [
+        {"action": "delete", "selector": "head title"},
+        {"action": "insert", "selector": "head", "position": "inside", "content": "x"}
+      ]
+    }
+  }
+]`,
+			want: []string{"8:9 [0].hackDetail.modifyPointsList[1].position"},
+		},
+		{
+			name: "replacement fields",
+			data: `[
+  {
+    "hackAction": "replaceText",
+    "hackSource": "/a.js",
+    "hackDetail": {"replacements": [
+      {"old": "a", "new": "b"},
+      {"old": "", "new": "{{env \"HOME\"}}", "limit": -1}
+    ]}
+  }
+]`,
+			want: []string{
+				"7:7 [0].hackDetail.replacements[1].old",
+				"7:7 [0].hackDetail.replacements[1].limit",
+				"7:7 [0].hackDetail.replacements[1].new",
+			},
+		},
+		{
+			name: "per-request template fields",
+			data: `[
+  {
+    "hackAction": "modifyHTMLFile",
+    "hackSource": "/index.html",
+    "hackDetail": {
+      "modifyPointsList": [
+        {"action": "insert", "selector": "head", "position": "after", "content": "<meta name=\"ip\" content=\"{{.ClientIP}}\">"},
+        {"action": "insert", "selector": "head", "position": "after", "content": "{{with .Config.BaseHref}}{{.}}{{end}}{{.Host}}"},
+        {"action": "replace", "selector": "title", "content": "{{with .Config}}{{$.RequestID}}{{end}}"}
+      ]
+    }
+  }
+]`,
+			want: []string{
+				"7:9 [0].hackDetail.modifyPointsList[0].content",
+				"9:9 [0].hackDetail.modifyPointsList[2].content",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseHackMap("hack-map.json", []byte(tt.data))
+			var got []string
+			if err != nil {
+				var hackErrs HackMapErrors
+				if !errors.As(err, &hackErrs) {
+					t.Fatalf("got %T, want HackMapErrors", err)
+				}
+				for _, hackErr := range hackErrs {
+					if hackErr.File != "hack-map.json" {
+						t.Errorf("file = %q", hackErr.File)
+					}
+					got = append(got, fmt.Sprintf("%d:%d %s", hackErr.Line, hackErr.Column, hackErr.Path))
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q\n%v", got, tt.want, err)
+			}
+		})
+	}
+}
+
+func TestOffsetToLineColumn(t *testing.T) {
+	data := []byte("ab\ncd\n\nef")
+	tests := []struct {
+		offset       int64
+		line, column int
+	}{
+		{0, 1, 1},
+		{1, 1, 2},
+		{3, 2, 1},
+		{4, 2, 2},
+		{6, 3, 1},
+		{7, 4, 1},
+		{100, 4, 3},
+	}
+	for _, tt := range tests {
+		line, column := offsetToLineColumn(data, tt.offset)
+		if line != tt.line || column != tt.column {
+			t.Errorf("offset %d: got %d:%d, want %d:%d", tt.offset, line, column, tt.line, tt.column)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/rs/zerolog/log"
+)
+
+// HeaderActionType 定义请求头与响应头改写动作的枚举值
+type HeaderActionType string
+
+const (
+	HeaderAdd    HeaderActionType = "add"
+	HeaderSet    HeaderActionType = "set"
+	HeaderRemove HeaderActionType = "remove"
+	HeaderRename HeaderActionType = "rename"
+)
+
+// HeaderRule 定义单条头部改写规则
+type HeaderRule struct {
+	Action HeaderActionType `json:"action"` // 操作类型: add/set/remove/rename
+	Name   string           `json:"name"`   // 头部名称
+	Value  string           `json:"value"`  // add/set 的值，支持模板变量，例如 {{.ClientIP}}
+	To     string           `json:"to"`     // rename 的新名称
+}
+
+// HeaderRules 定义请求头与响应头的改写规则，按顺序执行
+type HeaderRules struct {
+	Request  []HeaderRule `json:"request"`  // 转发到上游前对请求头的改写
+	Response []HeaderRule `json:"response"` // 返回给客户端前对响应头的改写
+}
+
+// defaultHeaderRules 未配置 header_rules 时使用的默认规则：
+// 告知上游原始主机，允许页面被嵌入，并统一 Server 头
+var defaultHeaderRules = HeaderRules{
+	Request: []HeaderRule{
+		{Action: HeaderSet, Name: "X-Forwarded-Host", Value: "{{.Host}}"},
+	},
+	Response: []HeaderRule{
+		{Action: HeaderRemove, Name: "X-Frame-Options"},
+		{Action: HeaderSet, Name: "Server", Value: "ra2web-proxy"},
+	},
+}
+
+// globalHeaderRules 返回全局生效的头部改写规则
+func globalHeaderRules() HeaderRules {
+	if rules := currentConfig().HeaderRules; rules != nil {
+		return *rules
+	}
+	return defaultHeaderRules
+}
+
+// validateHeaderRules 校验头部改写规则，field 为规则在配置中的位置
+func validateHeaderRules(field string, rules *HeaderRules) error {
+	if rules == nil {
+		return nil
+	}
+	check := func(kind string, list []HeaderRule) error {
+		for i, rule := range list {
+			prefix := fmt.Sprintf("%s.%s[%d]", field, kind, i)
+			if rule.Name == "" {
+				return fmt.Errorf("%s: name is required", prefix)
+			}
+			switch rule.Action {
+			case HeaderAdd, HeaderSet:
+				if err := parseHackTemplate(rule.Value); err != nil {
+					return fmt.Errorf("%s: invalid value template: %w", prefix, err)
+				}
+			case HeaderRemove:
+			case HeaderRename:
+				if rule.To == "" {
+					return fmt.Errorf("%s: to is required for rename", prefix)
+				}
+			default:
+				return fmt.Errorf("%s: unknown action %q", prefix, rule.Action)
+			}
+		}
+		return nil
+	}
+	if err := check("request", rules.Request); err != nil {
+		return err
+	}
+	return check("response", rules.Response)
+}
+
+// applyHeaderRules 按顺序对头部执行改写规则，模板渲染失败的规则会被跳过并记录日志
+func applyHeaderRules(header http.Header, rules []HeaderRule, vars TemplateVars) {
+	for _, rule := range rules {
+		switch rule.Action {
+		case HeaderAdd, HeaderSet:
+			value, err := renderTemplate(rule.Value, vars)
+			if err != nil {
+				log.Error().Err(err).Str("header", rule.Name).Msg("Error rendering header rule")
+				continue
+			}
+			if rule.Action == HeaderAdd {
+				header.Add(rule.Name, value)
+			} else {
+				header.Set(rule.Name, value)
+			}
+		case HeaderRemove:
+			header.Del(rule.Name)
+		case HeaderRename:
+			values := header.Values(rule.Name)
+			if len(values) == 0 {
+				continue
+			}
+			header.Del(rule.Name)
+			header.Del(rule.To)
+			for _, value := range values {
+				header.Add(rule.To, value)
+			}
+		}
+	}
+}
+
+// requestHeaderRules 返回请求生效的请求头改写规则，路由规则追加在全局规则之后
+func requestHeaderRules(routeRules *HeaderRules) []HeaderRule {
+	rules := globalHeaderRules().Request
+	if routeRules != nil {
+		rules = append(append([]HeaderRule(nil), rules...), routeRules.Request...)
+	}
+	return rules
+}
+
+// responseHeaderRules 返回请求生效的响应头改写规则，路由规则追加在全局规则之后
+func responseHeaderRules(routeRules *HeaderRules) []HeaderRule {
+	rules := globalHeaderRules().Response
+	if routeRules != nil {
+		rules = append(append([]HeaderRule(nil), rules...), routeRules.Response...)
+	}
+	return rules
+}
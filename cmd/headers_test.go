@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// headerEchoUpstream 将收到的请求头以 X-Got- 前缀返回，并附带需要改写的响应头
+var headerEchoUpstream = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	for _, name := range []string{"X-Forwarded-Host", "X-Client-Ip", "X-Request-Id", "Cookie", "X-Legacy", "X-Modern"} {
+		if values := r.Header.Values(name); len(values) > 0 {
+			w.Header().Set("X-Got-"+name, strings.Join(values, ","))
+		}
+	}
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Server", "origin")
+	w.Header().Set("X-Internal", "node-7")
+	w.Header().Set("Content-Type", "application/javascript")
+	_, _ = w.Write([]byte("ok"))
+})
+
+func TestProxyDefaultHeaderRules(t *testing.T) {
+	newTestProxy(t, headerEchoUpstream, Config{}, nil)
+
+	// 第二次请求命中缓存，响应头规则同样生效
+	for round := 0; round < 2; round++ {
+		w := proxyGet("http://"+testEntryHost+":8080/app.js", nil)
+		if round == 0 && w.Header().Get("X-Got-X-Forwarded-Host") != testEntryHost {
+			t.Errorf("upstream got X-Forwarded-Host %q, want %q", w.Header().Get("X-Got-X-Forwarded-Host"), testEntryHost)
+		}
+		if got := w.Header().Get("X-Frame-Options"); got != "" {
+			t.Errorf("round %d: X-Frame-Options = %q, want removed", round, got)
+		}
+		if got := w.Header().Get("Server"); got != "ra2web-proxy" {
+			t.Errorf("round %d: Server = %q, want ra2web-proxy", round, got)
+		}
+	}
+}
+
+func TestProxyHeaderRules(t *testing.T) {
+	newTestProxy(t, headerEchoUpstream, Config{
+		TrustedProxies: []string{"192.0.2.0/24"},
+		HeaderRules: &HeaderRules{
+			Request: []HeaderRule{
+				{Action: HeaderSet, Name: "X-Client-IP", Value: "{{.ClientIP}}"},
+				{Action: HeaderAdd, Name: "X-Request-ID", Value: "proxy-{{.RequestID}}"},
+				{Action: HeaderRemove, Name: "Cookie"},
+				{Action: HeaderRename, Name: "X-Legacy", To: "X-Modern"},
+			},
+			Response: []HeaderRule{
+				{Action: HeaderRename, Name: "X-Internal", To: "X-Upstream-Node"},
+				{Action: HeaderSet, Name: "X-Served-Host", Value: "{{.Host}}"},
+			},
+		},
+		Routes: []ConfigRoute{{
+			PathPrefix: "/api/",
+			Upstream:   "main",
+			Headers: &HeaderRules{
+				Response: []HeaderRule{{Action: HeaderSet, Name: "Cache-Control", Value: "no-store"}},
+			},
+		}},
+	}, nil)
+
+	request := map[string]string{
+		"X-Forwarded-For": "203.0.113.7",
+		"X-Request-ID":    "abc",
+		"Cookie":          "sid=1",
+		"X-Legacy":        "v1",
+	}
+	tests := []struct {
+		name string
+		path string
+		want map[string]string // 空值表示该响应头不存在
+	}{
+		{
+			name: "global rules replace defaults",
+			path: "/app",
+			want: map[string]string{
+				"X-Got-X-Client-Ip":      "203.0.113.7",
+				"X-Got-X-Request-Id":     "abc,proxy-abc",
+				"X-Got-Cookie":           "",
+				"X-Got-X-Legacy":         "",
+				"X-Got-X-Modern":         "v1",
+				"X-Got-X-Forwarded-Host": "",
+				"X-Internal":             "",
+				"X-Upstream-Node":        "node-7",
+				"X-Served-Host":          testEntryHost,
+				"X-Frame-Options":        "DENY",
+				"Cache-Control":          "",
+			},
+		},
+		{
+			name: "route rules run after global rules",
+			path: "/api/status",
+			want: map[string]string{
+				"X-Upstream-Node": "node-7",
+				"Cache-Control":   "no-store",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// httptest 请求的来源地址 192.0.2.1 属于可信代理网段
+			w := proxyGet("http://"+testEntryHost+tt.path, request)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d", w.Code)
+			}
+			for name, want := range tt.want {
+				if got := strings.Join(w.Header().Values(name), ","); got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
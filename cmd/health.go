@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"ra2web-proxy/pkg/utils"
+	"sort"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	defaultMinFreeDiskMB    = 512
+	defaultMaxLogQueueRatio = 0.9
+)
+
+// ConfigReadiness 定义 readyz 检查的阈值
+type ConfigReadiness struct {
+	MinFreeDiskMB    int     `json:"min_free_disk_mb"`    // 缓存目录所在磁盘的最小可用空间，默认 512
+	MaxLogQueueRatio float64 `json:"max_log_queue_ratio"` // 日志队列占用比例的上限，默认 0.9
+	// RequireUpstreams 上游没有可用源站时 readyz 是否失败，默认为 true。
+	// 所有节点共用同一组源站时，源站整体故障会让全部节点下线，可以设置为 false 只作为提示
+	RequireUpstreams *bool `json:"require_upstreams"`
+}
+
+// HealthCheck 定义单项检查的结果
+type HealthCheck struct {
+	Status  string `json:"status"` // ok、warn 或 fail，warn 不影响总体状态
+	Message string `json:"message,omitempty"`
+}
+
+// HealthResponse 定义 healthz 与 readyz 接口的输出格式，两个接口无需鉴权，只输出每项检查的状态，
+// readyz 额外输出各个上游与源站的可用状态，不包含源站地址与错误信息
+type HealthResponse struct {
+	Status    string                          `json:"status"`              // ok 或 unavailable
+	Checks    map[string]string               `json:"checks"`              // 各项检查的状态
+	Upstreams map[string]UpstreamAvailability `json:"upstreams,omitempty"` // 各个上游的可用状态
+}
+
+// UpstreamAvailability 定义 readyz 输出的上游可用状态
+type UpstreamAvailability struct {
+	Available bool                 `json:"available"` // 是否至少有一个可用的源站
+	Origins   []OriginAvailability `json:"origins"`   // 各个源站的状态，顺序与配置中的 origins 一致
+}
+
+// OriginAvailability 定义 readyz 输出的源站可用状态
+type OriginAvailability struct {
+	Available bool `json:"available"` // 是否参与转发
+	Healthy   bool `json:"healthy"`   // 主动健康检查是否通过
+	Ejected   bool `json:"ejected"`   // 是否因请求失败被暂时摘除
+}
+
+// HealthDetailResponse 定义健康详情接口的输出格式，包含检查详情与各个源站的健康状态
+type HealthDetailResponse struct {
+	Status    string                    `json:"status"`
+	Checks    map[string]HealthCheck    `json:"checks"`
+	Upstreams map[string][]OriginStatus `json:"upstreams"` // 各个上游的源站健康状态
+}
+
+func checkOK(format string, args ...interface{}) HealthCheck {
+	return HealthCheck{Status: "ok", Message: fmt.Sprintf(format, args...)}
+}
+
+func checkWarn(format string, args ...interface{}) HealthCheck {
+	return HealthCheck{Status: "warn", Message: fmt.Sprintf(format, args...)}
+}
+
+func checkFail(format string, args ...interface{}) HealthCheck {
+	return HealthCheck{Status: "fail", Message: fmt.Sprintf(format, args...)}
+}
+
+// readinessSettings 返回当前配置的 readyz 阈值，未配置的项使用默认值
+func readinessSettings() ConfigReadiness {
+	requireUpstreams := true
+	settings := ConfigReadiness{MinFreeDiskMB: defaultMinFreeDiskMB, MaxLogQueueRatio: defaultMaxLogQueueRatio, RequireUpstreams: &requireUpstreams}
+	if c := currentConfig().Readiness; c != nil {
+		if c.MinFreeDiskMB > 0 {
+			settings.MinFreeDiskMB = c.MinFreeDiskMB
+		}
+		if c.MaxLogQueueRatio > 0 {
+			settings.MaxLogQueueRatio = c.MaxLogQueueRatio
+		}
+		if c.RequireUpstreams != nil {
+			settings.RequireUpstreams = c.RequireUpstreams
+		}
+	}
+	return settings
+}
+
+// checkConfigLoaded 检查配置与 hack-map 是否已经加载
+func checkConfigLoaded() HealthCheck {
+	rc := activeConfig.Load()
+	if rc == nil {
+		return checkFail("config not loaded")
+	}
+	return checkOK("%d upstreams, %d hacks", len(rc.upstreams), len(rc.hacks))
+}
+
+// checkCacheDirWritable 在缓存目录中写入并删除一个临时文件，遗留的临时文件会在启动时清理
+func checkCacheDirWritable() HealthCheck {
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		return checkFail("%v", err)
+	}
+	file, err := os.CreateTemp(cacheDir, "tmp-readyz-*")
+	if err != nil {
+		return checkFail("%v", err)
+	}
+	defer os.Remove(file.Name())
+	_, err = file.Write([]byte("ok"))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return checkFail("%v", err)
+	}
+	return checkOK("%s", cacheDir)
+}
+
+// checkDiskFree 检查缓存目录所在磁盘的可用空间
+func checkDiskFree(minFreeDiskMB int) HealthCheck {
+	free, err := utils.DiskFree(cacheDir)
+	if err != nil {
+		return checkFail("%v", err)
+	}
+	freeMB := free / 1024 / 1024
+	if freeMB < uint64(minFreeDiskMB) {
+		return checkFail("%d MB free, below %d MB", freeMB, minFreeDiskMB)
+	}
+	return checkOK("%d MB free", freeMB)
+}
+
+// checkUpstreams 使用健康检查已有的结果，检查每个上游是否至少有一个可用的源站，
+// required 为 false（require_upstreams 设置为 false）时没有可用源站只作为提示
+func checkUpstreams(upstreams map[string][]OriginStatus, required bool) HealthCheck {
+	var unavailable []string
+	for name, statuses := range upstreams {
+		available := false
+		for _, status := range statuses {
+			available = available || status.Available
+		}
+		if !available {
+			unavailable = append(unavailable, name)
+		}
+	}
+	if len(unavailable) > 0 {
+		sort.Strings(unavailable)
+		if !required {
+			return checkWarn("no available origin: %s", strings.Join(unavailable, ", "))
+		}
+		return checkFail("no available origin: %s", strings.Join(unavailable, ", "))
+	}
+	return checkOK("%d upstreams available", len(upstreams))
+}
+
+// checkLogQueue 检查日志队列的占用比例，队列写满时新的访问日志会被丢弃
+func checkLogQueue(maxRatio float64) HealthCheck {
+	queued, capacity := len(logChannel), cap(logChannel)
+	if float64(queued) >= float64(capacity)*maxRatio {
+		return checkFail("%d/%d queued", queued, capacity)
+	}
+	return checkOK("%d/%d queued", queued, capacity)
+}
+
+// writeHealthResponse 以 JSON 输出检查结果，存在失败的检查时返回 503
+func writeHealthResponse(w http.ResponseWriter, name string, status string, response interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Error().Err(err).Msgf("Error writing %s response", name)
+	}
+}
+
+// overallStatus 任一检查失败时返回 unavailable
+func overallStatus(checks map[string]HealthCheck) string {
+	for _, check := range checks {
+		if check.Status == "fail" {
+			return "unavailable"
+		}
+	}
+	return "ok"
+}
+
+// checkStatuses 只保留每项检查的状态，详情中的路径、源站与错误信息不通过公开接口输出
+func checkStatuses(checks map[string]HealthCheck) map[string]string {
+	statuses := make(map[string]string, len(checks))
+	for name, check := range checks {
+		statuses[name] = check.Status
+	}
+	return statuses
+}
+
+// readinessChecks 执行 readyz 的全部检查：配置已加载、缓存目录可写、磁盘空间充足、
+// 每个上游至少有一个可用的源站、日志队列未饱和
+func readinessChecks(upstreams map[string][]OriginStatus) map[string]HealthCheck {
+	settings := readinessSettings()
+	return map[string]HealthCheck{
+		"config":    checkConfigLoaded(),
+		"cache_dir": checkCacheDirWritable(),
+		"disk":      checkDiskFree(settings.MinFreeDiskMB),
+		"upstreams": checkUpstreams(upstreams, *settings.RequireUpstreams),
+		"log_queue": checkLogQueue(settings.MaxLogQueueRatio),
+	}
+}
+
+// originStatuses 返回各个上游的源站健康状态
+func originStatuses() map[string][]OriginStatus {
+	upstreams := map[string][]OriginStatus{}
+	for name, upstream := range currentUpstreams() {
+		upstreams[name] = upstream.OriginStatuses()
+	}
+	return upstreams
+}
+
+// readyzHandler 检查节点能否正常处理请求，任一检查失败时返回 503，供负载均衡摘除节点
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	upstreams := originStatuses()
+	checks := readinessChecks(upstreams)
+	response := HealthResponse{Status: overallStatus(checks), Checks: checkStatuses(checks), Upstreams: upstreamAvailability(upstreams)}
+	writeHealthResponse(w, "readyz", response.Status, response)
+}
+
+// upstreamAvailability 只保留上游与源站的可用状态，源站地址与错误信息只在健康详情接口中输出
+func upstreamAvailability(upstreams map[string][]OriginStatus) map[string]UpstreamAvailability {
+	result := make(map[string]UpstreamAvailability, len(upstreams))
+	for name, statuses := range upstreams {
+		availability := UpstreamAvailability{Origins: make([]OriginAvailability, 0, len(statuses))}
+		for _, status := range statuses {
+			availability.Available = availability.Available || status.Available
+			availability.Origins = append(availability.Origins, OriginAvailability{
+				Available: status.Available,
+				Healthy:   status.Healthy,
+				Ejected:   status.Ejected,
+			})
+		}
+		result[name] = availability
+	}
+	return result
+}
+
+// healthzHandler 检查进程是否存活：配置已加载。
+// 上游、磁盘与日志队列等问题只影响 readyz，避免因此重启进程
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]HealthCheck{
+		"config": checkConfigLoaded(),
+	}
+	response := HealthResponse{Status: overallStatus(checks), Checks: checkStatuses(checks)}
+	writeHealthResponse(w, "healthz", response.Status, response)
+}
+
+// healthDetailHandler 在 api_endpoint 域名下输出 readyz 的检查详情与各个源站的健康状态，用于排查问题
+func healthDetailHandler(w http.ResponseWriter, r *http.Request) {
+	if !isDomainAllowedCallApi(r.Host, *currentConfig()) {
+		mainProxyHandler(w, r)
+		return
+	}
+
+	upstreams := originStatuses()
+	checks := readinessChecks(upstreams)
+	response := HealthDetailResponse{Status: overallStatus(checks), Checks: checks, Upstreams: upstreams}
+	writeHealthResponse(w, "health detail", response.Status, response)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReadyzUpstreams(t *testing.T) {
+	disabled := false
+
+	tests := []struct {
+		name          string
+		require       *bool
+		eject         bool // 摘除唯一的源站
+		wantCode      int
+		wantCheck     string
+		wantAvailable bool
+	}{
+		{"available", nil, false, http.StatusOK, "ok", true},
+		{"unavailable fails by default", nil, true, http.StatusServiceUnavailable, "fail", false},
+		{"unavailable with opt-out", &disabled, true, http.StatusOK, "warn", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestProxy(t, http.NotFoundHandler(), Config{
+				Readiness: &ConfigReadiness{MinFreeDiskMB: 1, RequireUpstreams: tt.require},
+			}, nil)
+			if tt.eject {
+				currentUpstreams()["main"].Origins[0].markFailure(errors.New("refused"), 1, time.Minute)
+			}
+
+			w := httptest.NewRecorder()
+			readyzHandler(w, httptest.NewRequest("GET", "http://"+testEntryHost+"/proxy-svc/api/readyz", nil))
+			if w.Code != tt.wantCode {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.wantCode, w.Body)
+			}
+			var response HealthResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			if response.Checks["upstreams"] != tt.wantCheck {
+				t.Errorf("upstreams check = %q, want %q", response.Checks["upstreams"], tt.wantCheck)
+			}
+			upstream := response.Upstreams["main"]
+			if upstream.Available != tt.wantAvailable || len(upstream.Origins) != 1 {
+				t.Fatalf("upstreams.main = %+v, want available %v with one origin", upstream, tt.wantAvailable)
+			}
+			if origin := upstream.Origins[0]; origin.Available != tt.wantAvailable || origin.Ejected != tt.eject {
+				t.Errorf("origin = %+v, want available %v ejected %v", origin, tt.wantAvailable, tt.eject)
+			}
+		})
+	}
+}
+
+func TestReadyzChecks(t *testing.T) {
+	tests := []struct {
+		name      string
+		readiness ConfigReadiness
+		setup     func(t *testing.T)
+		wantCode  int
+		wantFail  string // 唯一失败的检查，空值表示全部通过
+	}{
+		{"healthy", ConfigReadiness{MinFreeDiskMB: 1}, nil, http.StatusOK, ""},
+		{"cache dir not writable", ConfigReadiness{MinFreeDiskMB: 1}, func(t *testing.T) {
+			// 缓存目录的位置被普通文件占用，无论是否以 root 运行都无法写入
+			file := filepath.Join(t.TempDir(), "cache")
+			if err := os.WriteFile(file, nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+			cacheDir = file
+		}, http.StatusServiceUnavailable, "cache_dir"},
+		{"disk below threshold", ConfigReadiness{MinFreeDiskMB: 1 << 30}, nil, http.StatusServiceUnavailable, "disk"},
+		{"log queue saturated", ConfigReadiness{MinFreeDiskMB: 1, MaxLogQueueRatio: 0.5}, func(t *testing.T) {
+			logChannel = make(chan LogMessage, 4)
+			logChannel <- LogMessage{}
+			logChannel <- LogMessage{}
+		}, http.StatusServiceUnavailable, "log_queue"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			readiness := tt.readiness
+			newTestProxy(t, http.NotFoundHandler(), Config{Readiness: &readiness}, nil)
+			savedLogChannel := logChannel
+			t.Cleanup(func() { logChannel = savedLogChannel })
+			logChannel = make(chan LogMessage, 4)
+			if tt.setup != nil {
+				tt.setup(t)
+			}
+
+			w := httptest.NewRecorder()
+			readyzHandler(w, httptest.NewRequest("GET", "http://"+testEntryHost+"/proxy-svc/api/readyz", nil))
+			if w.Code != tt.wantCode {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.wantCode, w.Body)
+			}
+			var response HealthResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			for _, name := range []string{"config", "cache_dir", "disk", "upstreams", "log_queue"} {
+				want := "ok"
+				if name == tt.wantFail {
+					want = "fail"
+				}
+				if response.Checks[name] != want {
+					t.Errorf("%s check = %q, want %q", name, response.Checks[name], want)
+				}
+			}
+
+			// 存活检查只关心配置是否加载，不因 readyz 的失败而重启进程
+			w = httptest.NewRecorder()
+			healthzHandler(w, httptest.NewRequest("GET", "http://"+testEntryHost+"/proxy-svc/api/healthz", nil))
+			if w.Code != http.StatusOK {
+				t.Errorf("healthz status = %d, want 200: %s", w.Code, w.Body)
+			}
+		})
+	}
+}
+
+func TestHealthzConfigNotLoaded(t *testing.T) {
+	saved := activeConfig.Load()
+	activeConfig.Store(nil)
+	t.Cleanup(func() { activeConfig.Store(saved) })
+
+	w := httptest.NewRecorder()
+	healthzHandler(w, httptest.NewRequest("GET", "http://"+testEntryHost+"/proxy-svc/api/healthz", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want 503", w.Code)
+	}
+	var response HealthResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Status != "unavailable" || response.Checks["config"] != "fail" {
+		t.Errorf("response = %+v, want the config check to fail", response)
+	}
+}
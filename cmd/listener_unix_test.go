@@ -0,0 +1,61 @@
+//go:build !windows
+
+package main
+
+import (
+	"net"
+	"strconv"
+	"testing"
+)
+
+func TestListenReusePort(t *testing.T) {
+	first, err := listen("127.0.0.1:0", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+
+	// 新进程可以在旧进程退出前绑定同一端口
+	addr := "127.0.0.1:" + strconv.Itoa(listenerPort(first))
+	second, err := listen(addr, true)
+	if err != nil {
+		t.Fatalf("second listener with SO_REUSEPORT: %v", err)
+	}
+	second.Close()
+
+	if _, err := listen(addr, false); err == nil {
+		t.Error("listening without SO_REUSEPORT should fail while the port is in use")
+	}
+}
+
+func TestInheritedListeners(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	file, err := listener.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// inheritedListeners 接管并关闭传入的 fd
+	t.Setenv(listenFDsEnv, "http="+strconv.Itoa(int(file.Fd())))
+	inherited, err := inheritedListeners()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, ok := inherited["http"]
+	if !ok {
+		t.Fatalf("inherited = %v, want an http listener", inherited)
+	}
+	defer got.Close()
+	if listenerPort(got) != listenerPort(listener) {
+		t.Errorf("inherited port %d, want %d", listenerPort(got), listenerPort(listener))
+	}
+
+	t.Setenv(listenFDsEnv, "http=abc")
+	if _, err := inheritedListeners(); err == nil {
+		t.Error("expected an error for an invalid fd")
+	}
+}
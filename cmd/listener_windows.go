@@ -0,0 +1,17 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// restartSignals Windows 不支持平滑重启
+var restartSignals []os.Signal
+
+// reusePortControl Windows 不支持 SO_REUSEPORT
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return errors.New("reuse_port is not supported on windows")
+}
@@ -4,7 +4,10 @@ import (
 	"bytes"
 	"compress/flate"
 	"compress/gzip"
+	"context"
+	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"mime"
@@ -13,14 +16,13 @@ import (
 	"net/http/httputil"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"ra2web-proxy/pkg/utils"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
-	"github.com/PuerkitoBio/goquery"
 	"github.com/andybalholm/brotli"
 	"github.com/klauspost/compress/zstd"
 	"github.com/rs/zerolog"
@@ -29,15 +31,44 @@ import (
 )
 
 type Config struct {
-	MainTargetURL  string       `json:"main_target_url"`
-	MainEntryList  []string     `json:"main_entry_list"`
-	ResTargetURL   string       `json:"res_target_url"`
-	ResEntryList   []string     `json:"res_entry_list"`
-	ApiEndpoint    []string     `json:"api_endpoint"`
-	AllowedOrigins []string     `json:"allowed_origins"`
-	BaseHref       string       `json:"base_href"`
-	HTTP           ConfigHTTP   `json:"http"`
-	HTTPS          *ConfigHTTPS `json:"https"`
+	MainTargetURL  string            `json:"main_target_url"`
+	MainEntryList  []string          `json:"main_entry_list"`
+	ResTargetURL   string            `json:"res_target_url"`
+	ResEntryList   []string          `json:"res_entry_list"`
+	ApiEndpoint    []string          `json:"api_endpoint"`
+	AllowedOrigins []string          `json:"allowed_origins"`
+	BaseHref       string            `json:"base_href"`
+	MainHost       string            `json:"main_host"`   // 模板变量 MainHost，为空时取 main_entry_list 第一项
+	ResHost        string            `json:"res_host"`    // 模板变量 ResHost，为空时取 res_entry_list 第一项
+	URLRewrite     *ConfigURLRewrite `json:"url_rewrite"` // 响应内容中上游绝对地址的改写规则
+	// RedirectRewrite 按上游名称（main/res）配置重定向地址与 Cookie 的改写规则
+	RedirectRewrite map[string]*ConfigRedirectRewrite `json:"redirect_rewrite"`
+	// Upstreams 命名上游，main_target_url 与 res_target_url 分别作为 main、res 上游
+	Upstreams map[string]ConfigUpstream `json:"upstreams"`
+	// ErrorPages 按状态码、主机与请求类型匹配的错误页面表，为空时使用 defaultErrorPages
+	ErrorPages []ConfigErrorPage `json:"error_pages"`
+	// HeaderRules 全局的请求头与响应头改写规则，为空时使用 defaultHeaderRules
+	HeaderRules *HeaderRules `json:"header_rules"`
+	// Routes 按顺序匹配的路由规则，未命中时按入口主机路由
+	Routes []ConfigRoute `json:"routes"`
+	// Maintenance 维护模式与计划维护时间段，运行时可以通过 /proxy-svc/api/v1/maintenance 修改
+	Maintenance *ConfigMaintenance `json:"maintenance"`
+	// TrustedProxies 可信代理（CDN、负载均衡）的 IP 或网段，只有来自这些地址的 X-Forwarded-For 与 X-Forwarded-Proto 才会被采用
+	TrustedProxies []string `json:"trusted_proxies"`
+	// Readiness /proxy-svc/api/readyz 检查的阈值
+	Readiness *ConfigReadiness `json:"readiness"`
+	// CacheDir、OverwriteDir、ViewsDir 分别为缓存目录、覆盖文件目录与内置页面模板目录，可以通过命令行参数覆盖
+	CacheDir     string `json:"cache_dir"`
+	OverwriteDir string `json:"overwrite_dir"`
+	ViewsDir     string `json:"views_dir"`
+	// ReloadInterval 检查配置文件与 hack-map 是否变化的间隔，例如 10s，为空时只在收到 SIGHUP 或调用接口时重新加载
+	ReloadInterval string `json:"reload_interval"`
+	// ShutdownTimeout 停机与平滑重启时等待进行中请求完成的最长时间，默认 30s，超时后强制关闭连接
+	ShutdownTimeout string `json:"shutdown_timeout"`
+	// ReusePort 监听时设置 SO_REUSEPORT，允许新旧进程同时绑定同一端口，Windows 不支持
+	ReusePort bool         `json:"reuse_port"`
+	HTTP      ConfigHTTP   `json:"http"`
+	HTTPS     *ConfigHTTPS `json:"https"`
 }
 
 type ConfigHTTP struct {
@@ -76,18 +107,24 @@ type LogMessage struct {
 	CachePath   string // 缓存路径
 	UpstreamURL string // 上游URL
 	Error       error  // 错误信息
+
+	flushed chan struct{} // 不为空时为刷新标记，logger 处理到该消息时关闭，见 flushLogs
 }
 
 // HackActionType 定义枚举值
 type HackActionType string
 
+const (
+	AddFile        HackActionType = "addFile"
+	ModifyHTMLFile HackActionType = "modifyHTMLFile"
+	InjectAsset    HackActionType = "injectAsset"
+	StripTrackers  HackActionType = "stripTrackers"
+	ReplaceText    HackActionType = "replaceText"
+)
+
 var (
-	targetsMap     sync.Map
-	targetsTypeMap sync.Map
-	logChannel     = make(chan LogMessage, 10000)
-	singleGroup    singleflight.Group
-	config         Config
-	allowedOrigins sync.Map
+	logChannel  = make(chan LogMessage, 10000)
+	singleGroup singleflight.Group
 )
 
 // ModifyActionType 定义修改动作类型的枚举值
@@ -110,19 +147,72 @@ type ModifyPoint struct {
 	NewContent string           `json:"newContent"` // 新的内联JS内容，仅在replaceJS操作时使用
 }
 
+// AssetType 定义注入资源类型的枚举值
+type AssetType string
+
+const (
+	ScriptAsset AssetType = "script"
+	StyleAsset  AssetType = "style"
+	MetaAsset   AssetType = "meta"
+)
+
+// AssetPoint 定义注入资源的数据结构
+type AssetPoint struct {
+	Type      AssetType         `json:"type"`      // 资源类型: script/style/meta
+	Position  string            `json:"position"`  // 插入位置: head-start/head-end/body-end
+	Src       string            `json:"src"`       // script 的 src 或 style 的 href，支持模板变量
+	Content   string            `json:"content"`   // 内联的脚本或样式内容，与src互斥，支持模板变量
+	File      string            `json:"file"`      // overwrite目录下对应的文件，用于计算integrity与cache-busting
+	Integrity bool              `json:"integrity"` // 是否根据file自动计算integrity
+	CacheBust bool              `json:"cacheBust"` // 是否在地址后追加file的内容哈希
+	Attrs     map[string]string `json:"attrs"`     // 其他属性，值为空时输出为布尔属性，例如async/defer
+}
+
+// TextReplacement 定义文本替换规则
+type TextReplacement struct {
+	Old   string `json:"old"`   // 要替换的原始内容
+	New   string `json:"new"`   // 替换后的内容，支持模板变量
+	Limit int    `json:"limit"` // 最多替换次数，0表示全部替换
+}
+
 // HackDetail 定义详细操作的数据结构
 type HackDetail struct {
-	ModifyPointsList []ModifyPoint `json:"modifyPointsList"`
+	ModifyPointsList []ModifyPoint     `json:"modifyPointsList"` // 修改点列表，仅在modifyHTMLFile操作时使用
+	AddFileSource    string            `json:"addFileSource"`    // overwrite目录下的文件，仅在addFile操作时使用
+	Overwrite        bool              `json:"overwrite"`        // 是否覆盖上游同名文件，仅在addFile操作时使用
+	Assets           []AssetPoint      `json:"assets"`           // 要注入的资源列表，在injectAsset与stripTrackers操作时使用
+	BlockedDomains   []string          `json:"blockedDomains"`   // 要移除的第三方统计域名，包含其子域名，仅在stripTrackers操作时使用
+	InlinePatterns   []string          `json:"inlinePatterns"`   // 要移除的内联脚本特征片段，仅在stripTrackers操作时使用
+	Replacements     []TextReplacement `json:"replacements"`     // 文本替换规则，仅在replaceText操作时使用
 }
 
 // HackConfig 定义整体操作配置的数据结构
 type HackConfig struct {
 	HackAction HackActionType `json:"hackAction"`
-	HackSource string         `json:"hackSource"`
+	HackSource string         `json:"hackSource"` // 路径，支持 glob（例如 /dist/*.js）或 re: 前缀的正则表达式
 	HackDetail HackDetail     `json:"hackDetail"`
+	Upstreams  []string       `json:"upstreams,omitempty"` // 作用的上游名称，为空时作用于全部上游
 }
 
-var cacheDir = "./_cacheRaw"
+var cacheDir = defaultCacheDir
+
+// overwriteRoutes 直接返回覆盖文件的路径，文件相对于 overwriteDir，Template 为 true 时先按模板渲染
+var overwriteRoutes = []struct {
+	Path     string
+	File     string
+	Template bool
+}{
+	{Path: "/config.ini", File: "config.ini", Template: true},
+	{Path: "/breaking-news.html", File: "breaking-news.html"},
+	//servers.ini由作者保持最新
+	//{Path: "/servers.ini", File: "servers.ini"},
+	{Path: "/lib/local-trans.js", File: "local-trans.js"},
+	{Path: "/lib/nipplejs.js", File: "nipplejs.js"},
+	{Path: "/res/locale/zh-CN.json", File: "zh-CN.json"},
+	{Path: "/res/locale/zh-TW.json", File: "zh-CN.json"},
+	{Path: "/robots.txt", File: "robots.txt"},
+	{Path: "/res/mods.ini", File: "mods.ini"},
+}
 
 func main() {
 	// 配置 zerolog
@@ -132,46 +222,85 @@ func main() {
 		TimeFormat: time.RFC3339,
 	})
 
+	// 解析全局参数，剩余参数为子命令
+	commandLine, args := parseCommandLine(os.Args[1:])
+	commandLine.resolvePaths()
+
 	/*
 		处理配置文件
 	*/
-	// 读取配置文件
-	configFile, err := os.ReadFile("config/config.json")
+	// 读取配置文件，依次应用环境变量与命令行参数
+	startupCommandLine = commandLine
+	config, err := loadConfig(commandLine)
 	if err != nil {
-		log.Fatal().Msgf("unable to read config file: %v", err)
+		log.Fatal().Msgf("%v", err)
+	}
+	if len(args) > 0 && args[0] == "print-config" {
+		os.Exit(runPrintConfigCommand(config))
+	}
+	setDirs(&config)
+	if len(args) > 0 && args[0] == "check" {
+		os.Exit(runCheckCommand(config, commandLine.configPath, args[1:]))
+	}
+	if len(args) > 0 && args[0] == "validate" {
+		os.Exit(runValidateCommand(config, args[1:]))
 	}
 
-	// 解析JSON配置文件，配置送入全局
-	err = json.Unmarshal(configFile, &config)
-	if err != nil {
-		log.Fatal().Msgf("unable to parse config file: %v", err)
+	// 检查配置与 hack-map，一次报告全部问题，存在错误时拒绝启动
+	hacks, result := checkConfigAndHackMap(config)
+	for _, warning := range result.Warnings {
+		log.Warn().Msg(warning)
+	}
+	if len(result.Errors) > 0 {
+		log.Fatal().Msgf("invalid config:\n%v", result.Errors)
 	}
 
-	for _, origin := range config.AllowedOrigins {
-		allowedOrigins.Store(origin, true)
+	// 解析命名上游、入口主机、头部改写规则、错误页面表与路由规则，配置送入全局
+	rc, err := buildRuntime(config, hacks)
+	if err != nil {
+		log.Fatal().Msgf("%v", err)
 	}
-	// 添加 main_entry_list 中的项到 targetsMap
-	for _, entry := range config.MainEntryList {
-		targetsMap.Store(entry, mustParseURL(config.MainTargetURL))
-		targetsTypeMap.Store(entry, "main")
+
+	/*
+		子命令处理
+	*/
+	// preview 只读取上游内容，不启动健康检查，也不清理缓存目录
+	if len(args) > 0 {
+		switch args[0] {
+		case "preview":
+			activeConfig.Store(rc)
+			os.Exit(runPreviewCommand(args[1:]))
+		default:
+			log.Fatal().Msgf("unknown command %q", args[0])
+		}
 	}
 
-	// 添加 res_entry_list 中的项到 targetsMap
-	for _, entry := range config.ResEntryList {
-		targetsMap.Store(entry, mustParseURL(config.ResTargetURL))
-		targetsTypeMap.Store(entry, "res")
+	activateRuntime(rc)
+	if err := initMaintenance(config.Maintenance); err != nil {
+		log.Fatal().Msgf("unable to parse maintenance: %v", err)
 	}
+	go func() {
+		removeStaleTempFiles()
+		pruneDerivedCache()
+	}()
 
 	/*
 		初始化日志等可观测配件协程
 	*/
 	go logger(logChannel)
 
+	// 收到 SIGHUP 或配置文件变化时重新加载配置
+	go watchReloadSignal()
+	if config.ReloadInterval != "" {
+		interval, _ := time.ParseDuration(config.ReloadInterval)
+		go pollConfigFiles(interval)
+	}
+
 	/*
 		路由注册与处理逻辑
 	*/
 	http.HandleFunc("/proxy-svc/api/v1/refresh-cache", func(w http.ResponseWriter, r *http.Request) {
-		if !isDomainAllowedCallApi(r.Host, config) {
+		if !isDomainAllowedCallApi(r.Host, *currentConfig()) {
 			mainProxyHandler(w, r)
 			return
 		}
@@ -197,8 +326,12 @@ func main() {
 			Str("filePath", req.FilePath).
 			Msg("try to refresh cache")
 
-		// 拼接路径
-		targetPath := filepath.Join(cacheDir, req.Site+".site")
+		// 拼接路径，site 为上游名称
+		siteDir := filepath.Join(cacheDir, req.Site+".site")
+		if upstream, ok := currentUpstreams()[req.Site]; ok {
+			siteDir = filepath.Join(cacheDir, upstream.SiteDir())
+		}
+		targetPath := siteDir
 		if req.FilePath != "" {
 			targetPath = filepath.Join(targetPath, req.FilePath)
 		}
@@ -211,6 +344,11 @@ func main() {
 			deleteErr = os.Remove(targetPath)
 		}
 
+		// 同时删除由该文件派生出的 hack 结果
+		if deleteErr == nil || os.IsNotExist(deleteErr) {
+			deleteErr = removeDerivedCache(siteDir, req.FilePath)
+		}
+
 		// 处理删除错误
 		if deleteErr != nil {
 			http.Error(w, "Failed to delete cache: "+deleteErr.Error(), http.StatusInternalServerError)
@@ -221,67 +359,49 @@ func main() {
 		w.WriteHeader(http.StatusNoContent)
 	})
 
-	http.HandleFunc("/proxy-svc/api/healthz", func(w http.ResponseWriter, r *http.Request) {
-		// 这里可以检查应用的健康状态
-		w.WriteHeader(http.StatusOK)
-		_, err := w.Write([]byte("OK"))
-		if err != nil {
+	http.HandleFunc("/proxy-svc/api/v1/hack-preview", hackPreviewHandler)
+	http.HandleFunc("/proxy-svc/api/v1/hack-stats", hackStatsHandler)
+	http.HandleFunc("/proxy-svc/api/v1/maintenance", maintenanceHandler)
+	http.HandleFunc("/proxy-svc/api/v1/reload-config", reloadConfigHandler)
+
+	http.HandleFunc("/proxy-svc/api/v1/reload-hack-map", func(w http.ResponseWriter, r *http.Request) {
+		if !isDomainAllowedCallApi(r.Host, *currentConfig()) {
+			mainProxyHandler(w, r)
 			return
 		}
-	})
 
-	http.HandleFunc("/proxy-svc/api/readyz", func(w http.ResponseWriter, r *http.Request) {
-		// 这里可以检查应用是否准备好接受流量
-		w.WriteHeader(http.StatusOK)
-		_, err := w.Write([]byte("OK"))
-		if err != nil {
+		// 新的 hack-map 不合法时保留之前的配置，并返回错误详情
+		if err := reloadHackMap(); err != nil {
+			http.Error(w, "Failed to reload hack map:\n"+err.Error(), http.StatusBadRequest)
 			return
 		}
+		w.WriteHeader(http.StatusNoContent)
 	})
 
-	http.HandleFunc("/config.ini", serveFileHandler("overwrite/config.ini"))
-	http.HandleFunc("/breaking-news.html", serveFileHandler("overwrite/breaking-news.html"))
-	//servers.ini由作者保持最新
-	//http.HandleFunc("/servers.ini", serveFileHandler("overwrite/servers.ini"))
-	http.HandleFunc("/lib/local-trans.js", serveFileHandler("overwrite/local-trans.js"))
-	http.HandleFunc("/lib/nipplejs.js", serveFileHandler("overwrite/nipplejs.js"))
-	http.HandleFunc("/res/locale/zh-CN.json", serveFileHandler("overwrite/zh-CN.json"))
-	http.HandleFunc("/res/locale/zh-TW.json", serveFileHandler("overwrite/zh-CN.json"))
-	http.HandleFunc("/robots.txt", serveFileHandler("overwrite/robots.txt"))
-	http.HandleFunc("/res/mods.ini", serveFileHandler("overwrite/mods.ini"))
+	http.HandleFunc("/proxy-svc/api/healthz", healthzHandler)
 
-	http.HandleFunc("/", mainProxyHandler)
+	http.HandleFunc("/proxy-svc/api/readyz", readyzHandler)
 
-	wg := sync.WaitGroup{}
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		/*
-			服务启动
-		*/
-		log.Info().Msgf("Serving http on :%d", config.HTTP.Port)
-		err = http.ListenAndServe(":"+strconv.Itoa(config.HTTP.Port), nil)
-		if err != nil {
-			log.Fatal().Msgf("ListenAndServe: %s", err.Error())
-		}
-	}()
+	http.HandleFunc("/proxy-svc/api/v1/health", healthDetailHandler)
 
-	if config.HTTPS != nil {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			/*
-				服务启动
-			*/
-			log.Info().Msgf("Serving https on :%d", config.HTTPS.Port)
-			err = http.ListenAndServeTLS(":"+strconv.Itoa(config.HTTPS.Port), config.HTTPS.Cert, config.HTTPS.Key, nil)
-			if err != nil {
-				log.Fatal().Msgf("ListenAndServe: %s", err.Error())
-			}
-		}()
+	for _, overwrite := range overwriteRoutes {
+		filePath := filepath.Join(overwriteDir, overwrite.File)
+		if overwrite.Template {
+			http.HandleFunc(overwrite.Path, serveTemplateFileHandler(filePath))
+		} else {
+			http.HandleFunc(overwrite.Path, serveFileHandler(filePath))
+		}
 	}
 
-	wg.Wait()
+	http.HandleFunc("/", mainProxyHandler)
+
+	// 旧版本缓存目录中修改后的内容需要在开始服务前清理
+	migrateCacheLayout()
+
+	/*
+		服务启动，收到 SIGINT/SIGTERM 时平滑关闭，收到 SIGUSR2 时平滑重启
+	*/
+	os.Exit(runServers(&config))
 }
 
 func mainProxyHandler(w http.ResponseWriter, r *http.Request) {
@@ -289,7 +409,7 @@ func mainProxyHandler(w http.ResponseWriter, r *http.Request) {
 	isGetRequest := r.Method == http.MethodGet
 	isHtmlRequest := strings.Contains(r.Header.Get("Accept"), "text/html")
 	host := strings.Split(r.Host, ":")[0]
-	currentTargetURLValue, ok := targetsMap.Load(host)
+	match, ok := resolveRoute(host, r)
 	if !ok {
 		http.Error(w, "HTTP CODE 403. Forbidden By Tencent EdgeOne……", http.StatusForbidden)
 		return
@@ -297,22 +417,45 @@ func mainProxyHandler(w http.ResponseWriter, r *http.Request) {
 	// 设置CORS头
 	serveFileWithCORS(w, r)
 
-	targetURLType, ok := targetsTypeMap.Load(host)
-	if !ok {
-		http.Error(w, "HTTP CODE 403. Can't Find URL Type. Forbidden By Tencent Edge One……", http.StatusForbidden)
-		return
+	// 路由规则可能改写路径，缓存与 hack 均基于转发到上游的路径
+	if match.Path != r.URL.Path {
+		r.URL.Path = match.Path
+		r.URL.RawPath = ""
 	}
-	hostDir := targetURLType.(string) + ".site"
+	upstream := match.Upstream
+	hostDir := upstream.SiteDir()
 
 	// 代理缓存命中检查
-	cachePath := filepath.Join(cacheDir, hostDir, r.URL.Path)
+	// 缓存分为两层：原始层保存上游的原始内容，派生层保存按 hack 摘要区分的修改结果
+	relPath := cacheRelPath(r, isHtmlRequest)
+	rawPath := rawCachePath(hostDir, relPath)
+	// 模板变量需要在改写 r.Host 之前构建
+	vars := newTemplateVars(r)
+	// 摘要与派生层内容使用同一份配置与 hack-map，重新加载不会使两者混用
+	rc := activeRuntime()
+	digest, cacheable := hackDigest(rc, upstream.Name, relPath, host, vars.Scheme)
+	isHacked := digest != ""
+	// 结果依赖未在配置中登记的请求主机时不写入派生层，避免任意 Host 在磁盘上生成无限多份副本，
+	// 这类请求每次从原始层在内存中应用 hack
+	hackInMemory := isHacked && !cacheable
+	cachePath := rawPath
+	if isHacked && cacheable {
+		cachePath = derivedCachePath(hostDir, digest, relPath)
+	}
+	// 维护期间页面请求直接返回维护页面，开启 serve_cached 时其他请求仍可命中缓存
+	underMaintenance, maintenanceUntil := maintenanceFor(r, vars)
+	if underMaintenance && !maintenanceServesCached(r) {
+		applyHeaderRules(w.Header(), responseHeaderRules(match.Headers), vars)
+		writeMaintenance(w, r, maintenanceUntil, vars)
+		return
+	}
 	// 只有GET请求才考虑缓存相关
 	if isGetRequest {
-		if isHtmlRequest && r.URL.Path == "/" {
-			cachePath = filepath.Join(cacheDir, hostDir, "index.html")
-		}
-		if isHtmlRequest && filepath.Ext(r.URL.Path) == "" {
-			cachePath = filepath.Join(cacheDir, hostDir, r.URL.Path, "index.html")
+		// hack 变化后派生层未命中，如果原始层存在则直接在本地重新生成，无需访问上游
+		if isHacked && !hackInMemory && !fileExists(cachePath) && fileExists(rawPath) {
+			if err := rebuildDerivedCache(rc, upstream.Name, rawPath, cachePath, relPath, vars); err != nil {
+				log.Error().Err(err).Str("cache_path", cachePath).Msg("Error rebuilding derived cache")
+			}
 		}
 		if fileExists(cachePath) {
 
@@ -326,13 +469,17 @@ func mainProxyHandler(w http.ResponseWriter, r *http.Request) {
 			modTime := fileInfo.ModTime().UTC()
 			fileSize := fileInfo.Size()
 			etag := fmt.Sprintf(`"%x-%x"`, modTime.Unix(), fileSize)
+			if hackInMemory {
+				// 内容由原始层与 hack 共同决定，hack 变化时 ETag 也需要变化
+				etag = fmt.Sprintf(`"%x-%x-%s"`, modTime.Unix(), fileSize, digest[:12])
+			}
 
 			// 设置Last-Modified和ETag头
 			w.Header().Set("Last-Modified", modTime.Format(http.TimeFormat))
 			w.Header().Set("ETag", etag)
 
-			// 设置或覆盖Server头
-			w.Header().Set("Server", "ra2web-proxy")
+			// 按规则改写响应头
+			applyHeaderRules(w.Header(), responseHeaderRules(match.Headers), vars)
 
 			// 检查If-None-Match和If-Modified-Since头
 			ifNoneMatch := r.Header.Get("If-None-Match")
@@ -361,6 +508,14 @@ func mainProxyHandler(w http.ResponseWriter, r *http.Request) {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
+			if hackInMemory {
+				data, err = applyHacks(rc, upstream.Name, relPath, data, vars)
+				if err != nil {
+					log.Error().Err(err).Str("cache_path", cachePath).Msg("Error applying hacks")
+					http.Error(w, "Hack Error", http.StatusInternalServerError)
+					return
+				}
+			}
 
 			// 根据文件的扩展名设置Content-Type
 			ext := filepath.Ext(cachePath)
@@ -409,7 +564,7 @@ func mainProxyHandler(w http.ResponseWriter, r *http.Request) {
 			}
 
 			sendLog(LogMessage{
-				ClientIP:   r.RemoteAddr,
+				ClientIP:   vars.ClientIP,
 				RequestURL: r.URL.String(),
 				Method:     r.Method,
 				UserAgent:  r.UserAgent(),
@@ -422,24 +577,54 @@ func mainProxyHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	currentTargetURL := currentTargetURLValue.(*url.URL)
+	// 维护期间不访问上游
+	if underMaintenance {
+		applyHeaderRules(w.Header(), responseHeaderRules(match.Headers), vars)
+		writeMaintenance(w, r, maintenanceUntil, vars)
+		return
+	}
+
+	currentTargetURL := upstream.Target
+	rewriter := newHeaderRewriter(upstream, r.Host, vars)
+	if err := upstream.setUpstreamHeaders(r, vars); err != nil {
+		log.Error().Err(err).Msg("Error setting upstream headers")
+		http.Error(w, "Upstream Header Error", http.StatusInternalServerError)
+		return
+	}
 
 	r.URL.Scheme = currentTargetURL.Scheme
 	r.URL.Host = currentTargetURL.Host
-	r.Header.Set("X-Forwarded-Host", r.Header.Get("Host"))
+	applyHeaderRules(r.Header, requestHeaderRules(match.Headers), vars)
 	r.Host = currentTargetURL.Host
 
+	// 单个请求的总超时时间包括重试与读取响应体
+	if upstream.totalTimeout > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), upstream.totalTimeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+
 	// 创建反向代理
 	proxy := httputil.NewSingleHostReverseProxy(currentTargetURL)
+	proxy.Transport = upstream.Transport
+	proxy.ErrorHandler = func(rw http.ResponseWriter, req *http.Request, err error) {
+		log.Error().Err(err).Str("upstream", upstream.Name).Str("url", req.URL.String()).Msg("Upstream request failed")
+		// 熔断期间快速失败，并告知客户端何时重试
+		status := http.StatusBadGateway
+		switch {
+		case errors.Is(err, errCircuitOpen):
+			rw.Header().Set("Retry-After", strconv.Itoa(int(upstream.breaker.retryAfter().Seconds())))
+			status = http.StatusServiceUnavailable
+		case errors.Is(err, context.DeadlineExceeded):
+			status = http.StatusGatewayTimeout
+		}
+		writeErrorPage(rw, req, status, vars)
+	}
 	proxy.ModifyResponse = func(response *http.Response) error {
+		// 将上游的重定向地址与 Cookie 改写回当前入口主机
+		rewriter.rewriteHeaders(response.Header)
+
 		if isGetRequest {
-			// 如果请求的是根路径，则将缓存路径设置为index.html
-			if isHtmlRequest && r.URL.Path == "/" {
-				cachePath = filepath.Join(cacheDir, hostDir, "index.html")
-			}
-			if isHtmlRequest && filepath.Ext(r.URL.Path) == "" {
-				cachePath = filepath.Join(cacheDir, hostDir, r.URL.Path, "index.html")
-			}
 			// 只有2xx请求才考虑是否缓存，其他HTTP CODE不应该缓存处理
 			if response.StatusCode >= 200 && response.StatusCode < 300 {
 				// 判定是否应该缓存
@@ -474,52 +659,33 @@ func mainProxyHandler(w http.ResponseWriter, r *http.Request) {
 					if err != nil {
 						return err
 					}
-					// 这里插入内容是临时的，用于修改index.html，此时对于原始数据的解压已经完成
-					if r.URL.Path == "/" {
-						body, err = modifyIndexHTML(body)
+
+					// 原始层保存解压后的上游内容，便于之后离线重新应用 hack
+					if err := writeCacheFile(rawPath, body); err != nil {
+						return err
+					}
+
+					// 按 hack-map 修改文档，结果写入派生层
+					if isHacked {
+						body, err = applyHacks(rc, upstream.Name, relPath, body, vars)
 						if err != nil {
 							return err
 						}
-					}
-
-					if r.URL.Path == "/dist/workerHost.min.js" {
-						body = modifyWorkerHostJS(body)
+						if !hackInMemory {
+							if err := writeCacheFile(cachePath, body); err != nil {
+								return err
+							}
+						}
 					}
 
 					response.Body = io.NopCloser(bytes.NewReader(body))
 					response.Header.Set("Content-Length", strconv.Itoa(len(body))) // 更新Content-Length头
 					// 更新Content-Encoding头
 					response.Header.Del("Content-Encoding")
-
-					if err := writeCacheFile(cachePath, body); err != nil {
-						return err
-					}
-				}
-			} else {
-				if response.StatusCode == http.StatusNotFound {
-					filePath := "views/404page.html"
-
-					// 读取错误页面文件
-					content, err := os.ReadFile(filePath)
-					if err != nil {
-						log.Error().Err(err).Msg("Error reading 404 page")
-						// 返回基本404错误码
-						errorPage := []byte("Page 404")
-						response.Body = io.NopCloser(bytes.NewReader(errorPage))
-						response.Header.Set("Content-Length", strconv.Itoa(len(errorPage)))
-						response.Header.Set("Content-Type", "text/html")
-					}
-
-					response.Body = io.NopCloser(bytes.NewReader(content))
-					response.Header.Set("Content-Length", strconv.Itoa(len(content)))
-					response.Header.Set("Content-Type", "text/html")
-				} else {
-					// 返回其他模式下的错误页面
-					errorPage := []byte("Page Status Error")
-					response.Body = io.NopCloser(bytes.NewReader(errorPage))
-					response.Header.Set("Content-Length", strconv.Itoa(len(errorPage)))
-					response.Header.Set("Content-Type", "text/html")
 				}
+			} else if response.StatusCode >= 400 {
+				// 只替换错误响应的内容，重定向、304 等响应原样返回
+				replaceErrorBody(response, vars)
 			}
 		}
 		return nil
@@ -529,11 +695,8 @@ func mainProxyHandler(w http.ResponseWriter, r *http.Request) {
 	responseRecorder := httptest.NewRecorder()
 	proxy.ServeHTTP(responseRecorder, r)
 
-	// 删除X-Frame-Options头以允许有站点
-	responseRecorder.Header().Del("X-Frame-Options")
-
-	// 设置或覆盖Server头
-	responseRecorder.Header().Set("Server", "ra2web-proxy")
+	// 按规则改写响应头
+	applyHeaderRules(responseRecorder.Header(), responseHeaderRules(match.Headers), vars)
 
 	origin := r.Header.Get("Origin")
 	if origin == "" {
@@ -543,24 +706,22 @@ func mainProxyHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// 只有2xx请求才考虑是否缓存，其他HTTP CODE不应该缓存处理
-	if responseRecorder.Code >= 200 && responseRecorder.Code < 300 {
-		// 只有正常情况，才将代理的响应写回到原始的响应写入器
-		for k, vv := range responseRecorder.Header() {
-			for _, v := range vv {
-				w.Header().Set(k, v)
-			}
-		}
+	// 任何状态码都透传全部响应头，304 的 ETag、重定向的 Location、429 的 Retry-After 都需要保留。
+	// 同名头部可能有多个值（例如 Set-Cookie、Vary），需要整体复制
+	for k, vv := range responseRecorder.Header() {
+		w.Header()[k] = append([]string(nil), vv...)
 	}
 
 	w.WriteHeader(responseRecorder.Code)
-	_, err := w.Write(responseRecorder.Body.Bytes())
-	if err != nil {
-		return
+	if responseHasBody(r.Method, responseRecorder.Code) {
+		_, err := w.Write(responseRecorder.Body.Bytes())
+		if err != nil {
+			return
+		}
 	}
 
 	sendLog(LogMessage{
-		ClientIP:    r.RemoteAddr,
+		ClientIP:    vars.ClientIP,
 		RequestURL:  r.URL.String(),
 		Method:      r.Method,
 		UserAgent:   r.UserAgent(),
@@ -572,16 +733,13 @@ func mainProxyHandler(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-func mustParseURL(rawURL string) *url.URL {
-	parsedUrl, err := url.Parse(rawURL)
-	if err != nil {
-		log.Fatal().Msgf("Failed to parse URL %q: %v", rawURL, err)
-	}
-	return parsedUrl
-}
-
 func logger(logChannel chan LogMessage) {
 	for msg := range logChannel {
+		if msg.flushed != nil {
+			close(msg.flushed)
+			continue
+		}
+
 		event := log.Info()
 		if msg.Error != nil {
 			event = log.Error().Err(msg.Error)
@@ -614,6 +772,32 @@ func fileExists(path string) bool {
 	return !os.IsNotExist(err)
 }
 
+// cacheRelPath 计算请求在站点缓存目录下的相对路径，无扩展名的HTML请求对应目录下的index.html
+func cacheRelPath(r *http.Request, isHtmlRequest bool) string {
+	if isHtmlRequest && filepath.Ext(r.URL.Path) == "" {
+		return path.Join(r.URL.Path, "index.html")
+	}
+	return r.URL.Path
+}
+
+// rawCachePath 计算原始层缓存路径，保存上游返回的原始内容
+func rawCachePath(hostDir string, relPath string) string {
+	return filepath.Join(cacheDir, hostDir, relPath)
+}
+
+// derivedCachePath 计算派生层缓存路径，依赖请求主机与协议的结果已经按摘要区分
+func derivedCachePath(hostDir string, digest string, relPath string) string {
+	return filepath.Join(cacheDir, hostDir, derivedCacheDir, digest, relPath)
+}
+
+// responseHasBody 判断响应是否允许携带响应体，HEAD 请求以及 1xx、204、304 响应没有响应体
+func responseHasBody(method string, statusCode int) bool {
+	if method == http.MethodHead {
+		return false
+	}
+	return statusCode >= 200 && statusCode != http.StatusNoContent && statusCode != http.StatusNotModified
+}
+
 func shouldCache(response *http.Response) bool {
 	// 根据文件类型判定
 	contentType := response.Header.Get("Content-Type")
@@ -641,7 +825,7 @@ func serveFileWithCORS(w http.ResponseWriter, r *http.Request) {
 			origin = getOriginFromReferer(referer)
 		}
 	}
-	if _, ok := allowedOrigins.Load(origin); ok {
+	if isAllowedOrigin(origin) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 	}
 	w.Header().Set("Access-Control-Allow-Methods", "*")
@@ -674,20 +858,18 @@ func serveFileHandler(filePath string) http.HandlerFunc {
 			}
 		}
 
-		w.Header().Del("X-Frame-Options")
-
 		// 跨域逻辑处理
 		w.Header().Del("Access-Control-Allow-Origin")
 		w.Header().Del("Access-Control-Allow-Methods")
 		w.Header().Del("Access-Control-Allow-Headers")
-		if _, ok := allowedOrigins.Load(origin); ok {
+		if isAllowedOrigin(origin) {
 			w.Header().Set("Access-Control-Allow-Origin", "*")
 		}
 		w.Header().Set("Access-Control-Allow-Methods", "*")
 		w.Header().Set("Access-Control-Allow-Headers", "*")
 
-		// 设置或覆盖Server头
-		w.Header().Set("Server", "ra2web-proxy")
+		// 按规则改写响应头
+		applyHeaderRules(w.Header(), responseHeaderRules(nil), newTemplateVars(r))
 
 		// 设置Last-Modified和ETag头
 		fileInfo, err := os.Stat(filePath)
@@ -725,6 +907,53 @@ func serveFileHandler(filePath string) http.HandlerFunc {
 	}
 }
 
+// serveTemplateFileHandler 与 serveFileHandler 类似，但会先将文件内容作为模板渲染，
+// 用于 config.ini 这类需要随请求主机变化的覆盖文件
+func serveTemplateFileHandler(filePath string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// 跨域逻辑处理
+		serveFileWithCORS(w, r)
+
+		// 按规则改写响应头
+		vars := newTemplateVars(r)
+		applyHeaderRules(w.Header(), responseHeaderRules(nil), vars)
+
+		fileInfo, err := os.Stat(filePath)
+		if err != nil || fileInfo.IsDir() {
+			http.NotFound(w, r)
+			return
+		}
+
+		data, err := os.ReadFile(filePath)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		content, err := renderTemplate(string(data), vars)
+		if err != nil {
+			log.Error().Err(err).Str("file", filePath).Msg("Error rendering template file")
+			http.Error(w, "Template Render Error", http.StatusInternalServerError)
+			return
+		}
+
+		// 覆盖文件中仍然引用上游的绝对地址同样需要改写
+		if rules := urlRewriteRules(filePath, vars.Host); len(rules) > 0 {
+			rewritten, _, err := rewriteURLs([]byte(content), rules, vars)
+			if err != nil {
+				log.Error().Err(err).Str("file", filePath).Msg("Error rewriting urls")
+				http.Error(w, "Template Render Error", http.StatusInternalServerError)
+				return
+			}
+			content = string(rewritten)
+		}
+
+		// 渲染结果随请求变化，ETag 基于渲染后的内容计算
+		w.Header().Set("ETag", fmt.Sprintf(`"%x"`, sha256.Sum256([]byte(content))))
+		http.ServeContent(w, r, filePath, fileInfo.ModTime(), strings.NewReader(content))
+	}
+}
+
 func isDomainAllowedCallApi(host string, c Config) bool {
 	for _, allowedHost := range c.ApiEndpoint {
 		if host == allowedHost {
@@ -796,40 +1025,6 @@ func writeCacheFile(cachePath string, body []byte) error {
 	return err
 }
 
-// 添加辅助函数来处理 index.html 的修改
-func modifyIndexHTML(body []byte) ([]byte, error) {
-	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(body))
-	if err != nil {
-		return nil, err
-	}
-
-	// 从配置中读取 base_href
-	if config.BaseHref != "" {
-		doc.Find("head").PrependHtml(fmt.Sprintf(`<base href="%s" />`, config.BaseHref))
-	}
-
-	doc.Find("head title").SetText("网页红井-联机对战平台")
-	doc.Find(`meta[name="description"]`).Remove()
-	doc.Find("head title").AfterHtml(`<script type="text/javascript" src="lib/nipplejs.js"></script><script type="text/javascript" src="lib/local-trans.js"></script>`)
-	doc.Find(`script[src="https://www.googletagmanager.com/gtag/js?id=G-NT498QGSGZ"]`).Remove()
-	doc.Find("head title").AfterHtml(`<meta name="description" content="在网页上就能玩经典的红色井界游戏，无需下载安装，随时随地在手机、电脑、平板甚至手表上畅玩。提供多种游戏模式和地图，与全球玩家实时对战。">`)
-	doc.Find("head title").AfterHtml(`<meta name="keywords" content="红色警戒下载, 如何玩红警, webra2, 苹果如何玩红警, 平板上如何玩红警, 手机上如何玩红警, win7如何玩红警, win10如何玩红警, win11如何玩红警, 红警, 红警2, 红色警戒2, 网页红警, 云红警, 在线游戏, 游戏平台，对战平台，战网, 红色警戒3, 红警3, RA2, RA2WEB">`)
-
-	html, err := doc.Html()
-	if err != nil {
-		return nil, err
-	}
-	return []byte(html), nil
-}
-
-// 添加辅助函数来处理 workerHost.min.js 的修改
-func modifyWorkerHostJS(body []byte) []byte {
-	bodyStr := string(body)
-	bodyStr = strings.Replace(bodyStr, `(null===(r=null==t?void 0:t.CORSWorkaround)||void 0===r||r)`, `true`, 1)
-	bodyStr = strings.Replace(bodyStr, `"string"==typeof e&&o(e)&&(null===(i=null==t?void 0:t.CORSWorkaround)||void 0===i||i)`, `true`, 1)
-	return []byte(bodyStr)
-}
-
 // 添加辅助函数来发送日志
 func sendLog(msg LogMessage) {
 	select {
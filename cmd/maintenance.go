@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ConfigMaintenance 定义维护模式配置
+type ConfigMaintenance struct {
+	Enabled      bool                `json:"enabled"`       // 启动后立即进入维护模式
+	Windows      []MaintenanceWindow `json:"windows"`       // 计划维护时间段，到达开始时间自动进入维护模式
+	RetryAfter   string              `json:"retry_after"`   // 无法确定结束时间时返回的 Retry-After，默认为 5m
+	Page         string              `json:"page"`          // 维护页面模板，默认为 views 目录下的 maintenance.html
+	ServeCached  bool                `json:"serve_cached"`  // 维护期间是否继续返回已缓存的资源，页面请求始终返回维护页面
+	AllowIPs     []string            `json:"allow_ips"`     // 可以绕过维护模式的 IP 或网段，例如 10.0.0.0/8
+	BypassCookie string              `json:"bypass_cookie"` // 绕过维护模式的 Cookie 名称，默认为 ra2web_maintenance_bypass
+	BypassToken  string              `json:"bypass_token"`  // 绕过维护模式的 Cookie 值，为空时不允许通过 Cookie 绕过
+}
+
+// MaintenanceWindow 定义一个维护时间段，时间使用 RFC 3339 格式，例如 2024-01-01T02:00:00+08:00
+type MaintenanceWindow struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// MaintenanceStatus 定义维护模式接口的请求与输出格式
+type MaintenanceStatus struct {
+	Active  bool                `json:"active"`            // 当前是否处于维护模式，仅用于输出
+	Enabled *bool               `json:"enabled,omitempty"` // 手动开关
+	Until   *time.Time          `json:"until,omitempty"`   // 手动开启的自动结束时间
+	Windows []MaintenanceWindow `json:"windows,omitempty"` // 计划维护时间段，请求中提供时整体替换
+}
+
+// MaintenancePageVars 定义维护页面模板可用的变量
+type MaintenancePageVars struct {
+	ErrorPageVars
+	Until      *time.Time // 预计结束时间，无法确定时为空
+	RetryAfter int        // 建议客户端重试的秒数
+}
+
+const (
+	defaultMaintenanceRetryAfter = 5 * time.Minute
+	defaultBypassCookie          = "ra2web_maintenance_bypass"
+)
+
+// maintenanceState 维护模式的运行时状态。通过管理接口修改的开关与计划维护时间段在重新加载配置时保留，
+// 重启后恢复为配置文件中的设置
+type maintenanceState struct {
+	mu         sync.RWMutex
+	enabled    bool
+	until      time.Time
+	windows    []MaintenanceWindow
+	allowNets  []*net.IPNet
+	retryAfter time.Duration
+
+	enabledSet bool // 开关与结束时间已经通过接口修改
+	windowsSet bool // 计划维护时间段已经通过接口修改
+}
+
+var maintenance maintenanceState
+
+// initMaintenance 根据配置初始化维护模式，运行时通过接口做出的修改会被覆盖
+func initMaintenance(c *ConfigMaintenance) error {
+	allowNets, retryAfter, err := parseMaintenance(c)
+	if err != nil {
+		return err
+	}
+
+	maintenance.mu.Lock()
+	defer maintenance.mu.Unlock()
+	maintenance.enabled = false
+	maintenance.until = time.Time{}
+	maintenance.windows = nil
+	maintenance.allowNets = allowNets
+	maintenance.retryAfter = retryAfter
+	maintenance.enabledSet = false
+	maintenance.windowsSet = false
+	if c != nil {
+		maintenance.enabled = c.Enabled
+		maintenance.windows = c.Windows
+	}
+	return nil
+}
+
+// reloadMaintenance 重新加载配置时应用配置文件中的全部设置，
+// 只有通过接口修改过的开关与计划维护时间段保留运行时的状态，避免通过接口开启的维护模式被重新加载关闭
+func reloadMaintenance(c *ConfigMaintenance) error {
+	allowNets, retryAfter, err := parseMaintenance(c)
+	if err != nil {
+		return err
+	}
+
+	maintenance.mu.Lock()
+	defer maintenance.mu.Unlock()
+	maintenance.allowNets = allowNets
+	maintenance.retryAfter = retryAfter
+	if !maintenance.enabledSet {
+		maintenance.enabled = c != nil && c.Enabled
+		maintenance.until = time.Time{}
+	}
+	if !maintenance.windowsSet {
+		maintenance.windows = nil
+		if c != nil {
+			maintenance.windows = c.Windows
+		}
+	}
+	return nil
+}
+
+// parseMaintenance 校验维护模式配置，返回允许绕过的网段与默认的 Retry-After
+func parseMaintenance(c *ConfigMaintenance) ([]*net.IPNet, time.Duration, error) {
+	if c == nil {
+		return nil, defaultMaintenanceRetryAfter, nil
+	}
+
+	retryAfter, err := parseDuration("maintenance.retry_after", c.RetryAfter, defaultMaintenanceRetryAfter)
+	if err != nil {
+		return nil, 0, err
+	}
+	for i, window := range c.Windows {
+		if !window.End.After(window.Start) {
+			return nil, 0, fmt.Errorf("maintenance.windows[%d]: end must be after start", i)
+		}
+	}
+	var allowNets []*net.IPNet
+	for _, allow := range c.AllowIPs {
+		ipNet, err := parseIPNet(allow)
+		if err != nil {
+			return nil, 0, fmt.Errorf("maintenance.allow_ips: %w", err)
+		}
+		allowNets = append(allowNets, ipNet)
+	}
+	return allowNets, retryAfter, nil
+}
+
+// parseIPNet 解析 IP 或网段，单个 IP 视为只包含自身的网段
+func parseIPNet(value string) (*net.IPNet, error) {
+	if _, ipNet, err := net.ParseCIDR(value); err == nil {
+		return ipNet, nil
+	}
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid ip or cidr %q", value)
+	}
+	bits := 8 * net.IPv4len
+	if ip.To4() == nil {
+		bits = 8 * net.IPv6len
+	} else {
+		ip = ip.To4()
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// activeUntil 判断指定时间是否处于维护模式，并返回预计结束时间，无法确定时返回零值
+func (m *maintenanceState) activeUntil(now time.Time) (bool, time.Time) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.enabled && (m.until.IsZero() || now.Before(m.until)) {
+		return true, m.until
+	}
+	for _, window := range m.windows {
+		if !now.Before(window.Start) && now.Before(window.End) {
+			return true, window.End
+		}
+	}
+	return false, time.Time{}
+}
+
+// bypass 判断请求是否可以绕过维护模式
+func (m *maintenanceState) bypass(r *http.Request, clientIP string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if ip := net.ParseIP(clientIP); ip != nil {
+		for _, ipNet := range m.allowNets {
+			if ipNet.Contains(ip) {
+				return true
+			}
+		}
+	}
+
+	settings := currentConfig().Maintenance
+	if settings == nil || settings.BypassToken == "" {
+		return false
+	}
+	name := settings.BypassCookie
+	if name == "" {
+		name = defaultBypassCookie
+	}
+	cookie, err := r.Cookie(name)
+	return err == nil && cookie.Value == settings.BypassToken
+}
+
+// maintenanceFor 判断请求是否需要返回维护响应
+func maintenanceFor(r *http.Request, vars TemplateVars) (bool, time.Time) {
+	active, until := maintenance.activeUntil(time.Now())
+	if !active || maintenance.bypass(r, vars.ClientIP) {
+		return false, time.Time{}
+	}
+	return true, until
+}
+
+// maintenanceServesCached 判断维护期间是否继续返回已缓存的资源
+func maintenanceServesCached(r *http.Request) bool {
+	settings := currentConfig().Maintenance
+	return settings != nil && settings.ServeCached && errorPageKind(r) != HTMLErrorPage
+}
+
+// writeMaintenance 返回维护响应：页面请求返回维护页面，其他请求按错误页面表返回 503
+func writeMaintenance(w http.ResponseWriter, r *http.Request, until time.Time, vars TemplateVars) {
+	retryAfter := maintenance.retryAfter
+	var untilPtr *time.Time
+	if !until.IsZero() {
+		retryAfter = time.Until(until)
+		untilPtr = &until
+	}
+	seconds := int(retryAfter.Seconds())
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	w.Header().Set("Cache-Control", "no-store")
+
+	if errorPageKind(r) != HTMLErrorPage {
+		writeErrorPage(w, r, http.StatusServiceUnavailable, vars)
+		return
+	}
+
+	page := viewFile("maintenance.html")
+	if settings := currentConfig().Maintenance; settings != nil && settings.Page != "" {
+		page = settings.Page
+	}
+	pageVars := MaintenancePageVars{
+		ErrorPageVars: ErrorPageVars{
+			TemplateVars: vars,
+			Status:       http.StatusServiceUnavailable,
+			StatusText:   http.StatusText(http.StatusServiceUnavailable),
+		},
+		Until:      untilPtr,
+		RetryAfter: seconds,
+	}
+	content, err := renderPageFile(page, "text/html", pageVars)
+	if err != nil {
+		log.Error().Err(err).Str("file", page).Msg("Error rendering maintenance page")
+		writeErrorPage(w, r, http.StatusServiceUnavailable, vars)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+	w.WriteHeader(http.StatusServiceUnavailable)
+	_, _ = w.Write(content)
+}
+
+// status 返回维护模式的当前状态
+func (m *maintenanceState) status() MaintenanceStatus {
+	active, _ := m.activeUntil(time.Now())
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	enabled := m.enabled
+	status := MaintenanceStatus{Active: active, Enabled: &enabled, Windows: m.windows}
+	if !m.until.IsZero() {
+		until := m.until
+		status.Until = &until
+	}
+	return status
+}
+
+// maintenanceHandler 查询或修改维护模式。
+// GET 返回当前状态；POST 修改状态，例如 {"enabled": true, "until": "2024-01-01T03:00:00+08:00"}，
+// 提供 windows 时整体替换计划维护时间段
+func maintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	if !isDomainAllowedCallApi(r.Host, *currentConfig()) {
+		mainProxyHandler(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req MaintenanceStatus
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		for i, window := range req.Windows {
+			if !window.End.After(window.Start) {
+				http.Error(w, fmt.Sprintf("windows[%d]: end must be after start", i), http.StatusBadRequest)
+				return
+			}
+		}
+
+		maintenance.mu.Lock()
+		if req.Enabled != nil {
+			maintenance.enabled = *req.Enabled
+			maintenance.until = time.Time{}
+			maintenance.enabledSet = true
+		}
+		if req.Until != nil {
+			maintenance.until = *req.Until
+			maintenance.enabledSet = true
+		}
+		if req.Windows != nil {
+			maintenance.windows = req.Windows
+			maintenance.windowsSet = true
+		}
+		maintenance.mu.Unlock()
+		log.Info().Interface("maintenance", req).Msg("Maintenance mode updated")
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(maintenance.status()); err != nil {
+		log.Error().Err(err).Msg("Error writing maintenance response")
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReloadMaintenance(t *testing.T) {
+	start := time.Date(2024, 1, 1, 2, 0, 0, 0, time.UTC)
+	window := MaintenanceWindow{Start: start, End: start.Add(time.Hour)}
+
+	tests := []struct {
+		name        string
+		initial     *ConfigMaintenance
+		api         string // 重新加载前调用维护模式接口的请求体，为空时不调用
+		reload      *ConfigMaintenance
+		wantEnabled bool
+		wantWindows int
+	}{
+		{
+			name:        "enable from config",
+			reload:      &ConfigMaintenance{Enabled: true},
+			wantEnabled: true,
+		},
+		{
+			name:    "disable from config",
+			initial: &ConfigMaintenance{Enabled: true, Windows: []MaintenanceWindow{window}},
+			reload:  &ConfigMaintenance{},
+		},
+		{
+			name:        "windows from config",
+			reload:      &ConfigMaintenance{Windows: []MaintenanceWindow{window}},
+			wantWindows: 1,
+		},
+		{
+			name:    "section removed",
+			initial: &ConfigMaintenance{Enabled: true, Windows: []MaintenanceWindow{window}},
+		},
+		{
+			name:        "api switch is sticky",
+			api:         `{"enabled": true}`,
+			reload:      &ConfigMaintenance{Windows: []MaintenanceWindow{window}},
+			wantEnabled: true,
+			wantWindows: 1,
+		},
+		{
+			name:        "api windows are sticky",
+			initial:     &ConfigMaintenance{Windows: []MaintenanceWindow{window}},
+			api:         `{"windows": []}`,
+			reload:      &ConfigMaintenance{Enabled: true, Windows: []MaintenanceWindow{window}},
+			wantEnabled: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestProxy(t, nil, Config{ApiEndpoint: []string{"admin.example.com"}}, nil)
+			if err := initMaintenance(tt.initial); err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { _ = initMaintenance(nil) })
+
+			if tt.api != "" {
+				r := httptest.NewRequest("POST", "http://admin.example.com/proxy-svc/api/v1/maintenance", strings.NewReader(tt.api))
+				w := httptest.NewRecorder()
+				maintenanceHandler(w, r)
+				if w.Code != 200 {
+					t.Fatalf("maintenance api status = %d: %s", w.Code, w.Body)
+				}
+			}
+			if err := reloadMaintenance(tt.reload); err != nil {
+				t.Fatal(err)
+			}
+
+			status := maintenance.status()
+			if *status.Enabled != tt.wantEnabled {
+				t.Errorf("enabled = %v, want %v", *status.Enabled, tt.wantEnabled)
+			}
+			if len(status.Windows) != tt.wantWindows {
+				t.Errorf("windows = %v, want %d", status.Windows, tt.wantWindows)
+			}
+		})
+	}
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ConfigOrigin 定义上游的单个源站
+type ConfigOrigin struct {
+	URL      string `json:"url"`      // 源站地址，各源站的路径结构需要一致
+	Priority int    `json:"priority"` // 优先级，数值越小越优先，同一优先级的源站全部不可用时才使用下一优先级
+	Weight   int    `json:"weight"`   // 同一优先级内的权重，默认为 1
+}
+
+// ConfigHealthCheck 定义源站的主动健康检查
+type ConfigHealthCheck struct {
+	Path               string `json:"path"`                // 检查路径，默认为 /
+	Interval           string `json:"interval"`            // 检查间隔，默认为 10s
+	Timeout            string `json:"timeout"`             // 单次检查超时时间，默认为 5s
+	UnhealthyThreshold int    `json:"unhealthy_threshold"` // 连续失败多少次后标记为不健康，默认为 3
+	HealthyThreshold   int    `json:"healthy_threshold"`   // 连续成功多少次后恢复为健康，默认为 2
+}
+
+const (
+	defaultMaxFails           = 3
+	defaultEjectDuration      = 30 * time.Second
+	defaultCheckInterval      = 10 * time.Second
+	defaultCheckTimeout       = 5 * time.Second
+	defaultUnhealthyThreshold = 3
+	defaultHealthyThreshold   = 2
+)
+
+// Origin 定义源站及其健康状态
+type Origin struct {
+	URL      *url.URL
+	Priority int
+	Weight   int
+
+	mu             sync.Mutex
+	unhealthy      bool      // 主动健康检查的结果
+	checkFails     int       // 主动检查连续失败次数
+	checkSuccesses int       // 主动检查连续成功次数
+	fails          int       // 代理请求连续失败次数
+	ejectedUntil   time.Time // 被动摘除的截止时间
+	lastError      string
+	lastCheck      time.Time
+}
+
+// OriginStatus 定义源站健康状态的输出格式
+type OriginStatus struct {
+	URL          string     `json:"url"`
+	Priority     int        `json:"priority"`
+	Weight       int        `json:"weight"`
+	Healthy      bool       `json:"healthy"`                // 主动健康检查是否通过
+	Ejected      bool       `json:"ejected"`                // 是否因请求失败被暂时摘除
+	Available    bool       `json:"available"`              // 是否参与转发
+	EjectedUntil *time.Time `json:"ejectedUntil,omitempty"` // 被动摘除的截止时间
+	LastError    string     `json:"lastError,omitempty"`
+	LastCheck    *time.Time `json:"lastCheck,omitempty"` // 最近一次主动健康检查的时间
+}
+
+// healthCheck 解析后的主动健康检查配置
+type healthCheck struct {
+	path               string
+	interval           time.Duration
+	timeout            time.Duration
+	unhealthyThreshold int
+	healthyThreshold   int
+}
+
+// parseOrigins 解析上游的源站列表，未配置 origins 时使用 target_url 作为唯一源站
+func parseOrigins(name string, configUpstream ConfigUpstream) ([]*Origin, error) {
+	configOrigins := configUpstream.Origins
+	if len(configOrigins) == 0 {
+		configOrigins = []ConfigOrigin{{URL: configUpstream.TargetURL}}
+	}
+
+	origins := make([]*Origin, 0, len(configOrigins))
+	for i, configOrigin := range configOrigins {
+		target, err := url.Parse(configOrigin.URL)
+		if err != nil || target.Scheme == "" || target.Host == "" {
+			return nil, fmt.Errorf("upstreams.%s.origins[%d]: invalid url %q", name, i, configOrigin.URL)
+		}
+		if configOrigin.Weight < 0 {
+			return nil, fmt.Errorf("upstreams.%s.origins[%d]: weight must not be negative", name, i)
+		}
+		weight := configOrigin.Weight
+		if weight == 0 {
+			weight = 1
+		}
+		origins = append(origins, &Origin{URL: target, Priority: configOrigin.Priority, Weight: weight})
+	}
+	return origins, nil
+}
+
+// parseHealthCheck 解析主动健康检查配置，未配置时返回 nil
+func parseHealthCheck(name string, config *ConfigHealthCheck) (*healthCheck, error) {
+	if config == nil {
+		return nil, nil
+	}
+	check := &healthCheck{
+		path:               config.Path,
+		interval:           defaultCheckInterval,
+		timeout:            defaultCheckTimeout,
+		unhealthyThreshold: config.UnhealthyThreshold,
+		healthyThreshold:   config.HealthyThreshold,
+	}
+	if check.path == "" {
+		check.path = "/"
+	}
+	if config.Interval != "" {
+		interval, err := time.ParseDuration(config.Interval)
+		if err != nil || interval <= 0 {
+			return nil, fmt.Errorf("upstreams.%s.health_check: invalid interval %q", name, config.Interval)
+		}
+		check.interval = interval
+	}
+	if config.Timeout != "" {
+		timeout, err := time.ParseDuration(config.Timeout)
+		if err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("upstreams.%s.health_check: invalid timeout %q", name, config.Timeout)
+		}
+		check.timeout = timeout
+	}
+	if check.unhealthyThreshold <= 0 {
+		check.unhealthyThreshold = defaultUnhealthyThreshold
+	}
+	if check.healthyThreshold <= 0 {
+		check.healthyThreshold = defaultHealthyThreshold
+	}
+	return check, nil
+}
+
+// available 判断源站是否参与转发
+func (o *Origin) available(now time.Time) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return !o.unhealthy && !now.Before(o.ejectedUntil)
+}
+
+// markSuccess 记录一次成功的代理请求
+func (o *Origin) markSuccess() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.fails = 0
+}
+
+// markFailure 记录一次失败的代理请求，连续失败达到 maxFails 次时暂时摘除
+func (o *Origin) markFailure(err error, maxFails int, ejectDuration time.Duration) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.fails++
+	o.lastError = err.Error()
+	if o.fails >= maxFails {
+		o.fails = 0
+		o.ejectedUntil = time.Now().Add(ejectDuration)
+		log.Warn().Err(err).Str("origin", o.URL.String()).Dur("eject_duration", ejectDuration).Msg("Origin ejected")
+	}
+}
+
+// recordCheck 记录一次主动健康检查的结果
+func (o *Origin) recordCheck(err error, check *healthCheck) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.lastCheck = time.Now()
+	if err != nil {
+		o.lastError = err.Error()
+		o.checkSuccesses = 0
+		o.checkFails++
+		if !o.unhealthy && o.checkFails >= check.unhealthyThreshold {
+			o.unhealthy = true
+			log.Warn().Err(err).Str("origin", o.URL.String()).Msg("Origin marked unhealthy")
+		}
+		return
+	}
+	o.checkFails = 0
+	o.checkSuccesses++
+	if o.unhealthy && o.checkSuccesses >= check.healthyThreshold {
+		o.unhealthy = false
+		o.ejectedUntil = time.Time{}
+		log.Info().Str("origin", o.URL.String()).Msg("Origin marked healthy")
+	}
+}
+
+// Status 返回源站当前的健康状态
+func (o *Origin) Status() OriginStatus {
+	now := time.Now()
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	status := OriginStatus{
+		URL:       o.URL.String(),
+		Priority:  o.Priority,
+		Weight:    o.Weight,
+		Healthy:   !o.unhealthy,
+		Ejected:   now.Before(o.ejectedUntil),
+		LastError: o.lastError,
+	}
+	status.Available = status.Healthy && !status.Ejected
+	if status.Ejected {
+		ejectedUntil := o.ejectedUntil
+		status.EjectedUntil = &ejectedUntil
+	}
+	if !o.lastCheck.IsZero() {
+		lastCheck := o.lastCheck
+		status.LastCheck = &lastCheck
+	}
+	return status
+}
+
+// pickOrigins 返回本次请求依次尝试的源站：按优先级从高到低，同一优先级内按权重随机排序。
+// 全部源站都不可用时仍然按优先级返回全部源站，避免因误判导致完全无法访问
+func (u *Upstream) pickOrigins() []*Origin {
+	now := time.Now()
+	candidates := make([]*Origin, 0, len(u.Origins))
+	for _, origin := range u.Origins {
+		if origin.available(now) {
+			candidates = append(candidates, origin)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = append(candidates, u.Origins...)
+	}
+
+	// 同一优先级内按权重依次抽取
+	weighted := make([]*Origin, 0, len(candidates))
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Priority < candidates[j].Priority
+	})
+	for start := 0; start < len(candidates); {
+		end := start
+		for end < len(candidates) && candidates[end].Priority == candidates[start].Priority {
+			end++
+		}
+		group := append([]*Origin(nil), candidates[start:end]...)
+		for len(group) > 0 {
+			total := 0
+			for _, origin := range group {
+				total += origin.Weight
+			}
+			n := rand.Intn(total)
+			for i, origin := range group {
+				if n < origin.Weight {
+					weighted = append(weighted, origin)
+					group = append(group[:i], group[i+1:]...)
+					break
+				}
+				n -= origin.Weight
+			}
+		}
+		start = end
+	}
+	return weighted
+}
+
+// OriginStatuses 返回上游全部源站的健康状态
+func (u *Upstream) OriginStatuses() []OriginStatus {
+	statuses := make([]OriginStatus, 0, len(u.Origins))
+	for _, origin := range u.Origins {
+		statuses = append(statuses, origin.Status())
+	}
+	return statuses
+}
+
+// startHealthChecks 为配置了主动健康检查的上游启动检查协程
+func (u *Upstream) startHealthChecks() {
+	if u.healthCheck == nil {
+		return
+	}
+	u.stopChecks = make(chan struct{})
+	for _, origin := range u.Origins {
+		go u.runHealthCheck(origin, u.stopChecks)
+	}
+}
+
+// stopHealthChecks 停止上游的检查协程，配置重新加载后旧的上游不再检查
+func (u *Upstream) stopHealthChecks() {
+	if u.stopChecks != nil {
+		close(u.stopChecks)
+		u.stopChecks = nil
+	}
+}
+
+// runHealthCheck 按间隔检查单个源站，2xx 与 3xx 视为健康
+func (u *Upstream) runHealthCheck(origin *Origin, stop <-chan struct{}) {
+	client := &http.Client{
+		Transport: u.baseTransport,
+		Timeout:   u.healthCheck.timeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	checkURL := origin.URL.ResolveReference(&url.URL{Path: u.healthCheck.path}).String()
+
+	ticker := time.NewTicker(u.healthCheck.interval)
+	defer ticker.Stop()
+	for {
+		response, err := u.checkOrigin(client, checkURL)
+		if err == nil {
+			_, _ = io.Copy(io.Discard, response.Body)
+			response.Body.Close()
+			if response.StatusCode >= 400 {
+				err = fmt.Errorf("health check returned %s", response.Status)
+			}
+		}
+		origin.recordCheck(err, u.healthCheck)
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// checkOrigin 发送一次健康检查请求，Host 头与代理请求保持一致
+func (u *Upstream) checkOrigin(client *http.Client, checkURL string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, checkURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if u.HostHeader != "" {
+		req.Host = u.HostHeader
+	}
+	return client.Do(req)
+}
+
+// failoverTransport 依次尝试上游的各个源站，连接失败或返回 502/503/504 时透明地切换到下一个源站
+type failoverTransport struct {
+	upstream *Upstream
+}
+
+func (t *failoverTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	origins := t.upstream.pickOrigins()
+	// 请求体无法重放时只尝试一次
+	replayable := req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+
+	var lastErr error
+	for i, origin := range origins {
+		attempt := req.Clone(req.Context())
+		if i > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			attempt.Body = body
+		}
+		attempt.URL.Scheme = origin.URL.Scheme
+		attempt.URL.Host = origin.URL.Host
+		attempt.Host = origin.URL.Host
+		if t.upstream.HostHeader != "" {
+			attempt.Host = t.upstream.HostHeader
+		}
+
+		isLast := i == len(origins)-1 || !replayable
+		response, err := t.upstream.baseTransport.RoundTrip(attempt)
+		if err != nil {
+			// 客户端主动取消不计为源站故障
+			if errors.Is(err, context.Canceled) {
+				return nil, err
+			}
+			origin.markFailure(err, t.upstream.maxFails, t.upstream.ejectDuration)
+			lastErr = err
+			if isLast {
+				return nil, err
+			}
+			log.Warn().Err(err).Str("origin", origin.URL.String()).Msg("Origin request failed, trying next origin")
+			continue
+		}
+
+		switch response.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			origin.markFailure(fmt.Errorf("origin returned %s", response.Status), t.upstream.maxFails, t.upstream.ejectDuration)
+			if !isLast {
+				response.Body.Close()
+				log.Warn().Str("origin", origin.URL.String()).Int("status", response.StatusCode).Msg("Origin unavailable, trying next origin")
+				continue
+			}
+		default:
+			origin.markSuccess()
+		}
+		return response, nil
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("upstream %s has no origin", t.upstream.Name)
+	}
+	return nil, lastErr
+}
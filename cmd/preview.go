@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"ra2web-proxy/pkg/utils"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// HackPreviewRequest 定义 hack 预览请求
+type HackPreviewRequest struct {
+	Host       string          `json:"host"`       // 入口主机名，决定上游与模板变量，为空时取 main_entry_list 第一项
+	Scheme     string          `json:"scheme"`     // 客户端访问的协议 http/https，决定 .Scheme 与 url_rewrite 的结果，默认为 http
+	HackSource string          `json:"hackSource"` // 要预览的文件路径，例如 /index.html
+	Hack       json.RawMessage `json:"hack"`       // 可选，直接粘贴的 hack 配置，与 hack-map 中的条目一样严格校验，为空时使用 hack-map 中的配置
+}
+
+// HackPreviewResult 定义 hack 预览结果
+type HackPreviewResult struct {
+	HackSource  string         `json:"hackSource"`
+	UpstreamURL string         `json:"upstreamUrl"`
+	Changed     bool           `json:"changed"` // hack 后的内容与原始内容是否不同
+	Diff        string         `json:"diff"`    // 原始内容与 hack 后内容的 unified diff，HTML 按标签切分后比较
+	Rules       []HackRuleStat `json:"rules"`   // 每个修改点的匹配统计，没有改变内容的修改点 matched 为 0
+}
+
+// previewTimeout 预览拉取上游内容的超时时间
+const previewTimeout = 30 * time.Second
+
+// previewHack 通过上游自身的 Transport 拉取最新内容，按 applyHacks 的顺序应用 hack 与 url_rewrite，不写入缓存
+func previewHack(req HackPreviewRequest) (HackPreviewResult, error) {
+	var result HackPreviewResult
+
+	rc := activeRuntime()
+	host := req.Host
+	if host == "" {
+		host = firstEntry(rc.config.MainEntryList)
+	}
+	upstream, ok := lookupTarget(host)
+	if !ok {
+		return result, fmt.Errorf("unknown host %q", host)
+	}
+	scheme := req.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+	if scheme != "http" && scheme != "https" {
+		return result, fmt.Errorf("scheme %q must be http or https", scheme)
+	}
+	// hack-map 中的 hack 与线上一样使用当前配置渲染，粘贴的 hack 不能读取配置与环境变量
+	vars := newHostTemplateVars(strings.Split(host, ":")[0], scheme)
+	hackVars := vars
+
+	// 粘贴的 hack 配置优先，否则使用 hack-map 中作用于该路径的全部 hack
+	var hacks []HackConfig
+	source := req.HackSource
+	if len(req.Hack) > 0 {
+		hack, err := parsePreviewHack(req.Hack)
+		if err != nil {
+			return result, err
+		}
+		if source != "" {
+			hack.HackSource = source
+		}
+		source = hack.HackSource
+		hacks = []HackConfig{hack}
+		hackVars = newPreviewTemplateVars(vars.Host, scheme)
+	} else {
+		if source == "" {
+			return result, errors.New("hackSource or hack is required")
+		}
+		hacks = rc.findHacks(upstream.Name, source)
+		if len(hacks) == 0 && len(rc.urlRewriteRules(source, vars.Host)) == 0 {
+			return result, fmt.Errorf("no hack found for %q", source)
+		}
+	}
+	if source == "" {
+		return result, errors.New("hackSource is required")
+	}
+	if strings.HasPrefix(source, regexpSourcePrefix) || strings.ContainsAny(source, "*?[") {
+		return result, fmt.Errorf("hackSource %q is a pattern, a concrete path is required for preview", source)
+	}
+	result.HackSource = source
+
+	original, err := fetchPreviewSource(upstream, source, vars, &result)
+	if err != nil {
+		return result, err
+	}
+
+	// HTML 经过解析后格式会变化，先规范化原始内容再比较
+	isHTML := filepath.Ext(source) == ".html"
+	if isHTML {
+		if original, err = normalizeHTML(original); err != nil {
+			return result, err
+		}
+	}
+
+	hacked := original
+	for i, hack := range hacks {
+		var stats []HackRuleStat
+		hacked, stats, err = previewHackRules(hack, hacked, hackVars, isHTML)
+		if err != nil {
+			return result, err
+		}
+		for _, stat := range stats {
+			stat.Hack = i
+			result.Rules = append(result.Rules, stat)
+		}
+	}
+
+	// 与 applyHacks 一样最后改写上游绝对地址，规则来自当前配置
+	if rules := rc.urlRewriteRules(source, vars.Host); len(rules) > 0 {
+		var stats []HackRuleStat
+		if hacked, stats, err = rewriteURLs(hacked, rules, vars); err != nil {
+			return result, err
+		}
+		if isHTML {
+			if hacked, err = normalizeHTML(hacked); err != nil {
+				return result, err
+			}
+		}
+		for _, stat := range stats {
+			stat.Hack = len(hacks)
+			result.Rules = append(result.Rules, stat)
+		}
+	}
+
+	result.Changed = !bytes.Equal(original, hacked)
+	if !result.Changed {
+		return result, nil
+	}
+	if isHTML {
+		result.Diff = utils.UnifiedHTMLDiff("upstream"+source, "hacked"+source, string(original), string(hacked), 3)
+	} else {
+		result.Diff = utils.UnifiedDiff("upstream"+source, "hacked"+source, string(original), string(hacked), 3)
+	}
+	return result, nil
+}
+
+// fetchPreviewSource 拉取上游的原始内容，index.html 按目录路径请求。
+// 请求与代理一样附加上游的请求头，并通过上游的 Transport 发送，使用相同的 TLS、出口代理、Host 头与故障切换设置
+func fetchPreviewSource(upstream *Upstream, source string, vars TemplateVars, result *HackPreviewResult) ([]byte, error) {
+	upstreamPath := strings.TrimSuffix(source, "index.html")
+	result.UpstreamURL = upstream.Target.ResolveReference(&url.URL{Path: upstreamPath}).String()
+
+	ctx, cancel := context.WithTimeout(context.Background(), previewTimeout)
+	defer cancel()
+	upstreamReq, err := http.NewRequestWithContext(ctx, http.MethodGet, result.UpstreamURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if filepath.Ext(source) == ".html" {
+		upstreamReq.Header.Set("Accept", "text/html")
+	}
+	if err := upstream.setUpstreamHeaders(upstreamReq, vars); err != nil {
+		return nil, err
+	}
+	response, err := upstream.Transport.RoundTrip(upstreamReq)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return nil, fmt.Errorf("upstream returned %s", response.Status)
+	}
+	return io.ReadAll(response.Body)
+}
+
+// parsePreviewHack 按 hack-map 的规则严格解析粘贴的单个 hack 配置
+func parsePreviewHack(data []byte) (HackConfig, error) {
+	list := append(append([]byte("["), data...), ']')
+	hacks, err := parseHackMap("hack", list)
+	if err != nil {
+		return HackConfig{}, err
+	}
+	if len(hacks) != 1 {
+		return HackConfig{}, errors.New("hack must be a single hack config")
+	}
+	return hacks[0], nil
+}
+
+// previewHackRules 逐个应用 hack 中的修改点，修改点没有改变内容时（例如插入的片段被 HTML 解析丢弃）
+// 将其 matched 记为 0，避免预览结果显示命中却没有效果。HTML 每一步的输出都重新规范化，
+// 与下一个修改点解析后看到的文档保持一致
+func previewHackRules(hack HackConfig, body []byte, vars TemplateVars, isHTML bool) ([]byte, []HackRuleStat, error) {
+	var rules []HackConfig
+	detail := hack.HackDetail
+	switch hack.HackAction {
+	case ModifyHTMLFile:
+		for _, point := range detail.ModifyPointsList {
+			rule := hack
+			rule.HackDetail = HackDetail{ModifyPointsList: []ModifyPoint{point}}
+			rules = append(rules, rule)
+		}
+	case InjectAsset:
+		for _, asset := range detail.Assets {
+			rule := hack
+			rule.HackDetail = HackDetail{Assets: []AssetPoint{asset}}
+			rules = append(rules, rule)
+		}
+	case ReplaceText:
+		for _, replacement := range detail.Replacements {
+			rule := hack
+			rule.HackDetail = HackDetail{Replacements: []TextReplacement{replacement}}
+			rules = append(rules, rule)
+		}
+	default:
+		rules = []HackConfig{hack}
+	}
+
+	var stats []HackRuleStat
+	for i, rule := range rules {
+		hacked, ruleStats, err := applyHackConfig(rule, body, vars)
+		if err != nil {
+			return nil, nil, err
+		}
+		if isHTML {
+			if hacked, err = normalizeHTML(hacked); err != nil {
+				return nil, nil, err
+			}
+		}
+		changed := !bytes.Equal(body, hacked)
+		for _, stat := range ruleStats {
+			if len(rules) > 1 {
+				stat.Index = i
+			}
+			if !changed {
+				stat.Matched = 0
+			}
+			stats = append(stats, stat)
+		}
+		body = hacked
+	}
+	return body, stats, nil
+}
+
+// hackPreviewHandler 处理 hack 预览接口请求
+func hackPreviewHandler(w http.ResponseWriter, r *http.Request) {
+	if !isDomainAllowedCallApi(r.Host, *currentConfig()) {
+		mainProxyHandler(w, r)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req HackPreviewRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	result, err := previewHack(req)
+	if err != nil {
+		http.Error(w, "Failed to preview hack: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		log.Error().Err(err).Msg("Error writing hack preview response")
+	}
+}
+
+// runPreviewCommand 执行 preview 子命令，将 diff 与匹配统计输出到标准输出
+func runPreviewCommand(args []string) int {
+	fs := flag.NewFlagSet("preview", flag.ExitOnError)
+	host := fs.String("host", "", "entry host used to pick the upstream and template variables")
+	scheme := fs.String("scheme", "", "client scheme used for template variables and url_rewrite, http or https")
+	source := fs.String("source", "", "hackSource path to preview, e.g. /index.html")
+	hackFile := fs.String("hack", "", "JSON file containing a single hack config to preview instead of hack-map")
+	_ = fs.Parse(args)
+
+	req := HackPreviewRequest{Host: *host, Scheme: *scheme, HackSource: *source}
+	if *hackFile != "" {
+		data, err := os.ReadFile(*hackFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to read hack file: %v\n", err)
+			return 1
+		}
+		req.Hack = data
+	}
+
+	result, err := previewHack(req)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "preview failed: %v\n", err)
+		return 1
+	}
+
+	if result.Changed {
+		fmt.Print(result.Diff)
+	} else {
+		fmt.Println("no change")
+	}
+	fmt.Printf("\n# %s (%s)\n", result.HackSource, result.UpstreamURL)
+	for _, rule := range result.Rules {
+		fmt.Printf("# hack %d rule %d %-9s matched=%d selector=%s\n", rule.Hack, rule.Index, rule.Action, rule.Matched, rule.Selector)
+	}
+	return 0
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestPreviewHackPipeline(t *testing.T) {
+	var gotHost, gotHeader string
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotHost, gotHeader = r.Host, r.Header.Get("X-Upstream")
+		w.Header().Set("Content-Type", "application/javascript")
+		_, _ = w.Write([]byte(`var cdn = "https://game.chronodivide.com/a.js"; var base = "BASE";`))
+	})
+	t.Setenv("RA2PROXY_PUBLIC_PREVIEW", "from-env")
+	hack := HackConfig{
+		HackAction: ReplaceText,
+		HackSource: "/app.js",
+		HackDetail: HackDetail{Replacements: []TextReplacement{
+			{Old: "BASE", New: `{{.Config.BaseHref}} {{env "RA2PROXY_PUBLIC_PREVIEW"}}`},
+		}},
+	}
+	newTestProxy(t, upstream, Config{
+		BaseHref:   "/base/",
+		URLRewrite: &ConfigURLRewrite{Rules: []URLRewriteRule{{From: "game.chronodivide.com", To: "{{.Host}}"}}},
+		Upstreams: map[string]ConfigUpstream{"main": {
+			EntryList:  []string{testEntryHost},
+			HostHeader: "origin.example.com",
+			Headers:    map[string]string{"X-Upstream": "{{.Host}}"},
+		}},
+	}, []HackConfig{hack})
+
+	tests := []struct {
+		name    string
+		req     HackPreviewRequest
+		want    []string
+		notWant []string
+	}{
+		{
+			name: "hack-map uses live config and url_rewrite",
+			req:  HackPreviewRequest{Host: testEntryHost, Scheme: "https", HackSource: "/app.js"},
+			want: []string{
+				`+var cdn = "https://` + testEntryHost + `/a.js"; var base = "/base/ from-env";`,
+			},
+		},
+		{
+			name: "pasted hack cannot read config or env",
+			req: HackPreviewRequest{
+				Host: testEntryHost,
+				Hack: []byte(`{"hackAction": "replaceText", "hackSource": "/app.js", "hackDetail": {"replacements": [
+					{"old": "BASE", "new": "[{{.Config.BaseHref}}{{env \"RA2PROXY_PUBLIC_PREVIEW\"}}]"}
+				]}}`),
+			},
+			want:    []string{`+var cdn = "http://` + testEntryHost + `/a.js"; var base = "[]";`},
+			notWant: []string{"from-env", "/base/"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := previewHack(tt.req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if gotHost != "origin.example.com" || gotHeader != testEntryHost {
+				t.Errorf("upstream got host %q and X-Upstream %q, want upstream host_header and headers", gotHost, gotHeader)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(result.Diff, want) {
+					t.Errorf("diff does not contain %q:\n%s", want, result.Diff)
+				}
+			}
+			for _, notWant := range tt.notWant {
+				if strings.Contains(result.Diff, notWant) {
+					t.Errorf("diff contains %q:\n%s", notWant, result.Diff)
+				}
+			}
+			if last := result.Rules[len(result.Rules)-1]; last.Action != "rewriteURL" || last.Matched != 1 {
+				t.Errorf("last rule = %+v, want matched rewriteURL", last)
+			}
+		})
+	}
+}
+
+func TestPreviewTemplateCacheLimit(t *testing.T) {
+	vars := newPreviewTemplateVars(testEntryHost, "http")
+	for i := 0; i < maxPreviewTemplates*2; i++ {
+		if _, err := renderTemplate(fmt.Sprintf("{{.Host}} %d", i), vars); err != nil {
+			t.Fatal(err)
+		}
+	}
+	count := 0
+	previewTemplateCache.Range(func(_, _ interface{}) bool {
+		count++
+		return true
+	})
+	if count > maxPreviewTemplates {
+		t.Errorf("preview template cache holds %d templates, want at most %d", count, maxPreviewTemplates)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// testEntryHost 测试代理默认的入口主机
+const testEntryHost = "game.example.com"
+
+// newTestProxy 启动 httptest 上游，并以临时缓存目录与给定配置激活运行时状态，测试结束后恢复。
+// 配置中没有上游时使用名为 main 的上游，入口主机为 testEntryHost；没有 target_url 的上游指向 httptest 上游
+func newTestProxy(t *testing.T, upstream http.Handler, c Config, hacks []HackConfig) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(upstream)
+	t.Cleanup(server.Close)
+
+	if c.Upstreams == nil {
+		c.Upstreams = map[string]ConfigUpstream{"main": {EntryList: []string{testEntryHost}}}
+	}
+	for name, u := range c.Upstreams {
+		if u.TargetURL == "" && len(u.Origins) == 0 {
+			u.TargetURL = server.URL
+			c.Upstreams[name] = u
+		}
+	}
+
+	savedCacheDir, savedRuntime := cacheDir, activeConfig.Load()
+	cacheDir = t.TempDir()
+	rc, err := buildRuntime(c, hacks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	activateRuntime(rc)
+	t.Cleanup(func() {
+		for _, u := range rc.upstreams {
+			u.stopHealthChecks()
+		}
+		cacheDir = savedCacheDir
+		activeConfig.Store(savedRuntime)
+	})
+	return server
+}
+
+// proxyGet 通过 mainProxyHandler 发送 GET 请求，https 地址的请求带有 TLS 状态
+func proxyGet(url string, header map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, url, nil)
+	for name, value := range header {
+		r.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	mainProxyHandler(w, r)
+	return w
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// ConfigRedirectRewrite 定义单个上游的重定向与 Cookie 改写配置
+type ConfigRedirectRewrite struct {
+	Hosts       map[string]string `json:"hosts"`        // 上游主机名到入口主机名的映射，值支持模板变量；上游自身的主机名总是改写为当前请求主机
+	CookiePaths map[string]string `json:"cookie_paths"` // Cookie Path 前缀映射，例如 {"/api/": "/proxy-api/"}
+}
+
+// redirectHeaders 需要改写地址的响应头
+var redirectHeaders = []string{"Location", "Content-Location", "Refresh"}
+
+// headerRewriter 将上游返回的地址改写回当前请求的入口主机
+type headerRewriter struct {
+	originHosts []string               // 当前上游全部源站的主机名
+	requestHost string                 // 当前请求的 Host，可能包含端口
+	vars        TemplateVars           // 当前请求的模板变量
+	rewrite     *ConfigRedirectRewrite // 上游对应的改写配置，可以为空
+}
+
+func newHeaderRewriter(upstream *Upstream, requestHost string, vars TemplateVars) *headerRewriter {
+	originHosts := make([]string, 0, len(upstream.Origins))
+	for _, origin := range upstream.Origins {
+		originHosts = append(originHosts, strings.ToLower(origin.URL.Hostname()))
+	}
+	return &headerRewriter{
+		originHosts: originHosts,
+		requestHost: requestHost,
+		vars:        vars,
+		rewrite:     currentConfig().RedirectRewrite[upstream.Name],
+	}
+}
+
+// mapHost 返回上游主机名对应的入口主机名，不需要改写时返回 false
+func (h *headerRewriter) mapHost(host string) (string, bool) {
+	host = strings.ToLower(strings.TrimPrefix(host, "."))
+	if containsString(h.originHosts, host) {
+		return h.requestHost, true
+	}
+	if h.rewrite == nil {
+		return "", false
+	}
+	for from, to := range h.rewrite.Hosts {
+		if strings.ToLower(from) != host {
+			continue
+		}
+		mapped, err := renderTemplate(to, h.vars)
+		if err != nil || mapped == "" {
+			return "", false
+		}
+		// 映射到当前请求主机时保留请求中的端口
+		if mapped == h.vars.Host {
+			mapped = h.requestHost
+		}
+		return mapped, true
+	}
+	return "", false
+}
+
+// rewriteURL 改写绝对地址中的协议与主机，相对地址与未配置的主机保持不变
+func (h *headerRewriter) rewriteURL(rawURL string) string {
+	parsedUrl, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil || parsedUrl.Host == "" {
+		return rawURL
+	}
+	mapped, ok := h.mapHost(parsedUrl.Hostname())
+	if !ok {
+		return rawURL
+	}
+	if parsedUrl.Scheme != "" {
+		parsedUrl.Scheme = h.vars.Scheme
+	}
+	parsedUrl.Host = mapped
+	return parsedUrl.String()
+}
+
+// rewriteRefresh 改写 Refresh 头中 url= 之后的地址，例如 "5; url=https://example.com/"
+func (h *headerRewriter) rewriteRefresh(value string) string {
+	index := strings.Index(strings.ToLower(value), "url=")
+	if index < 0 {
+		return value
+	}
+	prefix := value[:index+len("url=")]
+	target := value[index+len("url="):]
+	quote := ""
+	if strings.HasPrefix(target, `"`) || strings.HasPrefix(target, `'`) {
+		quote = target[:1]
+		target = strings.Trim(target, `"'`)
+	}
+	return prefix + quote + h.rewriteURL(target) + quote
+}
+
+// rewriteCookie 改写 Set-Cookie 中的 Domain 与 Path 属性。
+// Domain 为上游主机或其父域时改为入口主机，其他无法映射的 Domain 会被去掉，使 Cookie 仅对当前主机生效
+func (h *headerRewriter) rewriteCookie(value string) string {
+	parts := strings.Split(value, ";")
+	result := parts[:1]
+	for _, part := range parts[1:] {
+		attr := strings.TrimSpace(part)
+		name, attrValue, _ := strings.Cut(attr, "=")
+		switch strings.ToLower(name) {
+		case "domain":
+			domain := strings.ToLower(strings.TrimPrefix(attrValue, "."))
+			if h.isOriginDomain(domain) {
+				result = append(result, " Domain="+h.vars.Host)
+			} else if mapped, ok := h.mapHost(domain); ok {
+				result = append(result, " Domain="+strings.Split(mapped, ":")[0])
+			}
+		case "path":
+			result = append(result, " Path="+h.rewriteCookiePath(attrValue))
+		default:
+			result = append(result, part)
+		}
+	}
+	return strings.Join(result, ";")
+}
+
+// isOriginDomain 判断 Cookie 的 Domain 是否为某个源站的主机名或其父域
+func (h *headerRewriter) isOriginDomain(domain string) bool {
+	for _, originHost := range h.originHosts {
+		if domain == originHost || strings.HasSuffix(originHost, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// rewriteCookiePath 按最长前缀匹配改写 Cookie Path
+func (h *headerRewriter) rewriteCookiePath(cookiePath string) string {
+	if h.rewrite == nil || len(h.rewrite.CookiePaths) == 0 {
+		return cookiePath
+	}
+	prefixes := make([]string, 0, len(h.rewrite.CookiePaths))
+	for prefix := range h.rewrite.CookiePaths {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Slice(prefixes, func(i, j int) bool {
+		return len(prefixes[i]) > len(prefixes[j])
+	})
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(cookiePath, prefix) {
+			return h.rewrite.CookiePaths[prefix] + strings.TrimPrefix(cookiePath, prefix)
+		}
+	}
+	return cookiePath
+}
+
+// rewriteHeaders 改写响应中的重定向地址与 Cookie
+func (h *headerRewriter) rewriteHeaders(header http.Header) {
+	for _, name := range redirectHeaders {
+		value := header.Get(name)
+		if value == "" {
+			continue
+		}
+		if name == "Refresh" {
+			header.Set(name, h.rewriteRefresh(value))
+		} else {
+			header.Set(name, h.rewriteURL(value))
+		}
+	}
+
+	cookies := header.Values("Set-Cookie")
+	if len(cookies) == 0 {
+		return
+	}
+	header.Del("Set-Cookie")
+	for _, cookie := range cookies {
+		header.Add("Set-Cookie", h.rewriteCookie(cookie))
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestProxyRedirectRewrite(t *testing.T) {
+	var origin string // httptest 上游的地址，例如 127.0.0.1:12345
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/origin":
+			w.Header().Set("Location", "http://"+origin+"/login?next=%2F")
+			w.Header().Set("Content-Location", "http://"+origin+"/origin.html")
+			w.WriteHeader(http.StatusFound)
+		case "/mapped":
+			w.Header().Set("Location", "https://game.chronodivide.com/play")
+			w.Header().Set("Refresh", `0; url="https://res.chronodivide.com/a"`)
+			w.WriteHeader(http.StatusMovedPermanently)
+		case "/foreign":
+			w.Header().Set("Location", "https://elsewhere.example.org/")
+			w.WriteHeader(http.StatusFound)
+		case "/cookies":
+			w.Header().Add("Set-Cookie", "sid=1; Domain=.127.0.0.1; Path=/api/session; HttpOnly")
+			w.Header().Add("Set-Cookie", "lang=cn; Domain=chronodivide.com; Path=/")
+			w.Header().Add("Set-Cookie", "ad=1; Domain=tracker.example.org")
+			w.WriteHeader(http.StatusNoContent)
+		}
+	})
+	server := newTestProxy(t, upstream, Config{RedirectRewrite: map[string]*ConfigRedirectRewrite{
+		"main": {
+			Hosts: map[string]string{
+				"game.chronodivide.com": "{{.Host}}",
+				"res.chronodivide.com":  "res.example.com",
+				"chronodivide.com":      "{{.Host}}",
+			},
+			CookiePaths: map[string]string{"/api/": "/proxy-api/"},
+		},
+	}}, nil)
+	origin = strings.TrimPrefix(server.URL, "http://")
+
+	tests := []struct {
+		name   string
+		path   string
+		header string
+		want   []string
+	}{
+		{"origin location keeps entry port", "/origin", "Location", []string{"https://" + testEntryHost + ":8443/login?next=%2F"}},
+		{"content location", "/origin", "Content-Location", []string{"https://" + testEntryHost + ":8443/origin.html"}},
+		{"mapped to request host", "/mapped", "Location", []string{"https://" + testEntryHost + ":8443/play"}},
+		{"refresh mapped to other host", "/mapped", "Refresh", []string{`0; url="https://res.example.com/a"`}},
+		{"unmapped host untouched", "/foreign", "Location", []string{"https://elsewhere.example.org/"}},
+		{"cookie domains and paths", "/cookies", "Set-Cookie", []string{
+			"sid=1; Domain=" + testEntryHost + "; Path=/proxy-api/session; HttpOnly",
+			"lang=cn; Domain=" + testEntryHost + "; Path=/",
+			"ad=1",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := proxyGet("https://"+testEntryHost+":8443"+tt.path, nil)
+			if got := w.Header().Values(tt.header); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("%s = %q, want %q", tt.header, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// runtimeConfig 由配置文件与 hack-map 构建的运行时状态，重新加载时整体替换，
+// 同一请求中的摘要计算与 hack 应用使用同一份状态，避免混用新旧配置
+type runtimeConfig struct {
+	config         *Config
+	hacks          []HackConfig         // 当前生效的 hack 配置
+	upstreams      map[string]*Upstream // 上游名称到上游的映射
+	targets        map[string]*Upstream // 入口主机到上游的映射
+	routes         []route              // 路由规则表，未命中时按上游的入口主机路由
+	errorPages     []errorPage          // 错误页面表，页面模板已经解析
+	allowedOrigins map[string]bool
+	trustedProxies []*net.IPNet    // trusted_proxies 解析后的网段
+	knownHosts     map[string]bool // 配置中登记的主机名，依赖请求主机的 hack 结果只为这些主机写入派生层
+	configDigest   []byte          // 配置的哈希，参与 hack 摘要计算
+	digests        *digestCache    // hack 摘要缓存，hack 或配置变化时随状态一起替换
+}
+
+// ReloadResult 定义重新加载配置的结果
+type ReloadResult struct {
+	Upstreams int      `json:"upstreams"`
+	Routes    int      `json:"routes"`
+	Hacks     int      `json:"hacks"`
+	Warnings  []string `json:"warnings,omitempty"` // 需要重启才能生效的配置项
+}
+
+var (
+	// activeConfig 当前生效的运行时状态
+	activeConfig atomic.Pointer[runtimeConfig]
+	// emptyRuntime 配置加载之前使用的空状态
+	emptyRuntime = runtimeConfig{config: &Config{}}
+	// reloadMu 保证同一时间只有一次重新加载
+	reloadMu sync.Mutex
+	// startupCommandLine 启动时的命令行参数，重新加载时沿用
+	startupCommandLine *commandLine
+)
+
+// activeRuntime 返回当前生效的运行时状态，同一请求中多次使用时应只获取一次
+func activeRuntime() *runtimeConfig {
+	if rc := activeConfig.Load(); rc != nil {
+		return rc
+	}
+	return &emptyRuntime
+}
+
+// currentConfig 返回当前生效的配置，调用方不能修改
+func currentConfig() *Config {
+	return activeRuntime().config
+}
+
+// currentUpstreams 返回当前生效的上游
+func currentUpstreams() map[string]*Upstream {
+	return activeRuntime().upstreams
+}
+
+// lookupTarget 根据入口主机查找上游
+func lookupTarget(host string) (*Upstream, bool) {
+	upstream, ok := activeRuntime().targets[host]
+	return upstream, ok
+}
+
+// isAllowedOrigin 判断跨域请求的来源是否在 allowed_origins 中
+func isAllowedOrigin(origin string) bool {
+	return activeRuntime().allowedOrigins[origin]
+}
+
+// parseTrustedProxies 解析可信代理的 IP 或网段
+func parseTrustedProxies(values []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, value := range values {
+		ipNet, err := parseIPNet(value)
+		if err != nil {
+			return nil, fmt.Errorf("trusted_proxies: %w", err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// isTrustedProxy 判断请求的直接来源是否为可信代理，只有可信代理设置的 X-Forwarded-* 请求头才会被采用
+func (rc *runtimeConfig) isTrustedProxy(remoteIP string) bool {
+	ip := net.ParseIP(remoteIP)
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range rc.trustedProxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP 解析请求的客户端 IP：直接来源为可信代理时，从右向左遍历 X-Forwarded-For，
+// 跳过可信代理，取第一个不可信的地址；客户端可以任意伪造最左侧的部分，因此不能直接取第一项
+func (rc *runtimeConfig) clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if !rc.isTrustedProxy(ip) {
+		return ip
+	}
+
+	var hops []string
+	for _, value := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(value, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		ip = hop
+		if !rc.isTrustedProxy(ip) {
+			break
+		}
+	}
+	return ip
+}
+
+// knownHosts 返回配置中登记的主机名：入口主机、路由规则中不含通配的主机以及 URL 改写规则限定的主机。
+// 通配与不限主机的路由可以接受任意 Host，不能把请求中的主机名直接用作缓存目录
+func knownHosts(c Config, targets map[string]*Upstream) map[string]bool {
+	hosts := make(map[string]bool, len(targets))
+	for host := range targets {
+		hosts[host] = true
+	}
+	for _, r := range c.Routes {
+		for _, host := range r.Hosts {
+			if !strings.HasPrefix(host, "*") {
+				hosts[host] = true
+			}
+		}
+	}
+	if c.URLRewrite != nil {
+		for _, rule := range c.URLRewrite.Rules {
+			for _, host := range rule.Hosts {
+				hosts[host] = true
+			}
+		}
+	}
+	return hosts
+}
+
+// buildRuntime 解析并校验配置，得到完整的运行时状态，任何一项不合法时返回错误且不影响当前状态
+func buildRuntime(c Config, hacks []HackConfig) (*runtimeConfig, error) {
+	upstreams, err := loadUpstreams(c)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse upstreams: %w", err)
+	}
+	targets, err := entryTargets(upstreams)
+	if err != nil {
+		return nil, fmt.Errorf("unable to register entry hosts: %w", err)
+	}
+	if err := validateHeaderRules("header_rules", c.HeaderRules); err != nil {
+		return nil, fmt.Errorf("unable to parse header rules: %w", err)
+	}
+	if err := validateURLRewrite(c.URLRewrite); err != nil {
+		return nil, err
+	}
+	errorPages, err := compileErrorPages(c.ErrorPages)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse error pages: %w", err)
+	}
+	routes, err := compileRoutes(c.Routes, upstreams)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse routes: %w", err)
+	}
+	if _, _, err := parseMaintenance(c.Maintenance); err != nil {
+		return nil, fmt.Errorf("unable to parse maintenance: %w", err)
+	}
+	trustedProxies, err := parseTrustedProxies(c.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+
+	allowed := make(map[string]bool, len(c.AllowedOrigins))
+	for _, origin := range c.AllowedOrigins {
+		allowed[origin] = true
+	}
+	return &runtimeConfig{
+		config:         &c,
+		hacks:          hacks,
+		upstreams:      upstreams,
+		targets:        targets,
+		routes:         routes,
+		errorPages:     errorPages,
+		allowedOrigins: allowed,
+		trustedProxies: trustedProxies,
+		knownHosts:     knownHosts(c, targets),
+		configDigest:   configDigest(&c),
+		digests:        newDigestCache(),
+	}, nil
+}
+
+// activateRuntime 替换当前生效的运行时状态，并切换上游的健康检查。
+// 进行中的请求继续使用旧的上游完成，旧上游的空闲连接会被关闭
+func activateRuntime(rc *runtimeConfig) {
+	for _, upstream := range rc.upstreams {
+		upstream.startHealthChecks()
+	}
+	old := activeConfig.Swap(rc)
+	if old == nil {
+		return
+	}
+	for _, upstream := range old.upstreams {
+		upstream.stopHealthChecks()
+		if transport, ok := upstream.baseTransport.(interface{ CloseIdleConnections() }); ok {
+			transport.CloseIdleConnections()
+		}
+	}
+}
+
+// restartRequiredFields 返回修改后需要重启才能生效的配置项
+func restartRequiredFields(old *Config, next *Config) []string {
+	var fields []string
+	if !reflect.DeepEqual(old.HTTP, next.HTTP) {
+		fields = append(fields, "http")
+	}
+	if !reflect.DeepEqual(old.HTTPS, next.HTTPS) {
+		fields = append(fields, "https")
+	}
+	if old.CacheDir != next.CacheDir {
+		fields = append(fields, "cache_dir")
+	}
+	if old.OverwriteDir != next.OverwriteDir {
+		fields = append(fields, "overwrite_dir")
+	}
+	if old.ViewsDir != next.ViewsDir {
+		fields = append(fields, "views_dir")
+	}
+	if old.ReloadInterval != next.ReloadInterval {
+		fields = append(fields, "reload_interval")
+	}
+	if old.ReusePort != next.ReusePort {
+		fields = append(fields, "reuse_port")
+	}
+	return fields
+}
+
+// reloadConfig 重新读取配置文件与 hack-map，全部校验通过后整体替换，否则保留之前生效的配置。
+// 维护模式的运行时开关不受重新加载影响
+func reloadConfig(source string) (ReloadResult, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	var result ReloadResult
+	logger := log.With().Str("source", source).Logger()
+	fail := func(err error) (ReloadResult, error) {
+		logger.Error().Err(err).Msg("Config invalid, keep previous one")
+		return result, err
+	}
+
+	c, err := loadConfig(startupCommandLine)
+	if err != nil {
+		return fail(err)
+	}
+	hacks, check := checkConfigAndHackMap(c)
+	if len(check.Errors) > 0 {
+		return fail(check.Errors)
+	}
+	rc, err := buildRuntime(c, hacks)
+	if err != nil {
+		return fail(err)
+	}
+
+	for _, warning := range check.Warnings {
+		logger.Warn().Msg(warning)
+	}
+	for _, field := range restartRequiredFields(currentConfig(), rc.config) {
+		result.Warnings = append(result.Warnings, field+" changed, restart required to take effect")
+	}
+	if err := reloadMaintenance(c.Maintenance); err != nil {
+		return fail(err)
+	}
+	activateRuntime(rc)
+	go pruneDerivedCache()
+
+	result.Upstreams = len(rc.upstreams)
+	result.Routes = len(rc.routes)
+	result.Hacks = len(hacks)
+	logger.Info().
+		Int("upstreams", result.Upstreams).
+		Int("routes", result.Routes).
+		Int("hacks", result.Hacks).
+		Strs("warnings", result.Warnings).
+		Msg("Config reloaded")
+	return result, nil
+}
+
+// watchReloadSignal 收到 SIGHUP 时重新加载配置
+func watchReloadSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		_, _ = reloadConfig("sighup")
+	}
+}
+
+// pollConfigFiles 按间隔检查配置文件、include 的片段与 hack-map 的修改时间和大小，发生变化时重新加载配置
+func pollConfigFiles(interval time.Duration) {
+	stamp := func() string {
+		reloadMu.Lock()
+		files := append(append([]string(nil), startupCommandLine.configFiles...), hackMapPath)
+		reloadMu.Unlock()
+
+		var result string
+		for _, file := range files {
+			if info, err := os.Stat(file); err == nil {
+				result += fmt.Sprintf("%s:%d:%d;", file, info.ModTime().UnixNano(), info.Size())
+			}
+		}
+		return result
+	}
+
+	last := stamp()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		current := stamp()
+		if current == last {
+			continue
+		}
+		last = current
+		_, _ = reloadConfig("poll")
+	}
+}
+
+// reloadConfigHandler 重新加载配置文件与 hack-map，新配置不合法时保留之前的配置并返回错误详情
+func reloadConfigHandler(w http.ResponseWriter, r *http.Request) {
+	if !isDomainAllowedCallApi(r.Host, *currentConfig()) {
+		mainProxyHandler(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	result, err := reloadConfig("api")
+	if err != nil {
+		http.Error(w, "Failed to reload config:\n"+err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		log.Error().Err(err).Msg("Error writing reload response")
+	}
+}
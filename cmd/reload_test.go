@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRuntimeClientIP(t *testing.T) {
+	trusted, err := parseTrustedProxies([]string{"10.0.0.0/8", "127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc := &runtimeConfig{trustedProxies: trusted}
+
+	tests := []struct {
+		name      string
+		remote    string
+		forwarded []string // 每一项为一个 X-Forwarded-For 请求头
+		want      string
+	}{
+		{"direct client", "203.0.113.9:5000", nil, "203.0.113.9"},
+		{"untrusted remote ignores header", "203.0.113.9:5000", []string{"127.0.0.1"}, "203.0.113.9"},
+		{"trusted proxy", "10.0.0.1:5000", []string{"203.0.113.9"}, "203.0.113.9"},
+		{"spoofed leftmost entry", "10.0.0.1:5000", []string{"127.0.0.1, 203.0.113.9"}, "203.0.113.9"},
+		{"proxy chain", "10.0.0.1:5000", []string{"198.51.100.1, 203.0.113.9, 10.0.0.2"}, "203.0.113.9"},
+		{"multiple headers", "10.0.0.1:5000", []string{"198.51.100.1", "203.0.113.9, 10.0.0.2"}, "203.0.113.9"},
+		{"all trusted", "10.0.0.1:5000", []string{"127.0.0.1, 10.0.0.2"}, "127.0.0.1"},
+		{"trusted proxy without header", "10.0.0.1:5000", nil, "10.0.0.1"},
+		{"invalid entry stops", "10.0.0.1:5000", []string{"198.51.100.1, unknown, 10.0.0.2"}, "10.0.0.2"},
+		{"ipv6", "[::1]:5000", []string{"127.0.0.1"}, "::1"},
+		{"remote without port", "10.0.0.1", []string{"2001:db8::1"}, "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "http://a.com/", nil)
+			r.RemoteAddr = tt.remote
+			for _, value := range tt.forwarded {
+				r.Header.Add("X-Forwarded-For", value)
+			}
+			if got := rc.clientIP(r); got != tt.want {
+				t.Errorf("clientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ConfigRetry 定义幂等请求的重试策略
+type ConfigRetry struct {
+	Attempts   int    `json:"attempts"`    // 包括首次请求在内的最大尝试次数，默认为 1，即不重试
+	Backoff    string `json:"backoff"`     // 首次重试前的等待时间，之后每次翻倍，默认为 200ms
+	MaxBackoff string `json:"max_backoff"` // 单次等待时间的上限，默认为 5s
+}
+
+// ConfigCircuitBreaker 定义上游的熔断策略
+type ConfigCircuitBreaker struct {
+	Failures     int    `json:"failures"`      // 连续失败多少个请求后熔断，默认为 5
+	OpenDuration string `json:"open_duration"` // 熔断持续时间，到期后放行一个探测请求，默认为 30s
+}
+
+const (
+	defaultRetryBackoff        = 200 * time.Millisecond
+	defaultRetryMaxBackoff     = 5 * time.Second
+	defaultBreakerFailures     = 5
+	defaultBreakerOpenDuration = 30 * time.Second
+)
+
+// errCircuitOpen 上游处于熔断状态时返回的错误
+var errCircuitOpen = errors.New("upstream circuit breaker is open")
+
+// retryPolicy 解析后的重试策略
+type retryPolicy struct {
+	attempts   int
+	backoff    time.Duration
+	maxBackoff time.Duration
+}
+
+// parseRetryPolicy 解析重试策略，未配置时不重试
+func parseRetryPolicy(name string, config *ConfigRetry) (retryPolicy, error) {
+	policy := retryPolicy{attempts: 1}
+	if config == nil {
+		return policy, nil
+	}
+	var err error
+	if policy.backoff, err = parseDuration("upstreams."+name+".retry.backoff", config.Backoff, defaultRetryBackoff); err != nil {
+		return policy, err
+	}
+	if policy.maxBackoff, err = parseDuration("upstreams."+name+".retry.max_backoff", config.MaxBackoff, defaultRetryMaxBackoff); err != nil {
+		return policy, err
+	}
+	if config.Attempts > 1 {
+		policy.attempts = config.Attempts
+	}
+	return policy, nil
+}
+
+// delay 返回第 attempt 次重试前的等待时间，带有随机抖动。backoff 明确配置为 0 时立即重试
+func (p retryPolicy) delay(attempt int) time.Duration {
+	if p.backoff <= 0 {
+		return 0
+	}
+	delay := p.backoff << (attempt - 1)
+	if delay <= 0 || delay > p.maxBackoff {
+		delay = p.maxBackoff
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// circuitBreaker 连续失败达到阈值后熔断，熔断期间直接返回错误，到期后放行一个探测请求
+type circuitBreaker struct {
+	name         string
+	threshold    int
+	openDuration time.Duration
+
+	mu       sync.Mutex
+	state    circuitState
+	failures int
+	openedAt time.Time
+}
+
+// newCircuitBreaker 创建熔断器，未配置时返回 nil
+func newCircuitBreaker(name string, config *ConfigCircuitBreaker) (*circuitBreaker, error) {
+	if config == nil {
+		return nil, nil
+	}
+	openDuration, err := parseDuration("upstreams."+name+".circuit_breaker.open_duration", config.OpenDuration, defaultBreakerOpenDuration)
+	if err != nil {
+		return nil, err
+	}
+	threshold := config.Failures
+	if threshold <= 0 {
+		threshold = defaultBreakerFailures
+	}
+	return &circuitBreaker{name: name, threshold: threshold, openDuration: openDuration}, nil
+}
+
+// allow 判断是否放行请求
+func (b *circuitBreaker) allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case circuitOpen:
+		if time.Since(b.openedAt) < b.openDuration {
+			return false
+		}
+		// 熔断到期，只放行一个探测请求
+		b.state = circuitHalfOpen
+		return true
+	case circuitHalfOpen:
+		return false
+	default:
+		return true
+	}
+}
+
+// retryAfter 返回熔断剩余的时间
+func (b *circuitBreaker) retryAfter() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	remaining := b.openDuration - time.Since(b.openedAt)
+	if remaining < time.Second {
+		remaining = time.Second
+	}
+	return remaining
+}
+
+// success 记录一次成功的请求
+func (b *circuitBreaker) success() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != circuitClosed {
+		log.Info().Str("upstream", b.name).Msg("Circuit breaker closed")
+	}
+	b.state = circuitClosed
+	b.failures = 0
+}
+
+// failure 记录一次失败的请求
+func (b *circuitBreaker) failure() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.state == circuitHalfOpen || b.failures >= b.threshold {
+		b.state = circuitOpen
+		b.openedAt = time.Now()
+		b.failures = 0
+		log.Warn().Str("upstream", b.name).Dur("open_duration", b.openDuration).Msg("Circuit breaker opened")
+	}
+}
+
+// cancel 探测请求被客户端取消时恢复为可以再次探测的状态
+func (b *circuitBreaker) cancel() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == circuitHalfOpen {
+		b.state = circuitOpen
+		b.openedAt = time.Now().Add(-b.openDuration)
+	}
+}
+
+// isUnavailableStatus 判断状态码是否表示上游暂时不可用
+func isUnavailableStatus(statusCode int) bool {
+	return statusCode == http.StatusBadGateway ||
+		statusCode == http.StatusServiceUnavailable ||
+		statusCode == http.StatusGatewayTimeout
+}
+
+// isIdempotent 判断请求是否可以安全地重试
+func isIdempotent(req *http.Request) bool {
+	return (req.Method == http.MethodGet || req.Method == http.MethodHead) &&
+		(req.Body == nil || req.Body == http.NoBody)
+}
+
+// resilientTransport 在源站故障切换之外增加熔断与幂等请求的重试
+type resilientTransport struct {
+	upstream *Upstream
+	next     http.RoundTripper
+}
+
+func (t *resilientTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	breaker := t.upstream.breaker
+	if !breaker.allow() {
+		return nil, errCircuitOpen
+	}
+
+	attempts := 1
+	if isIdempotent(req) {
+		attempts = t.upstream.retry.attempts
+	}
+	for attempt := 1; ; attempt++ {
+		response, err := t.next.RoundTrip(req)
+		if err == nil && !isUnavailableStatus(response.StatusCode) {
+			breaker.success()
+			return response, nil
+		}
+		if errors.Is(err, context.Canceled) || errors.Is(req.Context().Err(), context.Canceled) {
+			breaker.cancel()
+			return response, err
+		}
+		if attempt >= attempts {
+			breaker.failure()
+			return response, err
+		}
+
+		if response != nil {
+			_, _ = io.Copy(io.Discard, response.Body)
+			response.Body.Close()
+		}
+		delay := t.upstream.retry.delay(attempt)
+		log.Warn().Err(err).Str("upstream", t.upstream.Name).Int("attempt", attempt).Dur("delay", delay).Msg("Upstream request failed, retrying")
+		select {
+		case <-time.After(delay):
+		case <-req.Context().Done():
+			if errors.Is(req.Context().Err(), context.Canceled) {
+				breaker.cancel()
+			} else {
+				breaker.failure()
+			}
+			return nil, req.Context().Err()
+		}
+	}
+}
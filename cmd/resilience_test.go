@@ -0,0 +1,256 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerStates(t *testing.T) {
+	type step struct {
+		op    string // allow、success、failure、cancel 或 expire（模拟熔断到期）
+		allow bool   // op 为 allow 时期望的结果
+		state circuitState
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "opens after threshold",
+			steps: []step{
+				{op: "failure", state: circuitClosed},
+				{op: "allow", allow: true, state: circuitClosed},
+				{op: "failure", state: circuitOpen},
+				{op: "allow", allow: false, state: circuitOpen},
+			},
+		},
+		{
+			name: "success resets failures",
+			steps: []step{
+				{op: "failure", state: circuitClosed},
+				{op: "success", state: circuitClosed},
+				{op: "failure", state: circuitClosed},
+				{op: "allow", allow: true, state: circuitClosed},
+			},
+		},
+		{
+			name: "half open probe succeeds",
+			steps: []step{
+				{op: "failure", state: circuitClosed}, {op: "failure", state: circuitOpen},
+				{op: "expire", state: circuitOpen},
+				{op: "allow", allow: true, state: circuitHalfOpen},
+				{op: "allow", allow: false, state: circuitHalfOpen},
+				{op: "success", state: circuitClosed},
+				{op: "allow", allow: true, state: circuitClosed},
+			},
+		},
+		{
+			name: "half open probe fails",
+			steps: []step{
+				{op: "failure", state: circuitClosed}, {op: "failure", state: circuitOpen},
+				{op: "expire", state: circuitOpen},
+				{op: "allow", allow: true, state: circuitHalfOpen},
+				{op: "failure", state: circuitOpen},
+				{op: "allow", allow: false, state: circuitOpen},
+			},
+		},
+		{
+			name: "canceled probe allows another probe",
+			steps: []step{
+				{op: "failure", state: circuitClosed}, {op: "failure", state: circuitOpen},
+				{op: "expire", state: circuitOpen},
+				{op: "allow", allow: true, state: circuitHalfOpen},
+				{op: "cancel", state: circuitOpen},
+				{op: "allow", allow: true, state: circuitHalfOpen},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			breaker, err := newCircuitBreaker("test", &ConfigCircuitBreaker{Failures: 2, OpenDuration: "1m"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, s := range tt.steps {
+				switch s.op {
+				case "allow":
+					if got := breaker.allow(); got != s.allow {
+						t.Fatalf("step %d: allow = %v, want %v", i, got, s.allow)
+					}
+				case "success":
+					breaker.success()
+				case "failure":
+					breaker.failure()
+				case "cancel":
+					breaker.cancel()
+				case "expire":
+					breaker.openedAt = time.Now().Add(-breaker.openDuration)
+				}
+				if breaker.state != s.state {
+					t.Fatalf("step %d %s: state = %v, want %v", i, s.op, breaker.state, s.state)
+				}
+			}
+		})
+	}
+}
+
+func TestNilCircuitBreaker(t *testing.T) {
+	var breaker *circuitBreaker
+	breaker.failure()
+	breaker.success()
+	breaker.cancel()
+	if !breaker.allow() {
+		t.Error("nil breaker must allow every request")
+	}
+}
+
+func TestIsIdempotent(t *testing.T) {
+	tests := []struct {
+		method string
+		body   string
+		want   bool
+	}{
+		{http.MethodGet, "", true},
+		{http.MethodHead, "", true},
+		{http.MethodGet, "x", false},
+		{http.MethodPost, "", false},
+		{http.MethodPut, "", false},
+		{http.MethodDelete, "", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, "http://a.com/", strings.NewReader(tt.body))
+		if tt.body == "" {
+			r.Body = http.NoBody
+		}
+		if got := isIdempotent(r); got != tt.want {
+			t.Errorf("isIdempotent(%s, body %q) = %v, want %v", tt.method, tt.body, got, tt.want)
+		}
+	}
+}
+
+// countingTransport 按顺序返回预设的状态码，-1 表示连接失败
+type countingTransport struct {
+	statuses []int
+	calls    int
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	status := t.statuses[min(t.calls, len(t.statuses)-1)]
+	t.calls++
+	if status < 0 {
+		return nil, errors.New("connection refused")
+	}
+	return &http.Response{StatusCode: status, Body: http.NoBody, Request: req}, nil
+}
+
+func TestResilientTransportRetry(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		statuses []int
+		calls    int
+		status   int // 0 表示期望返回错误
+	}{
+		{"success", http.MethodGet, []int{200}, 1, 200},
+		{"retry until success", http.MethodGet, []int{503, -1, 200}, 3, 200},
+		{"give up after attempts", http.MethodGet, []int{502}, 3, 502},
+		{"give up on connection error", http.MethodHead, []int{-1}, 3, 0},
+		{"client error is not retried", http.MethodGet, []int{404}, 1, 404},
+		{"post is not retried", http.MethodPost, []int{503, 200}, 1, 503},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := &countingTransport{statuses: tt.statuses}
+			upstream := &Upstream{Name: "test", retry: retryPolicy{attempts: 3, backoff: time.Millisecond, maxBackoff: time.Millisecond}}
+			transport := &resilientTransport{upstream: upstream, next: next}
+
+			req := httptest.NewRequest(tt.method, "http://a.com/", nil)
+			response, err := transport.RoundTrip(req)
+			if next.calls != tt.calls {
+				t.Errorf("calls = %d, want %d", next.calls, tt.calls)
+			}
+			if tt.status == 0 {
+				if err == nil {
+					t.Errorf("expected error, got %d", response.StatusCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if response.StatusCode != tt.status {
+				t.Errorf("status = %d, want %d", response.StatusCode, tt.status)
+			}
+		})
+	}
+}
+
+func TestResilientTransportOpensBreaker(t *testing.T) {
+	breaker, err := newCircuitBreaker("test", &ConfigCircuitBreaker{Failures: 1, OpenDuration: "1m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := &countingTransport{statuses: []int{503}}
+	upstream := &Upstream{Name: "test", retry: retryPolicy{attempts: 1}, breaker: breaker}
+	transport := &resilientTransport{upstream: upstream, next: next}
+
+	if _, err := transport.RoundTrip(httptest.NewRequest(http.MethodGet, "http://a.com/", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := transport.RoundTrip(httptest.NewRequest(http.MethodGet, "http://a.com/", nil)); !errors.Is(err, errCircuitOpen) {
+		t.Errorf("err = %v, want errCircuitOpen", err)
+	}
+	if next.calls != 1 {
+		t.Errorf("calls = %d, want 1", next.calls)
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	policy := retryPolicy{attempts: 5, backoff: 100 * time.Millisecond, maxBackoff: 300 * time.Millisecond}
+	tests := []struct {
+		attempt  int
+		min, max time.Duration
+	}{
+		{1, 50 * time.Millisecond, 100 * time.Millisecond},
+		{2, 100 * time.Millisecond, 200 * time.Millisecond},
+		{3, 150 * time.Millisecond, 300 * time.Millisecond},
+		{10, 150 * time.Millisecond, 300 * time.Millisecond},
+		{80, 150 * time.Millisecond, 300 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 20; i++ {
+			if delay := policy.delay(tt.attempt); delay < tt.min || delay > tt.max {
+				t.Fatalf("delay(%d) = %v, want between %v and %v", tt.attempt, delay, tt.min, tt.max)
+			}
+		}
+	}
+}
+
+func TestParseRetryPolicyBackoff(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   ConfigRetry
+		min, max time.Duration
+	}{
+		{"default backoff", ConfigRetry{Attempts: 2}, defaultRetryBackoff / 2, defaultRetryBackoff},
+		{"zero backoff retries immediately", ConfigRetry{Attempts: 3, Backoff: "0s"}, 0, 0},
+		{"zero max backoff", ConfigRetry{Attempts: 3, Backoff: "100ms", MaxBackoff: "0s"}, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy, err := parseRetryPolicy("test", &tt.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for attempt := 1; attempt < tt.config.Attempts; attempt++ {
+				if delay := policy.delay(attempt); delay < tt.min || delay > tt.max {
+					t.Errorf("delay(%d) = %v, want between %v and %v", attempt, delay, tt.min, tt.max)
+				}
+			}
+		})
+	}
+}
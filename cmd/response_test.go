@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestProxyResponseHeaders(t *testing.T) {
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/not-modified":
+			w.Header().Set("ETag", `"v1"`)
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.WriteHeader(http.StatusNotModified)
+		case "/redirect":
+			w.Header().Set("Location", "/elsewhere")
+			w.WriteHeader(http.StatusFound)
+		case "/throttled":
+			w.Header().Set("Retry-After", "30")
+			w.Header().Set("ETag", `"busy"`)
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.WriteHeader(http.StatusTooManyRequests)
+			_, _ = w.Write([]byte("upstream throttled"))
+		default:
+			w.Header().Set("Content-Type", "text/plain")
+			_, _ = w.Write([]byte("probe"))
+		}
+	})
+	newTestProxy(t, upstream, Config{}, nil)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		status int
+		header map[string]string // 空值表示该响应头不存在
+		body   bool
+	}{
+		{"not modified keeps validators", http.MethodGet, "/not-modified", http.StatusNotModified,
+			map[string]string{"ETag": `"v1"`, "Cache-Control": "max-age=60"}, false},
+		{"redirect keeps location", http.MethodGet, "/redirect", http.StatusFound,
+			map[string]string{"Location": "/elsewhere"}, true},
+		{"error page keeps retry after", http.MethodGet, "/throttled", http.StatusTooManyRequests,
+			map[string]string{"Retry-After": "30", "ETag": ""}, true},
+		{"head has no body", http.MethodHead, "/probe", http.StatusOK,
+			map[string]string{"Content-Type": "text/plain"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			mainProxyHandler(w, httptest.NewRequest(tt.method, "http://"+testEntryHost+tt.path, nil))
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d", w.Code, tt.status)
+			}
+			for name, want := range tt.header {
+				if got := w.Header().Get(name); got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+			if !tt.body && w.Body.Len() != 0 {
+				t.Errorf("body = %q, want none", w.Body.String())
+			}
+			// 有响应体时 Content-Length 必须与实际写出的内容一致
+			if length := w.Header().Get("Content-Length"); tt.body && length != "" && length != strconv.Itoa(w.Body.Len()) {
+				t.Errorf("Content-Length = %s, body has %d bytes", length, w.Body.Len())
+			}
+		})
+	}
+
+	// 错误页面替换了上游的响应体与类型
+	w := proxyGet("http://"+testEntryHost+"/throttled", nil)
+	if bytes.Contains(w.Body.Bytes(), []byte("upstream throttled")) || w.Header().Get("Content-Type") == "application/octet-stream" {
+		t.Errorf("error response not replaced: %s %q", w.Header().Get("Content-Type"), w.Body.String())
+	}
+}
+
+func TestProxyCompressedUpstream(t *testing.T) {
+	const content = "window.game = 'ra2web';"
+	encoders := map[string]func(io.Writer) io.WriteCloser{
+		"gzip": func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) },
+		"deflate": func(w io.Writer) io.WriteCloser {
+			fw, _ := flate.NewWriter(w, flate.DefaultCompression)
+			return fw
+		},
+		"br": func(w io.Writer) io.WriteCloser { return brotli.NewWriter(w) },
+		"zstd": func(w io.Writer) io.WriteCloser {
+			zw, _ := zstd.NewWriter(w)
+			return zw
+		},
+	}
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// 路径 /<编码>/app.js 使用对应算法压缩响应体
+		encoding := filepath.Base(filepath.Dir(r.URL.Path))
+		var buf bytes.Buffer
+		ew := encoders[encoding](&buf)
+		_, _ = ew.Write([]byte(content))
+		_ = ew.Close()
+		w.Header().Set("Content-Type", "application/javascript")
+		w.Header().Set("Content-Encoding", encoding)
+		_, _ = w.Write(buf.Bytes())
+	})
+	newTestProxy(t, upstream, Config{}, nil)
+
+	for encoding := range encoders {
+		t.Run(encoding, func(t *testing.T) {
+			path := "/" + encoding + "/app.js"
+			w := proxyGet("http://"+testEntryHost+path, nil)
+			if w.Code != http.StatusOK || w.Body.String() != content {
+				t.Fatalf("got %d %q, want the decoded body", w.Code, w.Body.String())
+			}
+			if got := w.Header().Get("Content-Encoding"); got != "" {
+				t.Errorf("Content-Encoding = %q, want none", got)
+			}
+			if got := w.Header().Get("Content-Length"); got != strconv.Itoa(len(content)) {
+				t.Errorf("Content-Length = %s, want %d", got, len(content))
+			}
+
+			// 原始层缓存保存解压后的内容
+			raw, err := os.ReadFile(filepath.Join(cacheDir, "main.site", encoding, "app.js"))
+			if err != nil || string(raw) != content {
+				t.Fatalf("raw cache = %q (%v), want %q", raw, err, content)
+			}
+
+			// 命中缓存时按客户端支持的算法重新压缩
+			w = proxyGet("http://"+testEntryHost+path, map[string]string{"Accept-Encoding": "br"})
+			if got := w.Header().Get("Content-Encoding"); got != "br" {
+				t.Fatalf("cached Content-Encoding = %q, want br", got)
+			}
+			body, err := io.ReadAll(brotli.NewReader(w.Body))
+			if err != nil || string(body) != content {
+				t.Errorf("cached body = %q (%v), want %q", body, err, content)
+			}
+		})
+	}
+}
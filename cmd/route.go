@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// ConfigRoute 定义单条路由规则，按配置顺序匹配，第一条命中的规则生效
+type ConfigRoute struct {
+	Hosts       []string     `json:"hosts"`        // 请求主机，支持 *.example.com 形式的通配，为空时匹配全部主机
+	PathPrefix  string       `json:"path_prefix"`  // 路径前缀，例如 /v2/
+	PathRegex   string       `json:"path_regex"`   // 路径正则表达式，与 path_prefix 同时配置时两者都需要满足
+	Methods     []string     `json:"methods"`      // 请求方法，为空时匹配全部方法
+	Upstream    string       `json:"upstream"`     // 转发到的上游名称，对应 upstreams 中的配置
+	StripPrefix string       `json:"strip_prefix"` // 转发前去掉的路径前缀
+	AddPrefix   string       `json:"add_prefix"`   // 转发前添加的路径前缀
+	Headers     *HeaderRules `json:"headers"`      // 追加在全局规则之后的头部改写规则
+}
+
+// route 编译后的路由规则
+type route struct {
+	ConfigRoute
+	pathRegex *regexp.Regexp
+}
+
+// RouteMatch 定义请求的路由结果
+type RouteMatch struct {
+	Upstream *Upstream    // 上游，同时决定缓存目录
+	Path     string       // 转发到上游的请求路径
+	Headers  *HeaderRules // 路由规则中的头部改写规则
+}
+
+// compileRoutes 校验并编译路由规则，规则引用的上游必须存在
+func compileRoutes(configRoutes []ConfigRoute, upstreams map[string]*Upstream) ([]route, error) {
+	compiled := make([]route, 0, len(configRoutes))
+	for i, configRoute := range configRoutes {
+		if _, ok := upstreams[configRoute.Upstream]; !ok {
+			return nil, fmt.Errorf("routes[%d]: unknown upstream %q", i, configRoute.Upstream)
+		}
+		if err := validateHeaderRules(fmt.Sprintf("routes[%d].headers", i), configRoute.Headers); err != nil {
+			return nil, err
+		}
+		rule := route{ConfigRoute: configRoute}
+		if configRoute.PathRegex != "" {
+			re, err := regexp.Compile(configRoute.PathRegex)
+			if err != nil {
+				return nil, fmt.Errorf("routes[%d]: invalid path_regex: %w", i, err)
+			}
+			rule.pathRegex = re
+		}
+		compiled = append(compiled, rule)
+	}
+	return compiled, nil
+}
+
+// matchHostPattern 判断主机名是否匹配，*.example.com 匹配 example.com 的任意子域名，不区分大小写
+func matchHostPattern(pattern string, host string) bool {
+	if suffix, ok := strings.CutPrefix(pattern, "*"); ok {
+		return strings.HasSuffix(strings.ToLower(host), strings.ToLower(suffix))
+	}
+	return strings.EqualFold(pattern, host)
+}
+
+// match 判断请求是否命中路由规则
+func (rule *route) match(host string, r *http.Request) bool {
+	if len(rule.Hosts) > 0 {
+		matched := false
+		for _, pattern := range rule.Hosts {
+			if matchHostPattern(pattern, host) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(rule.Methods) > 0 {
+		matched := false
+		for _, method := range rule.Methods {
+			if strings.EqualFold(method, r.Method) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if rule.PathPrefix != "" && !strings.HasPrefix(r.URL.Path, rule.PathPrefix) {
+		return false
+	}
+	if rule.pathRegex != nil && !rule.pathRegex.MatchString(r.URL.Path) {
+		return false
+	}
+	return true
+}
+
+// rewritePath 按规则去掉并添加路径前缀
+func (rule *route) rewritePath(requestPath string) string {
+	if rule.StripPrefix != "" {
+		requestPath = strings.TrimPrefix(requestPath, rule.StripPrefix)
+		if !strings.HasPrefix(requestPath, "/") {
+			requestPath = "/" + requestPath
+		}
+	}
+	if rule.AddPrefix != "" {
+		requestPath = strings.TrimSuffix(rule.AddPrefix, "/") + requestPath
+	}
+	return requestPath
+}
+
+// resolveRoute 计算请求应该转发到的上游，先匹配路由规则，再按入口主机路由
+func resolveRoute(host string, r *http.Request) (RouteMatch, bool) {
+	rc := activeRuntime()
+	for i := range rc.routes {
+		rule := &rc.routes[i]
+		if rule.match(host, r) {
+			return RouteMatch{
+				Upstream: rc.upstreams[rule.Upstream],
+				Path:     rule.rewritePath(r.URL.Path),
+				Headers:  rule.Headers,
+			}, true
+		}
+	}
+
+	upstream, ok := rc.targets[host]
+	if !ok {
+		return RouteMatch{}, false
+	}
+	return RouteMatch{
+		Upstream: upstream,
+		Path:     r.URL.Path,
+	}, true
+}
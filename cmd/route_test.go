@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMatchHostPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		host    string
+		want    bool
+	}{
+		{"game.ra2web.cn", "game.ra2web.cn", true},
+		{"game.ra2web.cn", "GAME.ra2web.cn", true},
+		{"game.ra2web.cn", "cn.ra2web.cn", false},
+		{"*.ra2web.cn", "game.ra2web.cn", true},
+		{"*.ra2web.cn", "a.b.ra2web.cn", true},
+		{"*.ra2web.cn", "Game.RA2WEB.cn", true},
+		{"*.RA2WEB.cn", "game.ra2web.cn", true},
+		{"*.ra2web.cn", "ra2web.cn", false},
+		{"*.ra2web.cn", "gamera2web.cn", false},
+		{"*.ra2web.cn", "game.ra2web.cn.evil.com", false},
+	}
+	for _, tt := range tests {
+		if got := matchHostPattern(tt.pattern, tt.host); got != tt.want {
+			t.Errorf("matchHostPattern(%q, %q) = %v, want %v", tt.pattern, tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestRouteMatch(t *testing.T) {
+	upstreams := map[string]*Upstream{"main": {Name: "main"}}
+
+	tests := []struct {
+		name   string
+		route  ConfigRoute
+		method string
+		host   string
+		path   string
+		want   bool
+	}{
+		{"empty rule", ConfigRoute{}, "GET", "a.com", "/x", true},
+		{"host", ConfigRoute{Hosts: []string{"a.com", "*.b.com"}}, "GET", "x.b.com", "/", true},
+		{"host mismatch", ConfigRoute{Hosts: []string{"a.com"}}, "GET", "c.com", "/", false},
+		{"method", ConfigRoute{Methods: []string{"get", "HEAD"}}, "GET", "a.com", "/", true},
+		{"method mismatch", ConfigRoute{Methods: []string{"GET"}}, "POST", "a.com", "/", false},
+		{"prefix", ConfigRoute{PathPrefix: "/v2/"}, "GET", "a.com", "/v2/index.html", true},
+		{"prefix mismatch", ConfigRoute{PathPrefix: "/v2/"}, "GET", "a.com", "/v2", false},
+		{"regex", ConfigRoute{PathRegex: `\.js$`}, "GET", "a.com", "/dist/a.js", true},
+		{"regex mismatch", ConfigRoute{PathRegex: `\.js$`}, "GET", "a.com", "/dist/a.json", false},
+		{"prefix and regex", ConfigRoute{PathPrefix: "/v2/", PathRegex: `\.js$`}, "GET", "a.com", "/v2/a.js", true},
+		{"prefix without regex", ConfigRoute{PathPrefix: "/v2/", PathRegex: `\.js$`}, "GET", "a.com", "/v2/a.css", false},
+		{"all conditions", ConfigRoute{Hosts: []string{"*.a.com"}, Methods: []string{"GET"}, PathPrefix: "/api/"}, "GET", "x.a.com", "/api/x", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.route.Upstream = "main"
+			routes, err := compileRoutes([]ConfigRoute{tt.route}, upstreams)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest(tt.method, "http://"+tt.host+tt.path, nil)
+			if got := routes[0].match(tt.host, r); got != tt.want {
+				t.Errorf("match = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRouteRewritePath(t *testing.T) {
+	tests := []struct {
+		strip, add string
+		path       string
+		want       string
+	}{
+		{"", "", "/a/b", "/a/b"},
+		{"/v2", "", "/v2/a.js", "/a.js"},
+		{"/v2/", "", "/v2/a.js", "/a.js"},
+		{"/v2", "", "/v2", "/"},
+		{"/v2", "", "/other/a.js", "/other/a.js"},
+		{"", "/static", "/a.js", "/static/a.js"},
+		{"", "/static/", "/a.js", "/static/a.js"},
+		{"/v2", "/v3", "/v2/a.js", "/v3/a.js"},
+		{"/v2/", "/v3/", "/v2/", "/v3/"},
+	}
+	for _, tt := range tests {
+		rule := route{ConfigRoute: ConfigRoute{StripPrefix: tt.strip, AddPrefix: tt.add}}
+		if got := rule.rewritePath(tt.path); got != tt.want {
+			t.Errorf("strip %q add %q: rewritePath(%q) = %q, want %q", tt.strip, tt.add, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestCompileRoutesErrors(t *testing.T) {
+	upstreams := map[string]*Upstream{"main": {Name: "main"}}
+	tests := []struct {
+		name  string
+		route ConfigRoute
+	}{
+		{"unknown upstream", ConfigRoute{Upstream: "gone"}},
+		{"invalid regex", ConfigRoute{Upstream: "main", PathRegex: "("}},
+	}
+	for _, tt := range tests {
+		if _, err := compileRoutes([]ConfigRoute{tt.route}, upstreams); err == nil {
+			t.Errorf("%s: expected error", tt.name)
+		}
+	}
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// listenFDsEnv 平滑重启时传递给新进程的监听套接字，格式为 name=fd，例如 http=3,https=4
+	listenFDsEnv = "RA2PROXY_LISTEN_FDS"
+	// readyFDEnv 新进程开始服务后通过该管道通知旧进程
+	readyFDEnv = "RA2PROXY_READY_FD"
+
+	defaultShutdownTimeout = 30 * time.Second
+	// handoffTimeout 等待新进程就绪的最长时间，超时后旧进程继续服务
+	handoffTimeout = time.Minute
+)
+
+// proxyServer 一个监听端口及其 HTTP 服务
+type proxyServer struct {
+	name     string // http 或 https，同时作为平滑重启时套接字的名称
+	server   *http.Server
+	listener net.Listener
+	tls      bool
+}
+
+// serve 开始处理请求，直到服务被关闭
+func (s *proxyServer) serve() error {
+	log.Info().Msgf("Serving %s on %s", s.name, s.listener.Addr())
+	var err error
+	if s.tls {
+		// 证书已经在 TLSConfig 中加载
+		err = s.server.ServeTLS(s.listener, "", "")
+	} else {
+		err = s.server.Serve(s.listener)
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// newProxyServers 创建 http 与 https 服务，优先使用旧进程传递的监听套接字。
+// 证书在此预先加载，确保通知旧进程就绪之前能够发现证书错误
+func newProxyServers(c *Config) ([]*proxyServer, error) {
+	inherited, err := inheritedListeners()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		// 端口已经修改或不再需要的套接字直接关闭
+		for _, listener := range inherited {
+			listener.Close()
+		}
+	}()
+
+	type serverConfig struct {
+		name      string
+		port      int
+		cert, key string
+	}
+	configs := []serverConfig{{name: "http", port: c.HTTP.Port}}
+	if c.HTTPS != nil {
+		configs = append(configs, serverConfig{name: "https", port: c.HTTPS.Port, cert: c.HTTPS.Cert, key: c.HTTPS.Key})
+	}
+
+	servers := make([]*proxyServer, 0, len(configs))
+	closeAll := func() {
+		for _, s := range servers {
+			s.listener.Close()
+		}
+	}
+	for _, sc := range configs {
+		server := &http.Server{Handler: http.DefaultServeMux}
+		if sc.cert != "" {
+			certificate, err := tls.LoadX509KeyPair(sc.cert, sc.key)
+			if err != nil {
+				closeAll()
+				return nil, fmt.Errorf("load certificate: %w", err)
+			}
+			server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{certificate}}
+		}
+
+		addr := ":" + strconv.Itoa(sc.port)
+		listener, ok := inherited[sc.name]
+		if ok && listenerPort(listener) == sc.port {
+			delete(inherited, sc.name)
+			log.Info().Str("server", sc.name).Msgf("Inherited listener on %s", listener.Addr())
+		} else {
+			listener, err = listen(addr, c.ReusePort)
+			if err != nil {
+				closeAll()
+				return nil, fmt.Errorf("listen %s: %w", addr, err)
+			}
+		}
+		servers = append(servers, &proxyServer{
+			name:     sc.name,
+			server:   server,
+			listener: listener,
+			tls:      sc.cert != "",
+		})
+	}
+	return servers, nil
+}
+
+// listen 监听地址，reusePort 为 true 时设置 SO_REUSEPORT，允许新进程在旧进程退出前绑定同一端口
+func listen(addr string, reusePort bool) (net.Listener, error) {
+	lc := net.ListenConfig{}
+	if reusePort {
+		lc.Control = reusePortControl
+	}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+// listenerPort 返回监听套接字的端口
+func listenerPort(listener net.Listener) int {
+	if addr, ok := listener.Addr().(*net.TCPAddr); ok {
+		return addr.Port
+	}
+	return 0
+}
+
+// inheritedListeners 读取旧进程通过 RA2PROXY_LISTEN_FDS 传递的监听套接字
+func inheritedListeners() (map[string]net.Listener, error) {
+	value := os.Getenv(listenFDsEnv)
+	os.Unsetenv(listenFDsEnv)
+	listeners := map[string]net.Listener{}
+	if value == "" {
+		return listeners, nil
+	}
+
+	for _, item := range strings.Split(value, ",") {
+		name, fdValue, _ := strings.Cut(item, "=")
+		fd, err := strconv.Atoi(fdValue)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid fd %q", listenFDsEnv, item)
+		}
+		file := os.NewFile(uintptr(fd), name)
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: inherit %s: %w", listenFDsEnv, name, err)
+		}
+		listeners[name] = listener
+	}
+	return listeners, nil
+}
+
+// notifyParentReady 作为平滑重启的新进程时，在开始服务后通知旧进程退出
+func notifyParentReady() {
+	value := os.Getenv(readyFDEnv)
+	os.Unsetenv(readyFDEnv)
+	if value == "" {
+		return
+	}
+	fd, err := strconv.Atoi(value)
+	if err != nil {
+		log.Error().Str("value", value).Msg("Invalid ready fd")
+		return
+	}
+	pipe := os.NewFile(uintptr(fd), "ready")
+	defer pipe.Close()
+	if _, err := pipe.Write([]byte("ready")); err != nil {
+		log.Error().Err(err).Msg("Error notifying parent process")
+	}
+}
+
+// handoff 启动新进程并将监听套接字传递给它，新进程就绪后返回，失败时旧进程继续服务
+func handoff(servers []*proxyServer) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyReader.Close()
+
+	var files []*os.File
+	var fds []string
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	for _, s := range servers {
+		filer, ok := s.listener.(interface{ File() (*os.File, error) })
+		if !ok {
+			readyWriter.Close()
+			return fmt.Errorf("listener of %s can not be passed to a new process", s.name)
+		}
+		file, err := filer.File()
+		if err != nil {
+			readyWriter.Close()
+			return err
+		}
+		// ExtraFiles 中第 i 个文件在新进程中的 fd 为 3+i
+		fds = append(fds, fmt.Sprintf("%s=%d", s.name, 3+len(files)))
+		files = append(files, file)
+	}
+	readyFD := 3 + len(files)
+	files = append(files, readyWriter)
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(), listenFDsEnv+"="+strings.Join(fds, ","), readyFDEnv+"="+strconv.Itoa(readyFD))
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("start new process: %w", err)
+	}
+	log.Info().Int("pid", cmd.Process.Pid).Msg("Started new process, waiting for it to be ready")
+
+	// 新进程退出时管道的写端随之关闭，读取会立即返回 EOF
+	readyWriter.Close()
+	go func() { _ = cmd.Wait() }()
+	_ = readyReader.SetReadDeadline(time.Now().Add(handoffTimeout))
+	buf := make([]byte, len("ready"))
+	if _, err := readyReader.Read(buf); err != nil {
+		_ = cmd.Process.Kill()
+		return fmt.Errorf("new process not ready: %w", err)
+	}
+	return nil
+}
+
+// shutdownServers 停止接受新连接并等待进行中的请求完成，超过 timeout 后强制关闭
+func shutdownServers(servers []*proxyServer, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, s := range servers {
+		wg.Add(1)
+		go func(s *proxyServer) {
+			defer wg.Done()
+			if err := s.server.Shutdown(ctx); err != nil {
+				log.Warn().Err(err).Str("server", s.name).Msg("Drain deadline exceeded, closing remaining connections")
+				_ = s.server.Close()
+			}
+		}(s)
+	}
+	wg.Wait()
+}
+
+// runServers 启动服务并处理信号：SIGINT/SIGTERM 平滑关闭，平滑重启信号（SIGUSR2）将监听套接字交给新进程后平滑关闭
+func runServers(c *Config) int {
+	servers, err := newProxyServers(c)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to start servers")
+		return 1
+	}
+
+	errs := make(chan error, len(servers))
+	for _, s := range servers {
+		go func(s *proxyServer) {
+			if err := s.serve(); err != nil {
+				errs <- fmt.Errorf("%s: %w", s.name, err)
+			}
+		}(s)
+	}
+	notifyParentReady()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, append([]os.Signal{os.Interrupt, syscall.SIGTERM}, restartSignals...)...)
+	code := 0
+	for done := false; !done; {
+		select {
+		case err := <-errs:
+			log.Error().Err(err).Msg("Server stopped unexpectedly")
+			code = 1
+			done = true
+		case sig := <-signals:
+			if isRestartSignal(sig) {
+				if err := handoff(servers); err != nil {
+					log.Error().Err(err).Msg("Restart failed, keep serving")
+					continue
+				}
+				log.Info().Msg("New process is ready, shutting down")
+			} else {
+				log.Info().Str("signal", sig.String()).Msg("Shutting down")
+			}
+			done = true
+		}
+	}
+
+	shutdownServers(servers, shutdownTimeout())
+	flushLogs(5 * time.Second)
+	log.Info().Msg("Server stopped")
+	return code
+}
+
+// shutdownTimeout 返回当前配置的停机等待时间，可以通过重新加载配置修改
+func shutdownTimeout() time.Duration {
+	if timeout, err := time.ParseDuration(currentConfig().ShutdownTimeout); err == nil && timeout > 0 {
+		return timeout
+	}
+	return defaultShutdownTimeout
+}
+
+// isRestartSignal 判断信号是否为平滑重启信号
+func isRestartSignal(sig os.Signal) bool {
+	for _, restart := range restartSignals {
+		if sig == restart {
+			return true
+		}
+	}
+	return false
+}
+
+// flushLogs 等待 logChannel 中已有的日志全部输出
+func flushLogs(timeout time.Duration) {
+	flushed := make(chan struct{})
+	select {
+	case logChannel <- LogMessage{flushed: flushed}:
+	case <-time.After(timeout):
+		return
+	}
+	select {
+	case <-flushed:
+	case <-time.After(timeout):
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// startTestServer 在随机端口启动一个 proxyServer，handler 处理全部请求
+func startTestServer(t *testing.T, handler http.Handler) *proxyServer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &proxyServer{name: "http", server: &http.Server{Handler: handler}, listener: listener}
+	go func() { _ = s.serve() }()
+	t.Cleanup(func() { _ = s.server.Close() })
+	return s
+}
+
+func TestShutdownServersDrainsInFlightRequests(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	s := startTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		_, _ = w.Write([]byte("done"))
+	}))
+	url := "http://" + s.listener.Addr().String() + "/download"
+
+	type result struct {
+		body string
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		response, err := http.Get(url)
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		defer response.Body.Close()
+		body, err := io.ReadAll(response.Body)
+		results <- result{string(body), err}
+	}()
+	<-started
+
+	stopped := make(chan struct{})
+	go func() {
+		shutdownServers([]*proxyServer{s}, 5*time.Second)
+		close(stopped)
+	}()
+
+	// 停机期间不再接受新连接，但进行中的请求继续处理
+	deadline := time.Now().Add(time.Second)
+	for {
+		conn, err := net.Dial("tcp", s.listener.Addr().String())
+		if err != nil {
+			break
+		}
+		conn.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("listener still accepts connections during shutdown")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case <-stopped:
+		t.Fatal("shutdown returned before the in-flight request finished")
+	default:
+	}
+
+	close(release)
+	if r := <-results; r.err != nil || r.body != "done" {
+		t.Errorf("in-flight request got %q, %v", r.body, r.err)
+	}
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown did not return after the request finished")
+	}
+}
+
+func TestShutdownServersDeadline(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan struct{})
+	s := startTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}))
+
+	failed := make(chan error, 1)
+	go func() {
+		_, err := http.Get("http://" + s.listener.Addr().String() + "/stuck")
+		failed <- err
+	}()
+	<-started
+
+	// 超过等待时间后强制关闭剩余连接
+	start := time.Now()
+	shutdownServers([]*proxyServer{s}, 50*time.Millisecond)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("shutdown took %s, want it bounded by the deadline", elapsed)
+	}
+	if err := <-failed; err == nil {
+		t.Error("stuck request should be cut off after the deadline")
+	}
+}
+
+func TestFlushLogs(t *testing.T) {
+	saved := logChannel
+	t.Cleanup(func() { logChannel = saved })
+
+	// 没有日志协程时也不会一直阻塞
+	logChannel = make(chan LogMessage)
+	start := time.Now()
+	flushLogs(50 * time.Millisecond)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("flushLogs blocked for %s without a logger", elapsed)
+	}
+
+	// 返回时之前排队的日志已经全部输出
+	logChannel = make(chan LogMessage, 10)
+	for i := 0; i < 5; i++ {
+		logChannel <- LogMessage{RequestURL: "/queued", StatusCode: http.StatusOK}
+	}
+	go logger(logChannel)
+	t.Cleanup(func() { close(logChannel) })
+	flushLogs(5 * time.Second)
+	if queued := len(logChannel); queued != 0 {
+		t.Errorf("%d log messages still queued after flush", queued)
+	}
+}
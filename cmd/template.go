@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"text/template/parse"
+)
+
+// publicEnvPrefix 模板中 env 函数只能读取以该前缀开头的环境变量，避免泄露进程的其他环境变量
+const publicEnvPrefix = "RA2PROXY_PUBLIC_"
+
+// version 构建版本号，发布时通过 -ldflags "-X main.version=x.y.z" 注入
+var version = "dev"
+
+// templateCache 缓存已解析的模板，key 为模板原文；previewTemplateCache 缓存预览使用的模板
+var templateCache, previewTemplateCache sync.Map
+
+// maxPreviewTemplates 预览模板缓存的数量上限，超过后清空。预览接口可以粘贴任意模板，
+// 不限制时缓存会随调用次数无限增长
+const maxPreviewTemplates = 256
+
+// previewTemplateCount 预览模板缓存中的模板数量
+var previewTemplateCount atomic.Int64
+
+// TemplateVars 定义模板渲染时可用的变量
+type TemplateVars struct {
+	Host      string  // 当前请求的主机名（不含端口）
+	Scheme    string  // 当前请求的协议: http/https，来自可信代理时取 X-Forwarded-Proto
+	ClientIP  string  // 客户端 IP
+	RequestID string  // 请求 ID，取自 X-Request-ID 请求头，没有时自动生成
+	MainHost  string  // 主站主机名
+	ResHost   string  // 资源站主机名
+	Version   string  // 构建版本号
+	Config    *Config // 当前生效的配置，预览粘贴的 hack 时为空配置
+
+	preview bool // 预览粘贴的 hack，env 总是返回空字符串，见 newPreviewTemplateVars
+}
+
+// templateFuncs 模板中可用的辅助函数
+var templateFuncs = template.FuncMap{
+	// env 读取 RA2PROXY_PUBLIC_ 开头的环境变量，例如 {{env "RA2PROXY_PUBLIC_CDN"}}
+	"env": templateEnv,
+	// default 当值为空时使用默认值，例如 {{env "RA2PROXY_PUBLIC_CDN" | default "res.ra2web.cn"}}
+	"default": func(def string, value string) string {
+		if value == "" {
+			return def
+		}
+		return value
+	},
+}
+
+// previewTemplateFuncs 预览时使用的辅助函数，env 只校验变量名而不读取环境变量，
+// 避免通过预览接口粘贴的 hack 读取环境变量
+var previewTemplateFuncs = template.FuncMap{
+	"env": func(name string) (string, error) {
+		return "", checkEnvName(name)
+	},
+	"default": templateFuncs["default"],
+}
+
+// templateEnv 读取环境变量，只允许 RA2PROXY_PUBLIC_ 开头的变量
+func templateEnv(name string) (string, error) {
+	if err := checkEnvName(name); err != nil {
+		return "", err
+	}
+	return os.Getenv(name), nil
+}
+
+func checkEnvName(name string) error {
+	if !strings.HasPrefix(name, publicEnvPrefix) {
+		return fmt.Errorf("env %q is not allowed, only %s* variables can be read", name, publicEnvPrefix)
+	}
+	return nil
+}
+
+// parseHackTemplate 校验模板语法，并检查 env 读取的变量名，使不允许读取的变量在加载时就报错
+func parseHackTemplate(text string) error {
+	tmpl, err := template.New("hack").Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return err
+	}
+	if tmpl.Tree == nil {
+		return nil
+	}
+	return checkTemplateEnv(tmpl.Tree.Root)
+}
+
+// checkTemplateEnv 遍历模板语法树，检查以字符串常量调用 env 时的变量名
+func checkTemplateEnv(node parse.Node) error {
+	var children []parse.Node
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return nil
+		}
+		children = n.Nodes
+	case *parse.ActionNode:
+		children = []parse.Node{n.Pipe}
+	case *parse.PipeNode:
+		if n == nil {
+			return nil
+		}
+		for _, cmd := range n.Cmds {
+			children = append(children, cmd)
+		}
+	case *parse.CommandNode:
+		if len(n.Args) >= 2 {
+			ident, isIdent := n.Args[0].(*parse.IdentifierNode)
+			name, isString := n.Args[1].(*parse.StringNode)
+			if isIdent && isString && ident.Ident == "env" {
+				if err := checkEnvName(name.Text); err != nil {
+					return err
+				}
+			}
+		}
+		children = n.Args
+	case *parse.IfNode:
+		children = []parse.Node{n.Pipe, n.List, n.ElseList}
+	case *parse.RangeNode:
+		children = []parse.Node{n.Pipe, n.List, n.ElseList}
+	case *parse.WithNode:
+		children = []parse.Node{n.Pipe, n.List, n.ElseList}
+	case *parse.TemplateNode:
+		children = []parse.Node{n.Pipe}
+	}
+	for _, child := range children {
+		if err := checkTemplateEnv(child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// perRequestFields 每个请求都不同的模板变量。hack 与 URL 改写的结果写入派生层缓存后返回给所有客户端，
+// 因此这些内容不能引用它们，只有请求头与响应头改写可以使用
+var perRequestFields = []string{"ClientIP", "RequestID"}
+
+// parseCachedTemplate 校验结果会被缓存的模板：除 parseHackTemplate 的检查外，不允许引用随请求变化的变量
+func parseCachedTemplate(text string) error {
+	if err := parseHackTemplate(text); err != nil {
+		return err
+	}
+	fields, err := templateFields(text)
+	if err != nil {
+		return err
+	}
+	if fields["."] {
+		return errors.New("the whole template context cannot be used, results are cached and shared by all clients")
+	}
+	for _, field := range perRequestFields {
+		if fields[field] {
+			return fmt.Errorf(".%s differs per request and cannot be used, results are cached and shared by all clients", field)
+		}
+	}
+	return nil
+}
+
+// templateFields 返回模板引用的顶层模板变量，例如 {{.Host}} 返回 Host。
+// with 与 range 内部的 . 不再指向模板变量，只记录 $.Host 形式的引用；直接使用 . 或 $ 时记录为 "."
+func templateFields(text string) (map[string]bool, error) {
+	fields := map[string]bool{}
+	if !strings.Contains(text, "{{") {
+		return fields, nil
+	}
+	tmpl, err := template.New("hack").Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	if tmpl.Tree != nil {
+		collectTemplateFields(tmpl.Tree.Root, true, fields)
+	}
+	return fields, nil
+}
+
+// collectTemplateFields 遍历模板语法树收集引用的模板变量，root 表示当前的 . 是否为模板变量本身
+func collectTemplateFields(node parse.Node, root bool, fields map[string]bool) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			collectTemplateFields(child, root, fields)
+		}
+	case *parse.ActionNode:
+		collectTemplateFields(n.Pipe, root, fields)
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+		for _, decl := range n.Decl {
+			collectTemplateFields(decl, root, fields)
+		}
+		for _, cmd := range n.Cmds {
+			collectTemplateFields(cmd, root, fields)
+		}
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			collectTemplateFields(arg, root, fields)
+		}
+	case *parse.ChainNode:
+		collectTemplateFields(n.Node, root, fields)
+	case *parse.FieldNode:
+		if root {
+			fields[n.Ident[0]] = true
+		}
+	case *parse.DotNode:
+		if root {
+			fields["."] = true
+		}
+	case *parse.VariableNode:
+		if n.Ident[0] == "$" {
+			if len(n.Ident) > 1 {
+				fields[n.Ident[1]] = true
+			} else {
+				fields["."] = true
+			}
+		}
+	case *parse.IfNode:
+		collectTemplateFields(n.Pipe, root, fields)
+		collectTemplateFields(n.List, root, fields)
+		collectTemplateFields(n.ElseList, root, fields)
+	case *parse.RangeNode:
+		collectScopedFields(&n.BranchNode, root, fields)
+	case *parse.WithNode:
+		collectScopedFields(&n.BranchNode, root, fields)
+	case *parse.TemplateNode:
+		collectTemplateFields(n.Pipe, root, fields)
+	}
+}
+
+// collectScopedFields 处理 with 与 range：内部的 . 为管道的值，只有管道本身是 . 时仍指向模板变量
+func collectScopedFields(n *parse.BranchNode, root bool, fields map[string]bool) {
+	pipeFields := map[string]bool{}
+	collectTemplateFields(n.Pipe, root, pipeFields)
+	for field := range pipeFields {
+		if field != "." {
+			fields[field] = true
+		}
+	}
+	collectTemplateFields(n.List, root && pipeFields["."], fields)
+	collectTemplateFields(n.ElseList, root, fields)
+}
+
+// newTemplateVars 根据请求构建模板变量
+func newTemplateVars(r *http.Request) TemplateVars {
+	rc := activeRuntime()
+	remoteIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remoteIP = r.RemoteAddr
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	// 只有来自可信代理的请求才使用 X-Forwarded-Proto，客户端可以任意设置该请求头
+	if rc.isTrustedProxy(remoteIP) {
+		proto := strings.ToLower(strings.TrimSpace(strings.Split(r.Header.Get("X-Forwarded-Proto"), ",")[0]))
+		if proto == "http" || proto == "https" {
+			scheme = proto
+		}
+	}
+
+	c := rc.config
+	return TemplateVars{
+		Host:      strings.Split(r.Host, ":")[0],
+		Scheme:    scheme,
+		ClientIP:  rc.clientIP(r),
+		RequestID: requestID(r),
+		MainHost:  firstNonEmpty(c.MainHost, firstEntry(c.MainEntryList)),
+		ResHost:   firstNonEmpty(c.ResHost, firstEntry(c.ResEntryList)),
+		Version:   version,
+		Config:    c,
+	}
+}
+
+// newHostTemplateVars 根据入口主机与协议构建模板变量，不依赖具体的请求，用于预览 hack-map 中的 hack，
+// 渲染结果与该主机、协议下的线上请求一致
+func newHostTemplateVars(host string, scheme string) TemplateVars {
+	c := currentConfig()
+	return TemplateVars{
+		Host:      host,
+		Scheme:    scheme,
+		RequestID: "preview",
+		MainHost:  firstNonEmpty(c.MainHost, firstEntry(c.MainEntryList)),
+		ResHost:   firstNonEmpty(c.ResHost, firstEntry(c.ResEntryList)),
+		Version:   version,
+		Config:    c,
+	}
+}
+
+// newPreviewTemplateVars 构建预览粘贴的 hack 时使用的模板变量，Config 为空配置且 env 不读取环境变量，
+// 预览接口可以渲染任意粘贴的 hack，不能借此读出配置中的密钥与环境变量
+func newPreviewTemplateVars(host string, scheme string) TemplateVars {
+	vars := newHostTemplateVars(host, scheme)
+	vars.Config = &Config{}
+	vars.preview = true
+	return vars
+}
+
+// requestID 返回请求的 X-Request-ID，没有时生成一个并写回请求头，保证同一请求多次取值一致
+func requestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-ID"); id != "" {
+		return id
+	}
+	buf := make([]byte, 8)
+	_, _ = rand.Read(buf)
+	id := hex.EncodeToString(buf)
+	r.Header.Set("X-Request-ID", id)
+	return id
+}
+
+// renderTemplate 使用给定变量渲染模板文本，不含模板语法的文本原样返回
+func renderTemplate(text string, vars TemplateVars) (string, error) {
+	if !strings.Contains(text, "{{") {
+		return text, nil
+	}
+
+	cache, funcs := &templateCache, templateFuncs
+	if vars.preview {
+		cache, funcs = &previewTemplateCache, previewTemplateFuncs
+	}
+
+	var tmpl *template.Template
+	if cached, ok := cache.Load(text); ok {
+		tmpl = cached.(*template.Template)
+	} else {
+		parsed, err := template.New("hack").Funcs(funcs).Option("missingkey=error").Parse(text)
+		if err != nil {
+			return "", err
+		}
+		if vars.preview && previewTemplateCount.Add(1) > maxPreviewTemplates {
+			previewTemplateCache.Range(func(key, _ interface{}) bool {
+				previewTemplateCache.Delete(key)
+				return true
+			})
+			previewTemplateCount.Store(1)
+		}
+		cache.Store(text, parsed)
+		tmpl = parsed
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, vars); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func firstEntry(list []string) string {
+	if len(list) == 0 {
+		return ""
+	}
+	return list[0]
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestTemplateFields(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"plain text", nil},
+		{"{{.Host}}/{{.Scheme}}", []string{"Host", "Scheme"}},
+		{"{{.Config.BaseHref}}", []string{"Config"}},
+		{`{{env "RA2PROXY_PUBLIC_CDN" | default .ResHost}}`, []string{"ResHost"}},
+		{"{{if .MainHost}}{{.MainHost}}{{else}}{{.Host}}{{end}}", []string{"Host", "MainHost"}},
+		{"{{with .Config.BaseHref}}{{.}}{{.Host}}{{end}}", []string{"Config"}},
+		{"{{with .Config}}{{$.ClientIP}}{{else}}{{.Scheme}}{{end}}", []string{"ClientIP", "Config", "Scheme"}},
+		{"{{range .Config.MainEntryList}}{{.}}{{end}}", []string{"Config"}},
+		{"{{with .}}{{.RequestID}}{{end}}", []string{"RequestID"}},
+		{"{{$host := .Host}}{{$host}}", []string{"Host"}},
+		{"{{printf \"%v\" .}}", []string{"."}},
+		{"{{$}}", []string{"."}},
+		{"{{(.Config).CacheDir}}", []string{"Config"}},
+	}
+	for _, tt := range tests {
+		fields, err := templateFields(tt.text)
+		if err != nil {
+			t.Fatalf("templateFields(%q): %v", tt.text, err)
+		}
+		var got []string
+		for field := range fields {
+			got = append(got, field)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("templateFields(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestParseCachedTemplate(t *testing.T) {
+	tests := []struct {
+		text string
+		want string // 期望的错误片段，空字符串表示合法
+	}{
+		{"{{.Host}} {{.Scheme}} {{.Config.BaseHref}}", ""},
+		{"{{.ClientIP}}", ".ClientIP differs per request"},
+		{"{{with .Config}}{{$.RequestID}}{{end}}", ".RequestID differs per request"},
+		{"{{printf \"%v\" .}}", "whole template context"},
+		{`{{env "HOME"}}`, "not allowed"},
+		{"{{.Host", "unclosed action"},
+	}
+	for _, tt := range tests {
+		err := parseCachedTemplate(tt.text)
+		if tt.want == "" {
+			if err != nil {
+				t.Errorf("parseCachedTemplate(%q): %v", tt.text, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("parseCachedTemplate(%q) = %v, want error containing %q", tt.text, err, tt.want)
+		}
+	}
+}
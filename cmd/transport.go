@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// ConfigTimeouts 定义访问上游的各阶段超时时间，为空时使用默认值
+type ConfigTimeouts struct {
+	Dial           string `json:"dial"`            // 建立连接的超时时间，默认为 30s
+	TLSHandshake   string `json:"tls_handshake"`   // TLS 握手的超时时间，默认为 10s
+	ResponseHeader string `json:"response_header"` // 等待响应头的超时时间，默认不限制
+	Total          string `json:"total"`           // 单个请求包括重试与读取响应体在内的总超时时间，默认不限制
+}
+
+// ConfigUpstreamTLS 定义访问源站时的 TLS 配置
+type ConfigUpstreamTLS struct {
+	CAFile             string `json:"ca_file"`              // 额外信任的 CA 证书文件（PEM），用于私有 CA 签发的镜像
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"` // 跳过证书校验，仅用于测试环境
+	ServerName         string `json:"server_name"`          // 覆盖 SNI 与证书校验使用的主机名，用于按 IP 访问源站
+	CertFile           string `json:"cert_file"`            // 客户端证书文件（PEM）
+	KeyFile            string `json:"key_file"`             // 客户端证书私钥文件（PEM）
+}
+
+const (
+	defaultDialTimeout         = 30 * time.Second
+	defaultTLSHandshakeTimeout = 10 * time.Second
+)
+
+// parseDuration 解析配置中的时长，为空时返回默认值
+func parseDuration(field string, value string, defaultValue time.Duration) (time.Duration, error) {
+	if value == "" {
+		return defaultValue, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration < 0 {
+		return 0, fmt.Errorf("%s: invalid duration %q", field, value)
+	}
+	return duration, nil
+}
+
+// newBaseTransport 按上游配置创建访问源站的 Transport
+func newBaseTransport(name string, configUpstream ConfigUpstream) (*http.Transport, error) {
+	timeouts := configUpstream.Timeouts
+	// timeout 为 timeouts.response_header 的简写
+	if timeouts.ResponseHeader == "" {
+		timeouts.ResponseHeader = configUpstream.Timeout
+	}
+
+	dialTimeout, err := parseDuration("upstreams."+name+".timeouts.dial", timeouts.Dial, defaultDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	tlsHandshakeTimeout, err := parseDuration("upstreams."+name+".timeouts.tls_handshake", timeouts.TLSHandshake, defaultTLSHandshakeTimeout)
+	if err != nil {
+		return nil, err
+	}
+	responseHeaderTimeout, err := parseDuration("upstreams."+name+".timeouts.response_header", timeouts.ResponseHeader, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{
+		Timeout:   dialTimeout,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	transport.TLSHandshakeTimeout = tlsHandshakeTimeout
+	transport.ResponseHeaderTimeout = responseHeaderTimeout
+
+	if configUpstream.TLS != nil {
+		tlsConfig, err := newUpstreamTLSConfig(name, configUpstream.TLS)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	// 出口代理支持 http、https 与 socks5，为空时沿用 HTTP_PROXY 等环境变量
+	if configUpstream.Proxy != "" {
+		proxyURL, err := url.Parse(configUpstream.Proxy)
+		if err != nil || proxyURL.Host == "" {
+			return nil, fmt.Errorf("upstreams.%s.proxy: invalid url %q", name, configUpstream.Proxy)
+		}
+		switch proxyURL.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return nil, fmt.Errorf("upstreams.%s.proxy: unsupported scheme %q", name, proxyURL.Scheme)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	// 关闭 HTTP/2 时需要清空 TLSNextProto，否则仍然会通过 ALPN 协商 HTTP/2
+	if configUpstream.HTTP2 != nil && !*configUpstream.HTTP2 {
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	return transport, nil
+}
+
+// newUpstreamTLSConfig 按配置创建访问源站使用的 TLS 配置
+func newUpstreamTLSConfig(name string, config *ConfigUpstreamTLS) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         config.ServerName,
+		InsecureSkipVerify: config.InsecureSkipVerify,
+	}
+
+	if config.CAFile != "" {
+		pem, err := os.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("upstreams.%s.tls.ca_file: %w", name, err)
+		}
+		// 在系统证书之外额外信任配置的 CA
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("upstreams.%s.tls.ca_file: no certificate found in %s", name, config.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if config.CertFile != "" || config.KeyFile != "" {
+		if config.CertFile == "" || config.KeyFile == "" {
+			return nil, fmt.Errorf("upstreams.%s.tls: cert_file and key_file must be set together", name)
+		}
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("upstreams.%s.tls: %w", name, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writePEM 将 PEM 块写入临时目录下的文件并返回路径
+func writePEM(t *testing.T, name string, blockType string, der []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestProxyUpstreamTransport(t *testing.T) {
+	// 源站返回收到的 SNI、Host、协议版本与客户端证书数量
+	origin := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintf(w, "sni=%s host=%s proto=%d certs=%d", r.TLS.ServerName, r.Host, r.ProtoMajor, len(r.TLS.PeerCertificates))
+	}))
+	origin.EnableHTTP2 = true
+	origin.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	origin.StartTLS()
+	t.Cleanup(origin.Close)
+
+	serverCert := origin.TLS.Certificates[0]
+	caFile := writePEM(t, "ca.pem", "CERTIFICATE", origin.Certificate().Raw)
+	keyDER, err := x509.MarshalPKCS8PrivateKey(serverCert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := writePEM(t, "client.pem", "CERTIFICATE", serverCert.Certificate[0])
+	keyFile := writePEM(t, "client.key", "PRIVATE KEY", keyDER)
+	disabled := false
+
+	tests := []struct {
+		name     string
+		upstream ConfigUpstream
+		want     string
+		status   int
+	}{
+		{
+			name:     "untrusted certificate",
+			upstream: ConfigUpstream{},
+			status:   http.StatusBadGateway,
+		},
+		{
+			name:     "private ca",
+			upstream: ConfigUpstream{TLS: &ConfigUpstreamTLS{CAFile: caFile}},
+			want:     "sni= host=" + origin.Listener.Addr().String() + " proto=2 certs=0",
+		},
+		{
+			name:     "sni and host override",
+			upstream: ConfigUpstream{TLS: &ConfigUpstreamTLS{CAFile: caFile, ServerName: "example.com"}, HostHeader: "origin.example.com"},
+			want:     "sni=example.com host=origin.example.com proto=2 certs=0",
+		},
+		{
+			name:     "insecure skip verify without http2",
+			upstream: ConfigUpstream{TLS: &ConfigUpstreamTLS{InsecureSkipVerify: true}, HTTP2: &disabled},
+			want:     "sni= host=" + origin.Listener.Addr().String() + " proto=1 certs=0",
+		},
+		{
+			name:     "client certificate",
+			upstream: ConfigUpstream{TLS: &ConfigUpstreamTLS{CAFile: caFile, CertFile: certFile, KeyFile: keyFile}},
+			want:     "sni= host=" + origin.Listener.Addr().String() + " proto=2 certs=1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.upstream.TargetURL = origin.URL
+			tt.upstream.EntryList = []string{testEntryHost}
+			newTestProxy(t, nil, Config{Upstreams: map[string]ConfigUpstream{"main": tt.upstream}}, nil)
+
+			w := proxyGet("http://"+testEntryHost+"/probe", nil)
+			status := tt.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			if w.Code != status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, status, w.Body.String())
+			}
+			if tt.want != "" && w.Body.String() != tt.want {
+				t.Errorf("got %q, want %q", w.Body.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestProxyUpstreamOutboundProxy(t *testing.T) {
+	// 出口代理收到绝对地址形式的请求，直接返回而不再转发
+	var requested string
+	outbound := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = r.URL.String()
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte("via proxy"))
+	}))
+	t.Cleanup(outbound.Close)
+
+	newTestProxy(t, nil, Config{Upstreams: map[string]ConfigUpstream{"main": {
+		TargetURL: "http://origin.internal.example",
+		EntryList: []string{testEntryHost},
+		Proxy:     outbound.URL,
+	}}}, nil)
+
+	w := proxyGet("http://"+testEntryHost+"/probe?x=1", nil)
+	if w.Code != http.StatusOK || w.Body.String() != "via proxy" {
+		t.Fatalf("got %d %q, want the outbound proxy response", w.Code, w.Body.String())
+	}
+	if requested != "http://origin.internal.example/probe?x=1" {
+		t.Errorf("outbound proxy got %q, want the absolute origin url", requested)
+	}
+}
+
+func TestNewBaseTransportErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		upstream ConfigUpstream
+	}{
+		{"proxy without host", ConfigUpstream{Proxy: "http://"}},
+		{"unsupported proxy scheme", ConfigUpstream{Proxy: "ftp://10.0.0.1:21"}},
+		{"missing ca file", ConfigUpstream{TLS: &ConfigUpstreamTLS{CAFile: filepath.Join(t.TempDir(), "missing.pem")}}},
+		{"cert without key", ConfigUpstream{TLS: &ConfigUpstreamTLS{CertFile: "client.pem"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := newBaseTransport("main", tt.upstream); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
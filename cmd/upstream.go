@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// ConfigUpstream 定义一个命名上游
+type ConfigUpstream struct {
+	TargetURL      string                `json:"target_url"`      // 上游地址，配置 origins 时可以为空
+	Origins        []ConfigOrigin        `json:"origins"`         // 多个源站，按优先级与权重转发并自动故障切换
+	EntryList      []string              `json:"entry_list"`      // 转发到该上游的入口主机
+	CacheNamespace string                `json:"cache_namespace"` // 缓存目录名，目录为 <cache_namespace>.site，为空时使用上游名称
+	Timeout        string                `json:"timeout"`         // 等待上游响应头的超时时间，例如 30s，为 timeouts.response_header 的简写
+	Timeouts       ConfigTimeouts        `json:"timeouts"`        // 各阶段的超时时间
+	Retry          *ConfigRetry          `json:"retry"`           // 幂等请求的重试策略，为空时不重试
+	CircuitBreaker *ConfigCircuitBreaker `json:"circuit_breaker"` // 熔断策略，为空时不熔断
+	TLS            *ConfigUpstreamTLS    `json:"tls"`             // 访问源站时的 TLS 配置
+	HostHeader     string                `json:"host_header"`     // 覆盖发送给源站的 Host 头，为空时使用源站地址中的主机名
+	Proxy          string                `json:"proxy"`           // 出口代理地址，例如 http://10.0.0.1:3128 或 socks5://127.0.0.1:1080
+	HTTP2          *bool                 `json:"http2"`           // 是否允许与源站使用 HTTP/2，默认允许
+	Headers        map[string]string     `json:"headers"`         // 转发到上游时附加的请求头，值支持模板变量
+	HealthCheck    *ConfigHealthCheck    `json:"health_check"`    // 主动健康检查，为空时只根据请求结果被动摘除源站
+	MaxFails       int                   `json:"max_fails"`       // 源站连续请求失败多少次后被暂时摘除，默认为 3
+	EjectDuration  string                `json:"eject_duration"`  // 被动摘除的时长，默认为 30s
+}
+
+// Upstream 定义解析后的命名上游
+type Upstream struct {
+	Name           string
+	Target         *url.URL // 第一个源站的地址，决定转发路径
+	Origins        []*Origin
+	EntryList      []string
+	CacheNamespace string
+	Headers        map[string]string
+	HostHeader     string
+	Transport      http.RoundTripper // 带熔断、重试与故障切换的 Transport
+
+	baseTransport http.RoundTripper
+	healthCheck   *healthCheck
+	maxFails      int
+	ejectDuration time.Duration
+	totalTimeout  time.Duration
+	retry         retryPolicy
+	breaker       *circuitBreaker
+	stopChecks    chan struct{}
+}
+
+// SiteDir 返回上游在缓存目录下的站点目录名
+func (u *Upstream) SiteDir() string {
+	return u.CacheNamespace + ".site"
+}
+
+// loadUpstreams 解析配置中的上游，main_target_url 与 res_target_url 分别作为 main、res 上游，
+// upstreams 中的同名配置优先
+func loadUpstreams(c Config) (map[string]*Upstream, error) {
+	configUpstreams := map[string]ConfigUpstream{}
+	if c.MainTargetURL != "" {
+		configUpstreams["main"] = ConfigUpstream{TargetURL: c.MainTargetURL, EntryList: c.MainEntryList}
+	}
+	if c.ResTargetURL != "" {
+		configUpstreams["res"] = ConfigUpstream{TargetURL: c.ResTargetURL, EntryList: c.ResEntryList}
+	}
+	for name, configUpstream := range c.Upstreams {
+		configUpstreams[name] = configUpstream
+	}
+
+	result := make(map[string]*Upstream, len(configUpstreams))
+	namespaces := map[string]string{}
+	for name, configUpstream := range configUpstreams {
+		origins, err := parseOrigins(name, configUpstream)
+		if err != nil {
+			return nil, err
+		}
+		check, err := parseHealthCheck(name, configUpstream.HealthCheck)
+		if err != nil {
+			return nil, err
+		}
+		ejectDuration, err := parseDuration("upstreams."+name+".eject_duration", configUpstream.EjectDuration, defaultEjectDuration)
+		if err != nil {
+			return nil, err
+		}
+		maxFails := configUpstream.MaxFails
+		if maxFails <= 0 {
+			maxFails = defaultMaxFails
+		}
+
+		namespace := configUpstream.CacheNamespace
+		if namespace == "" {
+			namespace = name
+		}
+		if other, ok := namespaces[namespace]; ok {
+			return nil, fmt.Errorf("upstreams.%s: cache_namespace %q already used by upstream %q", name, namespace, other)
+		}
+		namespaces[namespace] = name
+
+		transport, err := newBaseTransport(name, configUpstream)
+		if err != nil {
+			return nil, err
+		}
+		totalTimeout, err := parseDuration("upstreams."+name+".timeouts.total", configUpstream.Timeouts.Total, 0)
+		if err != nil {
+			return nil, err
+		}
+		retry, err := parseRetryPolicy(name, configUpstream.Retry)
+		if err != nil {
+			return nil, err
+		}
+		breaker, err := newCircuitBreaker(name, configUpstream.CircuitBreaker)
+		if err != nil {
+			return nil, err
+		}
+
+		upstream := &Upstream{
+			Name:           name,
+			Target:         origins[0].URL,
+			Origins:        origins,
+			EntryList:      configUpstream.EntryList,
+			CacheNamespace: namespace,
+			Headers:        configUpstream.Headers,
+			HostHeader:     configUpstream.HostHeader,
+			baseTransport:  transport,
+			healthCheck:    check,
+			maxFails:       maxFails,
+			ejectDuration:  ejectDuration,
+			totalTimeout:   totalTimeout,
+			retry:          retry,
+			breaker:        breaker,
+		}
+		upstream.Transport = &resilientTransport{upstream: upstream, next: &failoverTransport{upstream: upstream}}
+		result[name] = upstream
+	}
+	return result, nil
+}
+
+// entryTargets 返回入口主机到上游的映射，同一主机不能属于多个上游
+func entryTargets(upstreams map[string]*Upstream) (map[string]*Upstream, error) {
+	targets := map[string]*Upstream{}
+	for name, upstream := range upstreams {
+		for _, entry := range upstream.EntryList {
+			if owner, ok := targets[entry]; ok && owner.Name != name {
+				return nil, fmt.Errorf("entry host %q belongs to both upstream %q and %q", entry, owner.Name, name)
+			}
+			targets[entry] = upstream
+		}
+	}
+	return targets, nil
+}
+
+// upstreamByNamespace 根据缓存目录名查找上游
+func upstreamByNamespace(namespace string) (*Upstream, bool) {
+	for _, upstream := range currentUpstreams() {
+		if upstream.CacheNamespace == namespace {
+			return upstream, true
+		}
+	}
+	return nil, false
+}
+
+// setUpstreamHeaders 为转发到上游的请求附加配置的请求头
+func (u *Upstream) setUpstreamHeaders(r *http.Request, vars TemplateVars) error {
+	for name, value := range u.Headers {
+		rendered, err := renderTemplate(value, vars)
+		if err != nil {
+			return fmt.Errorf("failed to render header %s of upstream %s: %w", name, u.Name, err)
+		}
+		r.Header.Set(name, rendered)
+	}
+	return nil
+}
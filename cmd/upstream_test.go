@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestProxyNamedUpstreams(t *testing.T) {
+	backend := func(name string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/javascript")
+			_, _ = w.Write([]byte(name + ":" + r.Header.Get("X-Mirror")))
+		})
+	}
+	maps := httptest.NewServer(backend("maps"))
+	t.Cleanup(maps.Close)
+
+	hacks := []HackConfig{{
+		HackAction: ReplaceText,
+		HackSource: "/app.js",
+		Upstreams:  []string{"maps"},
+		HackDetail: HackDetail{Replacements: []TextReplacement{{Old: "maps", New: "maps-hacked", Limit: 1}}},
+	}}
+	newTestProxy(t, backend("game"), Config{Upstreams: map[string]ConfigUpstream{
+		"main": {EntryList: []string{testEntryHost}},
+		"maps": {
+			TargetURL:      maps.URL,
+			EntryList:      []string{"maps.example.com"},
+			CacheNamespace: "mirror-maps",
+			Headers:        map[string]string{"X-Mirror": "{{.Host}}"},
+		},
+	}}, hacks)
+
+	tests := []struct {
+		host     string
+		want     string
+		rawCache string // 原始层缓存文件，相对于缓存目录
+	}{
+		{testEntryHost, "game:", "main.site/app.js"},
+		{"maps.example.com", "maps-hacked:maps.example.com", "mirror-maps.site/app.js"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			// 第二次请求命中缓存
+			for round := 0; round < 2; round++ {
+				w := proxyGet("http://"+tt.host+"/app.js", nil)
+				if w.Code != http.StatusOK || w.Body.String() != tt.want {
+					t.Errorf("round %d: got %d %q, want %q", round, w.Code, w.Body.String(), tt.want)
+				}
+			}
+			if !fileExists(filepath.Join(cacheDir, tt.rawCache)) {
+				t.Errorf("raw cache %s not written", tt.rawCache)
+			}
+		})
+	}
+
+	if w := proxyGet("http://unknown.example.com/app.js", nil); w.Code != http.StatusForbidden {
+		t.Errorf("unknown host: status = %d, want 403", w.Code)
+	}
+}
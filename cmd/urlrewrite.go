@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// ConfigURLRewrite 定义响应内容中上游绝对地址的改写配置
+type ConfigURLRewrite struct {
+	Extensions []string         `json:"extensions"` // 需要改写的文件扩展名，为空时使用 defaultRewriteExtensions
+	Rules      []URLRewriteRule `json:"rules"`      // 改写规则，按顺序匹配
+}
+
+// URLRewriteRule 定义单条主机名改写规则
+type URLRewriteRule struct {
+	From  string   `json:"from"`  // 上游主机名，例如 game.chronodivide.com
+	To    string   `json:"to"`    // 改写后的主机名，支持模板变量，例如 {{.Host}}
+	Hosts []string `json:"hosts"` // 仅对这些请求主机生效，为空时对所有入口主机生效
+}
+
+// defaultRewriteExtensions 默认改写 HTML、JS、CSS、JSON 与 INI 文件
+var defaultRewriteExtensions = []string{".html", ".js", ".css", ".json", ".ini"}
+
+// rewritePatternCache 缓存每个上游主机名对应的匹配表达式
+var rewritePatternCache sync.Map
+
+// rewritePattern 匹配 http(s)://host、//host 以及 JSON 转义形式的 http(s):\/\/host，
+// 上游的显式端口会被去掉，末尾分组用于确认主机名已经结束，避免 a.com 误匹配 a.com.cn
+func rewritePattern(from string) *regexp.Regexp {
+	if cached, ok := rewritePatternCache.Load(from); ok {
+		return cached.(*regexp.Regexp)
+	}
+	re := regexp.MustCompile(`(?i)(https?:)?(//|\\/\\/)` + regexp.QuoteMeta(from) + `(?::\d+)?([^A-Za-z0-9.\-]|$)`)
+	rewritePatternCache.Store(from, re)
+	return re
+}
+
+// validateURLRewrite 检查改写规则，改写结果会写入派生层缓存，to 不能引用随请求变化的模板变量
+func validateURLRewrite(rewrite *ConfigURLRewrite) error {
+	if rewrite == nil {
+		return nil
+	}
+	for i, rule := range rewrite.Rules {
+		if rule.From == "" {
+			return fmt.Errorf("url_rewrite.rules[%d]: from is required", i)
+		}
+		if err := parseCachedTemplate(rule.To); err != nil {
+			return fmt.Errorf("url_rewrite.rules[%d]: invalid to template: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// urlRewriteRules 返回当前配置中对指定路径与请求主机生效的改写规则
+func urlRewriteRules(relPath string, host string) []URLRewriteRule {
+	return activeRuntime().urlRewriteRules(relPath, host)
+}
+
+// urlRewriteRules 返回对指定路径与请求主机生效的改写规则
+func (rc *runtimeConfig) urlRewriteRules(relPath string, host string) []URLRewriteRule {
+	rewrite := rc.config.URLRewrite
+	if rewrite == nil || len(rewrite.Rules) == 0 {
+		return nil
+	}
+
+	extensions := rewrite.Extensions
+	if len(extensions) == 0 {
+		extensions = defaultRewriteExtensions
+	}
+	ext := strings.ToLower(path.Ext(relPath))
+	matched := false
+	for _, e := range extensions {
+		if ext == e {
+			matched = true
+			break
+		}
+	}
+	if !matched {
+		return nil
+	}
+
+	var rules []URLRewriteRule
+	for _, rule := range rewrite.Rules {
+		if len(rule.Hosts) == 0 || containsString(rule.Hosts, host) {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// rewriteURLs 将内容中的上游绝对地址改写为当前请求对应的入口主机，
+// 协议统一改为当前请求的协议，协议相对地址保持协议相对
+func rewriteURLs(body []byte, rules []URLRewriteRule, vars TemplateVars) ([]byte, []HackRuleStat, error) {
+	text := string(body)
+	stats := make([]HackRuleStat, 0, len(rules))
+	for i, rule := range rules {
+		to, err := renderTemplate(rule.To, vars)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to render url rewrite %q: %w", rule.From, err)
+		}
+
+		matched := 0
+		text = rewritePattern(rule.From).ReplaceAllStringFunc(text, func(match string) string {
+			groups := rewritePattern(rule.From).FindStringSubmatch(match)
+			matched++
+			scheme := ""
+			if groups[1] != "" {
+				scheme = vars.Scheme + ":"
+			}
+			return scheme + groups[2] + to + groups[3]
+		})
+		stats = append(stats, HackRuleStat{Index: i, Action: "rewriteURL", Selector: rule.From, Matched: matched})
+	}
+	return []byte(text), stats, nil
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
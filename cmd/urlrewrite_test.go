@@ -0,0 +1,153 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRewriteURLs(t *testing.T) {
+	rules := []URLRewriteRule{{From: "game.chronodivide.com", To: "{{.Host}}"}}
+	vars := TemplateVars{Host: "cn.ra2web.cn", Scheme: "https"}
+
+	tests := []struct {
+		name    string
+		body    string
+		want    string
+		matched int
+	}{
+		{"https", `src="https://game.chronodivide.com/dist/a.js"`, `src="https://cn.ra2web.cn/dist/a.js"`, 1},
+		{"http uses request scheme", `http://game.chronodivide.com/`, `https://cn.ra2web.cn/`, 1},
+		{"protocol relative", `url(//game.chronodivide.com/a.png)`, `url(//cn.ra2web.cn/a.png)`, 1},
+		{"explicit port", `https://game.chronodivide.com:8443/a`, `https://cn.ra2web.cn/a`, 1},
+		{"json escaped", `"https:\/\/game.chronodivide.com\/a"`, `"https:\/\/cn.ra2web.cn\/a"`, 1},
+		{"json escaped protocol relative", `"\/\/game.chronodivide.com:80\/a"`, `"\/\/cn.ra2web.cn\/a"`, 1},
+		{"case insensitive", `HTTPS://Game.ChronoDivide.com/a`, `https://cn.ra2web.cn/a`, 1},
+		{"end of text", `https://game.chronodivide.com`, `https://cn.ra2web.cn`, 1},
+		{"query", `https://game.chronodivide.com?a=1`, `https://cn.ra2web.cn?a=1`, 1},
+		{"quote boundary", `'https://game.chronodivide.com'`, `'https://cn.ra2web.cn'`, 1},
+		{"multiple", `//game.chronodivide.com/a https://game.chronodivide.com/b`, `//cn.ra2web.cn/a https://cn.ra2web.cn/b`, 2},
+		{"longer domain", `https://game.chronodivide.com.cn/a`, `https://game.chronodivide.com.cn/a`, 0},
+		{"hyphen suffix", `https://game.chronodivide.com-cdn.net/a`, `https://game.chronodivide.com-cdn.net/a`, 0},
+		{"subdomain prefix", `https://xgame.chronodivide.com/a`, `https://xgame.chronodivide.com/a`, 0},
+		{"bare host", `host: game.chronodivide.com`, `host: game.chronodivide.com`, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, stats, err := rewriteURLs([]byte(tt.body), rules, vars)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+			if len(stats) != 1 || stats[0].Matched != tt.matched {
+				t.Errorf("got stats %+v, want matched %d", stats, tt.matched)
+			}
+		})
+	}
+}
+
+func TestURLRewriteRules(t *testing.T) {
+	rc := &runtimeConfig{config: &Config{URLRewrite: &ConfigURLRewrite{
+		Rules: []URLRewriteRule{
+			{From: "a.com", To: "{{.Host}}"},
+			{From: "b.com", To: "{{.Host}}", Hosts: []string{"cn.ra2web.cn"}},
+		},
+	}}}
+
+	tests := []struct {
+		relPath string
+		host    string
+		want    int
+	}{
+		{"/index.html", "cn.ra2web.cn", 2},
+		{"/index.html", "tw.ra2web.cn", 1},
+		{"/dist/main.JS", "tw.ra2web.cn", 1},
+		{"/config.ini", "cn.ra2web.cn", 2},
+		{"/res/a.png", "cn.ra2web.cn", 0},
+		{"/noext", "cn.ra2web.cn", 0},
+	}
+	for _, tt := range tests {
+		if got := rc.urlRewriteRules(tt.relPath, tt.host); len(got) != tt.want {
+			t.Errorf("urlRewriteRules(%q, %q) = %d rules, want %d", tt.relPath, tt.host, len(got), tt.want)
+		}
+	}
+
+	rc.config.URLRewrite.Extensions = []string{".png"}
+	if got := rc.urlRewriteRules("/index.html", "cn.ra2web.cn"); len(got) != 0 {
+		t.Errorf("custom extensions: got %d rules for html, want 0", len(got))
+	}
+	if got := rc.urlRewriteRules("/res/a.png", "cn.ra2web.cn"); len(got) != 2 {
+		t.Errorf("custom extensions: got %d rules for png, want 2", len(got))
+	}
+}
+
+func TestValidateURLRewrite(t *testing.T) {
+	tests := []struct {
+		rule    URLRewriteRule
+		wantErr bool
+	}{
+		{URLRewriteRule{From: "game.chronodivide.com", To: "{{.Host}}"}, false},
+		{URLRewriteRule{From: "game.chronodivide.com", To: "{{.ResHost}}"}, false},
+		{URLRewriteRule{To: "{{.Host}}"}, true},
+		{URLRewriteRule{From: "game.chronodivide.com", To: "{{.Host"}, true},
+		{URLRewriteRule{From: "game.chronodivide.com", To: "{{.ClientIP}}.example.com"}, true},
+	}
+	for _, tt := range tests {
+		err := validateURLRewrite(&ConfigURLRewrite{Rules: []URLRewriteRule{tt.rule}})
+		if (err != nil) != tt.wantErr {
+			t.Errorf("validateURLRewrite(%+v) error = %v, want error %v", tt.rule, err, tt.wantErr)
+		}
+	}
+}
+
+func TestProxyRewriteURLsPerScheme(t *testing.T) {
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/javascript")
+		_, _ = w.Write([]byte(`fetch("https://game.chronodivide.com/api")`))
+	})
+	newTestProxy(t, upstream, Config{URLRewrite: &ConfigURLRewrite{
+		Rules: []URLRewriteRule{{From: "game.chronodivide.com", To: "{{.Host}}"}},
+	}}, nil)
+
+	// 第二轮请求命中派生层缓存，两种协议的结果互不影响
+	for round := 0; round < 2; round++ {
+		for _, scheme := range []string{"http", "https", "http"} {
+			w := proxyGet(scheme+"://"+testEntryHost+"/app.js", nil)
+			want := `fetch("` + scheme + `://` + testEntryHost + `/api")`
+			if w.Code != http.StatusOK || w.Body.String() != want {
+				t.Errorf("round %d %s: got %d %s, want %s", round, scheme, w.Code, w.Body.String(), want)
+			}
+		}
+	}
+}
+
+func TestHackDigestScheme(t *testing.T) {
+	hacks := []HackConfig{
+		{HackAction: ReplaceText, HackSource: "/plain.js", HackDetail: HackDetail{Replacements: []TextReplacement{{Old: "a", New: "{{.Host}}"}}}},
+		{HackAction: ReplaceText, HackSource: "/scheme.js", HackDetail: HackDetail{Replacements: []TextReplacement{{Old: "a", New: "{{.Scheme}}://x"}}}},
+	}
+	rc := &runtimeConfig{config: &Config{URLRewrite: &ConfigURLRewrite{
+		Extensions: []string{".css"},
+		Rules:      []URLRewriteRule{{From: "game.chronodivide.com", To: "{{.Host}}"}},
+	}}, hacks: hacks, digests: newDigestCache()}
+
+	tests := []struct {
+		relPath  string
+		perProto bool
+	}{
+		{"/plain.js", false},
+		{"/scheme.js", true},
+		{"/style.css", true},
+	}
+	for _, tt := range tests {
+		http1, _ := hackDigest(rc, "main", tt.relPath, testEntryHost, "http")
+		https, _ := hackDigest(rc, "main", tt.relPath, testEntryHost, "https")
+		if http1 == "" || https == "" {
+			t.Fatalf("%s: expected digests", tt.relPath)
+		}
+		if (http1 != https) != tt.perProto {
+			t.Errorf("%s: http %s, https %s, want differ %v", tt.relPath, http1, https, tt.perProto)
+		}
+	}
+}
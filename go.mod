@@ -3,17 +3,19 @@ module ra2web-proxy
 go 1.22.5
 
 require (
+	github.com/BurntSushi/toml v1.4.0
 	github.com/PuerkitoBio/goquery v1.9.2
 	github.com/andybalholm/brotli v1.1.0
+	github.com/andybalholm/cascadia v1.3.2
 	github.com/klauspost/compress v1.17.11
 	github.com/rs/zerolog v1.33.0
 	golang.org/x/sync v0.1.0
+	golang.org/x/sys v0.22.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
-	github.com/andybalholm/cascadia v1.3.2 // indirect
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.19 // indirect
 	golang.org/x/net v0.27.0 // indirect
-	golang.org/x/sys v0.22.0 // indirect
 )